@@ -1,10 +1,17 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -16,193 +23,1048 @@ const DEFAULT_OTLP_LOGGER_NAME = "pve2otelcol"
 const DEFAULT_OTLP_EXPORTER = "grpc"
 const DEFAULT_OTLP_GRPC_URL = "http://localhost:4317"
 const DEFAULT_OTLP_HTTP_URL = "https://localhost:4318"
+const DEFAULT_OTLP_HTTP_PATH = "/v1/logs"
 const DEFAULT_OTLP_COMPRESSION = "gzip"
+const DEFAULT_OTLP_USER_AGENT = "pve2otelcol/" + version.VERSION
+const DEFAULT_OTLP_SCOPE_VERSION = version.VERSION
+const DEFAULT_OTLP_ERRORS_SEVERITY = "error"
 const DEFAULT_OTLP_GRPC_RECONNECTION_PERIOD = 10
 const DEFAULT_OTLP_INITIAL_INTERVAL = 2
 const DEFAULT_OTLP_MAX_INTERVAL = 10
 const DEFAULT_OTLP_MAX_ELAPSED_TIME = 30
 const DEFAULT_OTLP_TIMEOUT = 10000
+const DEFAULT_OTLP_PROCESSOR = "batch"
+const DEFAULT_OTLP_CREATE_RETRIES = 5
+const DEFAULT_OTLP_CREATE_RETRY_DELAY = 1
 const DEFAULT_OTLP_BATCH_BUFFER_SIZE = 1
 const DEFAULT_OTLP_BATCH_EXPORT_INTERVAL = 1
 const DEFAULT_OTLP_BATCH_MAX_BATCH_SIZE = 512
+const DEFAULT_OTLP_BATCH_MAX_QUEUE_SIZE = 2048
+const DEFAULT_OTLP_BATCH_MEMORY_BUDGET = 0
 const DEFAULT_REFRESH_INTERVAL = 10
 const DEFAULT_CMD_RETRY_TIMES = 5
 const DEFAULT_CMD_RETRY_DELAY = 5
+const DEFAULT_DISCOVERY_RETRIES = 2
+const DEFAULT_DISCOVERY_RETRY_DELAY = 1
+const DEFAULT_SERVICE_NAME_TEMPLATE = "{name}"
+const DEFAULT_LXC_MONITOR_CMD = "pct exec {id} -- journalctl --lines 0 --follow --output json"
+const DEFAULT_NESTED_LIST_CMD = "pct exec {id} -- docker ps --quiet"
+const DEFAULT_NESTED_MONITOR_CMD = "pct exec {id} -- docker logs --follow --tail 0 {container}"
+const DEFAULT_DRAIN_TIMEOUT = 5
+const DEFAULT_SHUTDOWN_TIMEOUT = 15
+const DEFAULT_DEDUP_WINDOW = 0
+const DEFAULT_MULTILINE_TIMEOUT = 1000
+const DEFAULT_LOG_FORMAT = "text"
+const DEFAULT_TEST_VM_RECORDS = 10
+const DEFAULT_LOG_LEVEL = "info"
+const DEFAULT_TRACE_ID_FIELDS = "TRACE_ID,OTEL_TRACE_ID"
+const DEFAULT_SPAN_ID_FIELDS = "SPAN_ID,OTEL_SPAN_ID"
+const DEFAULT_RATE_LIMIT = 0
+const DEFAULT_RATE_LIMIT_BURST = 0
+const DEFAULT_MIN_SEVERITY = "debug"
+const DEFAULT_TIMESTAMP_SOURCE = "journal"
+const DEFAULT_ATTR_KEY_STYLE = "dotted"
+const DEFAULT_BODY_FORMAT = "map"
+const DEFAULT_NODE_NAME_SOURCE = "hostname"
+const DEFAULT_INFLIGHT_POLICY = "block"
+
+// environment variables with the PEM data of the TLS certificates
+const ENV_TLS_CERT_PEM = "PVE2OTELCOL_TLS_CERT_PEM"
+const ENV_TLS_KEY_PEM = "PVE2OTELCOL_TLS_KEY_PEM"
+const ENV_TLS_CA_PEM = "PVE2OTELCOL_TLS_CA_PEM"
+
+// names of the severities of log records, from the lowest
+var SEVERITIES = []string{"debug", "info", "warn", "error", "fatal"}
+
+// maximum number of log lines per second accepted from a VM
+type RateLimit struct {
+	Rate  int
+	Burst int
+}
+
+// actions of the rules applied to log entries
+const (
+	RULE_DROP  = "drop"
+	RULE_KEEP  = "keep"
+	RULE_ROUTE = "route"
+)
+
+// action to apply to the log entries having a journald field set to a value
+type LogRule struct {
+	Field  string
+	Value  string
+	Action string
+}
 
 // store command line configuration.
 type Config struct {
-	OtlpLoggerName             string
-	OtlpExporter               string
-	OtlpgRPCURL                string
-	OtlpHTTPURL                string
-	OtlpTLSCertFile            string
-	OtlpTLSKeyFile             string
-	OtlpCompression            string
-	OtlpInitialInterval        int
-	OtlpMaxInterval            int
-	OtlpMaxElapsedTime         int
-	OtlpTimeout                int
-	OtlpBatchBufferSize        int
-	OtlpBatchExportInterval    int
-	OtlpBatchMaxBatchSize      int
-	OtlpgRPCReconnectionPeriod int
-
-	RefreshInterval int
-	CmdRetryTimes   int
-	CmdRetryDelay   int
-	SkipLXCs        bool
-	SkipPVE         bool
+	OtlpLoggerName              string
+	OtlpScopeVersion            string
+	ClusterName                 string
+	NodeNameSource              string
+	AttrsFile                   string
+	OtlpExporter                string
+	OtlpgRPCURL                 string
+	OtlpHTTPURL                 string
+	OtlpHTTPPath                string
+	FilePath                    string
+	OtlpErrorsURL               string
+	OtlpErrorsSeverity          string
+	OtlpTLSCertFile             string
+	OtlpTLSKeyFile              string
+	OtlpTLSServerName           string
+	OtlpTLSCertPEM              string
+	OtlpTLSKeyPEM               string
+	OtlpTLSCAPEM                string
+	OtlpCompression             string
+	OtlpGzipLevel               int
+	OtlpUserAgent               string
+	OtlpInitialInterval         int
+	OtlpMaxInterval             int
+	OtlpMaxElapsedTime          int
+	OtlpTimeout                 int
+	OtlpProcessor               string
+	OtlpSharedExporter          bool
+	OtlpBatchBufferSize         int
+	OtlpBatchExportInterval     int
+	OtlpBatchMaxBatchSize       int
+	OtlpBatchMaxQueueSize       int
+	OtlpgRPCBatchExportInterval int
+	OtlpgRPCBatchMaxBatchSize   int
+	OtlpHTTPBatchExportInterval int
+	OtlpHTTPBatchMaxBatchSize   int
+	OtlpBatchMemoryBudget       int
+	OtlpgRPCReconnectionPeriod  int
+	OtlpCreateRetries           int
+	OtlpCreateRetryDelay        int
+
+	TraceIdFields     []string
+	KeepFields        []string
+	DropFieldPatterns []string
+	// compiled DropFieldPatterns, set by Validate
+	dropFieldRegexps   []*regexp.Regexp
+	SpanIdFields       []string
+	KeepRawLine        bool
+	BootIdAttr         bool
+	TimestampSource    string
+	AttrKeyStyle       string
+	BodyFormat         string
+	MaxRecordBytes     int
+	Backpressure       bool
+	MaxInflightRecords int
+	InflightPolicy     string
+	AddIngestLatency   bool
+	ObservedIngestTime bool
+
+	ServiceNameTemplate   string
+	ServiceNamePrefix     string
+	LXCMonitorCmd         string
+	LXCLogSources         []LogSource
+	NestedTag             string
+	NestedListCmd         string
+	NestedMonitorCmd      string
+	JournalGrep           string
+	JournalPriority       string
+	JournalFacility       string
+	MonitorIdleTimeout    int
+	MonitorMaxLifetime    int
+	IncludeStoppedHistory int
+	RefreshInterval       int
+	DiscoveryRetries      int
+	DiscoveryRetryDelay   int
+	VMRemovalGrace        int
+	StartupDelay          int
+	StartupSplay          int
+	CmdRetryTimes         int
+	CmdRetryDelay         int
+	DrainTimeout          int
+	ShutdownTimeout       int
+	StopMarker            bool
+	DedupWindow           int
+	ReorderWindow         int
+	MultilineStart        string
+	MultilineTimeout      int
+	RateLimit             RateLimit
+	VMRateLimits          map[int]RateLimit
+	MinSeverity           string
+	VMMinSeverities       map[int]string
+	LogRules              []LogRule
+	SkipLXCs              bool
+	SkipPVE               bool
+	PveUnits              []string
+	PveExcludeUnits       []string
 	//SkipKVMs     	bool
 	MonitorInclude []int
 	MonitorExclude []int
+	MonitorTags    []string
+	IncludeNames   []string
+	ExcludeNames   []string
+
+	MetricsAddress string
 
-	DryRun  bool
-	Verbose bool
+	ListVMs       bool
+	TestVM        int
+	TestVMRecords int
+	TestVMSend    bool
+	RequireVMs    bool
+	DryRun        bool
+	LogFormat     string
+	LogLevel      string
+	Verbose       bool
 }
 
 // Split and trim comma-separated values
-func splitAndTrim(s string) []int {
+func splitAndTrim(s string) ([]int, error) {
 	ids := []int{}
 	parts := strings.Split(s, ",")
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
 		id, err := strconv.Atoi(part)
 		if err != nil {
-			slog.Error(fmt.Sprintf("include and exclude list items must be integers; wrong value: '%s'", part))
-			flag.PrintDefaults()
-			os.Exit(1)
+			return nil, fmt.Errorf("include and exclude list items must be integers; wrong value: '%s'", part)
 		}
 		ids = append(ids, id)
 	}
-	return ids
+	return ids, nil
 }
 
-// parse command line arguments.
-func ParseArgs() *Config {
-	c := Config{}
-	flag.StringVar(&c.OtlpLoggerName, "otlp-logger-name", DEFAULT_OTLP_LOGGER_NAME, "OpenTelemetry logger name")
+// split a comma-separated list of strings, ignoring empty items
+func splitStrings(s string) []string {
+	items := []string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			items = append(items, part)
+		}
+	}
+	return items
+}
 
-	flag.StringVar(&c.OtlpExporter, "otlp-exporter", DEFAULT_OTLP_EXPORTER, "OpenTelemetry exporter (\"grpc\" or \"http\")")
-	flag.StringVar(&c.OtlpgRPCURL, "otlp-grpc-url", DEFAULT_OTLP_GRPC_URL, "OpenTelemetry gRPC URL")
-	flag.StringVar(&c.OtlpHTTPURL, "otlp-http-url", DEFAULT_OTLP_HTTP_URL, "OpenTelemetry HTTP URL")
+// additional log source of the LXCs: a command template, like LXCMonitorCmd
+type LogSource struct {
+	Name string
+	Cmd  string
+}
 
-	flag.StringVar(&c.OtlpTLSCertFile, "otlp-tls-cert-file", "", "Path to the TLS certificate file")
-	flag.StringVar(&c.OtlpTLSKeyFile, "otlp-tls-key-file", "", "Path to the TLS key file")
-	flag.StringVar(&c.OtlpCompression, "otlp-compression", DEFAULT_OTLP_COMPRESSION,
-		"OpenTelemetry compression algorithm (\"gzip\" or \"none\")")
-	flag.IntVar(&c.OtlpInitialInterval, "otlp-initial-interval",
-		DEFAULT_OTLP_INITIAL_INTERVAL, "OpenTelemetry time to wait after the first failure before retrying in seconds")
-	flag.IntVar(&c.OtlpMaxInterval, "otlp-max-interval",
-		DEFAULT_OTLP_MAX_INTERVAL, "OpenTelemetry upper bound on backoff interval in seconds")
-	flag.IntVar(&c.OtlpMaxElapsedTime, "otlp-max-elapsed-time",
-		DEFAULT_OTLP_MAX_ELAPSED_TIME, "OpenTelemetry maximum amount of time (including retries) spent trying to send a request/batch in seconds")
-	flag.IntVar(&c.OtlpTimeout, "otlp-timeout",
-		DEFAULT_OTLP_TIMEOUT, "OpenTelemetry timeout in milliseconds")
+// name of the log source of the journal, followed by LXCMonitorCmd
+const JOURNAL_LOG_SOURCE = "journal"
 
-	flag.IntVar(&c.OtlpgRPCReconnectionPeriod, "otlp-grpc-reconnection-period",
-		DEFAULT_OTLP_GRPC_RECONNECTION_PERIOD, "OpenTelemetry minimum amount of time between connection attempts to the target endpoint in seconds")
+// parse a semicolon-separated list of NAME=COMMAND items; semicolons
+// are used since commands usually contain commas
+func parseLogSources(s string) ([]LogSource, error) {
+	sources := []LogSource{}
+	names := map[string]bool{JOURNAL_LOG_SOURCE: true}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, cmd, found := strings.Cut(part, "=")
+		name, cmd = strings.TrimSpace(name), strings.TrimSpace(cmd)
+		if !found || name == "" || cmd == "" {
+			return nil, fmt.Errorf("lxc-log-sources items must be in the NAME=COMMAND format; wrong value: '%s'", part)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("lxc-log-sources: duplicated or reserved name '%s'", name)
+		}
+		names[name] = true
+		sources = append(sources, LogSource{Name: name, Cmd: cmd})
+	}
+	return sources, nil
+}
 
-	flag.IntVar(&c.OtlpBatchBufferSize, "otlp-batch-buffer-size",
-		DEFAULT_OTLP_BATCH_BUFFER_SIZE, "OpenTelemetry batch buffer size that is kept in memory")
-	flag.IntVar(&c.OtlpBatchExportInterval, "otlp-batch-export-interval",
-		DEFAULT_OTLP_BATCH_EXPORT_INTERVAL, "OpenTelemetry maximum duration between batched exports in seconds")
-	flag.IntVar(&c.OtlpBatchMaxBatchSize, "otlp-batch-max-batch-size",
-		DEFAULT_OTLP_BATCH_MAX_BATCH_SIZE, "OpenTelemetry maximum batch size of every export")
+// parse a comma-separated list of ID:RATE[:BURST] items
+func parseRateLimits(s string) (map[int]RateLimit, error) {
+	limits := map[int]RateLimit{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		items := strings.Split(part, ":")
+		values := []int{}
+		for _, item := range items {
+			value, err := strconv.Atoi(item)
+			if err != nil || value < 0 {
+				values = nil
+				break
+			}
+			values = append(values, value)
+		}
+		if len(values) < 2 || len(values) > 3 {
+			return nil, fmt.Errorf("rate-limit-vm items must be in the ID:RATE[:BURST] format; wrong value: '%s'", part)
+		}
+		limit := RateLimit{Rate: values[1]}
+		if len(values) == 3 {
+			limit.Burst = values[2]
+		}
+		limits[values[0]] = limit
+	}
+	return limits, nil
+}
 
-	flag.IntVar(&c.RefreshInterval, "refresh-interval", DEFAULT_REFRESH_INTERVAL, "refresh interval in seconds")
-	flag.IntVar(&c.CmdRetryTimes, "cmd-retry-times", DEFAULT_CMD_RETRY_TIMES, "number of times a process is restarted before giving up")
-	flag.IntVar(&c.CmdRetryDelay, "cmd-retry-delay", DEFAULT_CMD_RETRY_DELAY, "seconds to wait before a process is restarted on failure")
-	flag.BoolVar(&c.SkipLXCs, "skip-lxcs", false, "do not monitor LXCs virtuals")
-	flag.BoolVar(&c.SkipPVE, "skip-pve", false, "do not monitor this PVE node")
-	// it will be reintroduced if we'll find a way to get the stdout stream from a qm exec command.
-	//flag.BoolVar(&c.SkipKVMs, "skip-vms", false, "do not consider Qemu/KVM virtuals")
-	var monitorInclude string
-	var monitorExclude string
-	flag.StringVar(&monitorInclude, "monitor-include", "", "Comma-separated list of IDs to include in monitoring")
-	flag.StringVar(&monitorExclude, "monitor-exclude", "", "Comma-separated list of IDs to exclude from monitoring")
+// parse a comma-separated list of FIELD=VALUE:ACTION items
+func parseLogRules(s string) ([]LogRule, error) {
+	rules := []LogRule{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		cond, action, found := strings.Cut(part, ":")
+		field, value, foundValue := strings.Cut(cond, "=")
+		if !found || !foundValue || field == "" ||
+			!slices.Contains([]string{RULE_DROP, RULE_KEEP, RULE_ROUTE}, action) {
+			return nil, fmt.Errorf("log-rules items must be in the FIELD=VALUE:ACTION format, "+
+				"with ACTION one of drop, keep or route; wrong value: '%s'", part)
+		}
+		rules = append(rules, LogRule{Field: field, Value: value, Action: action})
+	}
+	return rules, nil
+}
 
-	flag.BoolVar(&c.DryRun, "dry-run", false, "do not execute any command")
-	flag.BoolVar(&c.Verbose, "verbose", false, "be more verbose")
-	getVer := flag.Bool("version", false, "print version and quit")
+// parse a comma-separated list of ID:SEVERITY items
+func parseSeverities(s string) (map[int]string, error) {
+	severities := map[int]string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		strId, severity, found := strings.Cut(part, ":")
+		id, err := strconv.Atoi(strId)
+		if !found || err != nil {
+			return nil, fmt.Errorf("min-severity-vm items must be in the ID:SEVERITY format; wrong value: '%s'", part)
+		}
+		severities[id] = strings.ToLower(severity)
+	}
+	return severities, nil
+}
 
-	flag.Parse()
+// return the list of endpoints of the selected OTLP exporter; the first is the
+// primary one, the others are used as fallbacks. The file exporter has a single
+// endpoint: its file
+func (c *Config) OtlpURLs() []string {
+	if c.OtlpExporter == "http" {
+		return splitStrings(c.OtlpHTTPURL)
+	}
+	if c.OtlpExporter == "file" {
+		return []string{c.FilePath}
+	}
+	return splitStrings(c.OtlpgRPCURL)
+}
 
-	if *getVer {
-		fmt.Printf("version %s\n", version.VERSION)
-		os.Exit(0)
+// return the list of URLs that also receive the records at or above OtlpErrorsSeverity
+func (c *Config) OtlpErrorsURLs() []string {
+	return splitStrings(c.OtlpErrorsURL)
+}
+
+// return the maximum number of records held in memory by the batch processor of a logger
+func (c *Config) OtlpBatchCapacity() int {
+	if c.OtlpProcessor == "simple" {
+		// records are exported synchronously
+		return 0
+	}
+	return c.OtlpBatchMaxQueueSize + c.OtlpBatchBufferSize*c.BatchMaxBatchSize()
+}
+
+// return the batch export interval of the exporter in use: its own, if set, or the shared one
+func (c *Config) BatchExportInterval() int {
+	switch {
+	case c.OtlpExporter == "grpc" && c.OtlpgRPCBatchExportInterval > 0:
+		return c.OtlpgRPCBatchExportInterval
+	case c.OtlpExporter == "http" && c.OtlpHTTPBatchExportInterval > 0:
+		return c.OtlpHTTPBatchExportInterval
+	}
+	return c.OtlpBatchExportInterval
+}
+
+// return the maximum batch size of the exporter in use: its own, if set, or the shared one
+func (c *Config) BatchMaxBatchSize() int {
+	switch {
+	case c.OtlpExporter == "grpc" && c.OtlpgRPCBatchMaxBatchSize > 0:
+		return c.OtlpgRPCBatchMaxBatchSize
+	case c.OtlpExporter == "http" && c.OtlpHTTPBatchMaxBatchSize > 0:
+		return c.OtlpHTTPBatchMaxBatchSize
+	}
+	return c.OtlpBatchMaxBatchSize
+}
+
+// return the rate limit to apply to a VM
+func (c *Config) VMRateLimit(id int) RateLimit {
+	if limit, ok := c.VMRateLimits[id]; ok {
+		return limit
+	}
+	return c.RateLimit
+}
+
+// return the minimum severity of the records sent for a VM
+func (c *Config) VMMinSeverity(id int) string {
+	if severity, ok := c.VMMinSeverities[id]; ok {
+		return severity
+	}
+	return c.MinSeverity
+}
+
+// return the compiled drop-field-pattern regular expressions
+func (c *Config) DropFieldRegexps() []*regexp.Regexp {
+	return c.dropFieldRegexps
+}
+
+// value of the secret fields in the JSON form of the configuration, when set
+const REDACTED = "***"
+
+// return the JSON form of the configuration, as printed by -print-config;
+// the PEM data, that may include the private key, is replaced by REDACTED
+func (c Config) MarshalJSON() ([]byte, error) {
+	// without the methods of Config, not to call MarshalJSON again
+	type config Config
+	redacted := config(c)
+	for _, secret := range []*string{&redacted.OtlpTLSCertPEM, &redacted.OtlpTLSKeyPEM, &redacted.OtlpTLSCAPEM} {
+		if *secret != "" {
+			*secret = REDACTED
+		}
+	}
+	return json.Marshal(redacted)
+}
+
+// check that the command monitoring the LXCs can be found, unless it's not run;
+// unlike Validate, it depends on the host, so it's checked when the monitoring starts
+func (c *Config) CheckCommands() error {
+	if c.DryRun || c.SkipLXCs {
+		return nil
+	}
+	args, err := ExpandCmdTemplate(c.LXCMonitorCmd, map[string]string{"id": "100", "name": "ct"})
+	if err != nil {
+		return fmt.Errorf("lxc-monitor-cmd: %w", err)
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("lxc-monitor-cmd: command '%s' not found: %w", args[0], err)
+	}
+	return nil
+}
+
+// check the configuration values, returning an error describing the first invalid one.
+func (c *Config) Validate() error {
+	if c.OtlpExporter != "grpc" && c.OtlpExporter != "http" && c.OtlpExporter != "file" {
+		return errors.New("otlp-exporter must be \"grpc\", \"http\" or \"file\"")
+	}
+	if c.OtlpExporter == "file" {
+		if c.FilePath == "" {
+			return errors.New("file-path must be specified with the file exporter")
+		}
+		if c.OtlpErrorsURL != "" {
+			return errors.New("otlp-errors-url can't be used with the file exporter")
+		}
+	} else {
+		urls := c.OtlpURLs()
+		if len(urls) == 0 {
+			return fmt.Errorf("at least one otlp-%s-url must be specified", c.OtlpExporter)
+		}
+		for _, endpointURL := range urls {
+			if u, err := url.Parse(endpointURL); err != nil || u.Host == "" {
+				return fmt.Errorf("invalid otlp-%s-url: '%s'", c.OtlpExporter, endpointURL)
+			}
+		}
 	}
 
-	if c.OtlpExporter != "grpc" && c.OtlpExporter != "http" {
-		slog.Error("otlp-exporter must be \"grpc\" or \"http\"")
-		flag.PrintDefaults()
-		os.Exit(1)
+	for _, endpointURL := range c.OtlpErrorsURLs() {
+		if u, err := url.Parse(endpointURL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid otlp-errors-url: '%s'", endpointURL)
+		}
+	}
+	if !slices.Contains(SEVERITIES, strings.ToLower(c.OtlpErrorsSeverity)) {
+		return fmt.Errorf("otlp-errors-severity must be one of %s; wrong value: '%s'",
+			strings.Join(SEVERITIES, ", "), c.OtlpErrorsSeverity)
 	}
 
 	if (c.OtlpTLSCertFile != "" || c.OtlpTLSKeyFile != "") &&
 		!(c.OtlpTLSCertFile != "" && c.OtlpTLSKeyFile != "") {
-		slog.Error("otlp-grpc-tls-cert-file and otlp-grpc-tls-key-file must both be specified")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("otlp-grpc-tls-cert-file and otlp-grpc-tls-key-file must both be specified")
+	}
+	if (c.OtlpTLSCertPEM != "") != (c.OtlpTLSKeyPEM != "") {
+		return errors.New("otlp-tls-cert-pem and otlp-tls-key-pem must both be specified")
+	}
+	if c.OtlpTLSServerName != "" && c.OtlpExporter == "file" {
+		return errors.New("otlp-tls-server-name is not supported by the file exporter")
 	}
 
+	if c.OtlpHTTPPath != "" && !strings.HasPrefix(c.OtlpHTTPPath, "/") {
+		return errors.New("otlp-http-path must start with \"/\"")
+	}
 	if c.OtlpCompression != "none" && c.OtlpCompression != "gzip" {
-		slog.Error("otlp-grpc-compression must be \"none\" or \"gzip\"")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("otlp-grpc-compression must be \"none\" or \"gzip\"")
+	}
+	if c.OtlpGzipLevel < 0 || c.OtlpGzipLevel > 9 {
+		return errors.New("otlp-gzip-level must be between 1 and 9, or 0 for the default")
+	}
+	if c.OtlpGzipLevel != 0 && c.OtlpExporter != "grpc" {
+		// the HTTP exporter doesn't allow to replace its compressor nor its transport
+		return errors.New("otlp-gzip-level is only supported by the grpc exporter")
 	}
 	if c.OtlpgRPCReconnectionPeriod < 0 {
-		slog.Error("otlp-grpc-reconnection-period must be equal or greater than zero")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("otlp-grpc-reconnection-period must be equal or greater than zero")
+	}
+	if c.AttrsFile != "" {
+		if _, err := ParseAttrsFile(c.AttrsFile); err != nil {
+			return fmt.Errorf("attrs-file: %w", err)
+		}
+	}
+	if c.OtlpCreateRetries < 0 {
+		return errors.New("otlp-create-retries must be equal or greater than zero")
+	}
+	if c.OtlpCreateRetryDelay < 1 {
+		return errors.New("otlp-create-retry-delay must be greater than zero")
+	}
+	if c.OtlpProcessor != "batch" && c.OtlpProcessor != "simple" {
+		return errors.New("otlp-processor must be \"batch\" or \"simple\"")
 	}
 	if c.OtlpBatchBufferSize < 1 {
-		slog.Error("otlp-batch-buffer-size must be greater than zero")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("otlp-batch-buffer-size must be greater than zero")
 	}
 	if c.OtlpBatchExportInterval < 1 {
-		slog.Error("otlp-batch-export-interval must be greater than zero")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("otlp-batch-export-interval must be greater than zero")
 	}
 	if c.OtlpBatchMaxBatchSize < 1 {
-		slog.Error("otlp-batch-max-batch-size must be greater than zero")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("otlp-batch-max-batch-size must be greater than zero")
+	}
+	if c.OtlpBatchMaxQueueSize < 1 {
+		return errors.New("otlp-batch-max-queue-size must be greater than zero")
+	}
+	for name, value := range map[string]int{
+		"otlp-grpc-batch-export-interval": c.OtlpgRPCBatchExportInterval,
+		"otlp-grpc-batch-max-batch-size":  c.OtlpgRPCBatchMaxBatchSize,
+		"otlp-http-batch-export-interval": c.OtlpHTTPBatchExportInterval,
+		"otlp-http-batch-max-batch-size":  c.OtlpHTTPBatchMaxBatchSize,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s must be equal or greater than zero", name)
+		}
+	}
+	if c.OtlpBatchMemoryBudget < 0 {
+		return errors.New("otlp-batch-memory-budget must be equal or greater than zero")
+	}
+	if _, err := ExpandTemplate(c.ServiceNameTemplate, map[string]string{
+		"id": "100", "name": "ct", "type": "lxc", "node": "pve"}); err != nil {
+		return fmt.Errorf("service-name-template: %w", err)
+	}
+	if _, err := ExpandCmdTemplate(c.LXCMonitorCmd, map[string]string{"id": "100", "name": "ct"}); err != nil {
+		return fmt.Errorf("lxc-monitor-cmd: %w", err)
+	}
+	for _, source := range c.LXCLogSources {
+		if _, err := ExpandCmdTemplate(source.Cmd, map[string]string{"id": "100", "name": "ct"}); err != nil {
+			return fmt.Errorf("lxc-log-sources: %s: %w", source.Name, err)
+		}
+	}
+	if c.NestedTag != "" {
+		if _, err := ExpandCmdTemplate(c.NestedListCmd, map[string]string{"id": "100", "name": "ct"}); err != nil {
+			return fmt.Errorf("nested-list-cmd: %w", err)
+		}
+		if _, err := ExpandCmdTemplate(c.NestedMonitorCmd,
+			map[string]string{"id": "100", "name": "ct", "container": "app"}); err != nil {
+			return fmt.Errorf("nested-monitor-cmd: %w", err)
+		}
+	}
+	if err := c.validateJournalFilters(); err != nil {
+		return err
+	}
+	if c.SkipLXCs && c.SkipPVE {
+		// KVMs are not monitored: there would be nothing to do
+		return errors.New("nothing to monitor: skip-lxcs and skip-pve can't be both set")
+	}
+	if c.IncludeStoppedHistory < 0 {
+		return errors.New("include-stopped-history must be equal or greater than zero")
+	}
+	if c.MonitorMaxLifetime < 0 {
+		return errors.New("monitor-max-lifetime must be equal or greater than zero")
+	}
+	if c.MonitorIdleTimeout < 0 {
+		return errors.New("monitor-idle-timeout must be equal or greater than zero")
 	}
 	if c.RefreshInterval < 0 {
-		slog.Error("refresh-interval must be equal or greater than zero")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("refresh-interval must be equal or greater than zero")
+	}
+	if c.DiscoveryRetries < 0 {
+		return errors.New("discovery-retries must be equal or greater than zero")
+	}
+	if c.DiscoveryRetryDelay < 0 {
+		return errors.New("discovery-retry-delay must be equal or greater than zero")
+	}
+	for _, rule := range c.LogRules {
+		if rule.Action == RULE_ROUTE && c.OtlpErrorsURL == "" {
+			return errors.New("log-rules with the route action require otlp-errors-url")
+		}
+	}
+	if !slices.Contains(SEVERITIES, strings.ToLower(c.MinSeverity)) {
+		return fmt.Errorf("min-severity must be one of %s; wrong value: '%s'",
+			strings.Join(SEVERITIES, ", "), c.MinSeverity)
+	}
+	for id, severity := range c.VMMinSeverities {
+		if !slices.Contains(SEVERITIES, severity) {
+			return fmt.Errorf("min-severity-vm of VM %d must be one of %s; wrong value: '%s'",
+				id, strings.Join(SEVERITIES, ", "), severity)
+		}
+	}
+	if c.NodeNameSource != "hostname" && c.NodeNameSource != "pve" {
+		return errors.New("node-name-source must be \"hostname\" or \"pve\"")
+	}
+	if c.BodyFormat != "map" && c.BodyFormat != "string" && c.BodyFormat != "logfmt" {
+		return errors.New("body-format must be \"map\", \"string\" or \"logfmt\"")
+	}
+	if c.AttrKeyStyle != "dotted" && c.AttrKeyStyle != "snake" {
+		return errors.New("attr-key-style must be \"dotted\" or \"snake\"")
+	}
+	if c.TimestampSource != "journal" && c.TimestampSource != "source" {
+		return errors.New("timestamp-source must be \"journal\" or \"source\"")
+	}
+	if c.MaxInflightRecords < 0 {
+		return errors.New("max-inflight-records must be equal or greater than zero")
+	}
+	if c.InflightPolicy != "block" && c.InflightPolicy != "drop" {
+		return errors.New("inflight-policy must be \"block\" or \"drop\"")
+	}
+	if c.MaxRecordBytes < 0 {
+		return errors.New("max-record-bytes must be equal or greater than zero")
+	}
+	if c.TestVMRecords < 1 {
+		return errors.New("test-vm-records must be greater than zero")
+	}
+	if c.VMRemovalGrace < 0 {
+		return errors.New("vm-removal-grace must be equal or greater than zero")
+	}
+	if c.StartupDelay < 0 {
+		return errors.New("startup-delay must be equal or greater than zero")
+	}
+	if c.StartupSplay < 0 {
+		return errors.New("startup-splay must be equal or greater than zero")
 	}
 	if c.CmdRetryTimes < 0 {
-		slog.Error("cmd-retry-times must be equal or greater than zero")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("cmd-retry-times must be equal or greater than zero")
 	}
 	if c.CmdRetryDelay < 0 {
-		slog.Error("cmd-retry-delay must be equal or greater than zero")
-		flag.PrintDefaults()
-		os.Exit(1)
+		return errors.New("cmd-retry-delay must be equal or greater than zero")
+	}
+	if c.DrainTimeout < 1 {
+		return errors.New("drain-timeout must be greater than zero")
 	}
+	if c.ShutdownTimeout < 1 {
+		return errors.New("shutdown-timeout must be greater than zero")
+	}
+	if c.DedupWindow < 0 {
+		return errors.New("dedup-window must be equal or greater than zero")
+	}
+	if c.ReorderWindow < 0 {
+		return errors.New("reorder-window must be equal or greater than zero")
+	}
+	c.dropFieldRegexps = nil
+	for _, pattern := range c.DropFieldPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("drop-field-pattern: %w", err)
+		}
+		c.dropFieldRegexps = append(c.dropFieldRegexps, re)
+	}
+	if _, err := regexp.Compile(c.MultilineStart); err != nil {
+		return fmt.Errorf("multiline-start: %w", err)
+	}
+	if c.MultilineTimeout < 1 {
+		return errors.New("multiline-timeout must be greater than zero")
+	}
+	if c.RateLimit.Rate < 0 {
+		return errors.New("rate-limit must be equal or greater than zero")
+	}
+	if c.RateLimit.Burst < 0 {
+		return errors.New("rate-limit-burst must be equal or greater than zero")
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return errors.New("log-format must be \"text\" or \"json\"")
+	}
+	for _, id := range c.MonitorInclude {
+		if slices.Contains(c.MonitorExclude, id) {
+			return fmt.Errorf("ID %d is present in both include and exclude lists", id)
+		}
+	}
+	for _, pattern := range append(slices.Clone(c.IncludeNames), c.ExcludeNames...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid name pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// convert the name of a log level to a slog.Level
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("log-level must be \"debug\", \"info\", \"warn\" or \"error\"; wrong value: '%s'", s)
+}
+
+// configure the format and level of the program's own logs.
+func (c *Config) SetupLogging() {
+	c.setupLogging(os.Stderr)
+}
 
+// configure the program's own logs, written as JSON to w if so configured
+func (c *Config) setupLogging(w io.Writer) {
+	level, _ := ParseLogLevel(c.LogLevel)
 	if c.Verbose {
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+		level = slog.LevelDebug
+	}
+	if c.LogFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+		return
+	}
+	slog.SetLogLoggerLevel(level)
+}
+
+// log the error, print the usage and exit.
+func exitWithError(err error) {
+	slog.Error(err.Error())
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+// register the command line flags, setting the defaults of the configuration;
+// the returned function completes the configuration, once the flags are parsed
+func (c *Config) registerFlags(fs *flag.FlagSet) func() error {
+	fs.StringVar(&c.OtlpLoggerName, "otlp-logger-name", DEFAULT_OTLP_LOGGER_NAME,
+		"OpenTelemetry logger name, used as the instrumentation scope name")
+	fs.StringVar(&c.OtlpScopeVersion, "otlp-scope-version", DEFAULT_OTLP_SCOPE_VERSION,
+		"OpenTelemetry instrumentation scope version (omitted if empty)")
+	fs.StringVar(&c.ClusterName, "cluster-name", "",
+		"name of the Proxmox cluster, sent as the proxmox.cluster resource attribute (omitted if empty)")
+	fs.StringVar(&c.NodeNameSource, "node-name-source", DEFAULT_NODE_NAME_SOURCE,
+		"source of the name of the PVE node, sent as the proxmox.node resource attribute: \"hostname\" or \"pve\" (from /etc/pve/.members, falling back to the hostname)")
+	fs.StringVar(&c.AttrsFile, "attrs-file", "",
+		"file of key=value lines sent as resource attributes of all the logs; re-read on SIGHUP by the loggers created afterwards")
+
+	fs.StringVar(&c.OtlpExporter, "otlp-exporter", DEFAULT_OTLP_EXPORTER,
+		"OpenTelemetry exporter (\"grpc\", \"http\" or \"file\", to write JSON lines to file-path)")
+	fs.StringVar(&c.FilePath, "file-path", "", "file where the records are appended by the file exporter")
+	fs.StringVar(&c.OtlpgRPCURL, "otlp-grpc-url", DEFAULT_OTLP_GRPC_URL,
+		"OpenTelemetry gRPC URL; additional comma-separated URLs are used as fallbacks")
+	fs.StringVar(&c.OtlpHTTPURL, "otlp-http-url", DEFAULT_OTLP_HTTP_URL,
+		"OpenTelemetry HTTP URL; additional comma-separated URLs are used as fallbacks")
+	fs.StringVar(&c.OtlpHTTPPath, "otlp-http-path", "",
+		"OpenTelemetry HTTP URL path; if set, it replaces any path in otlp-http-url, otherwise its path is used, or "+DEFAULT_OTLP_HTTP_PATH+" if it has none")
+	fs.StringVar(&c.OtlpErrorsURL, "otlp-errors-url", "",
+		"OpenTelemetry URL, using the same exporter, that also receives the records at or above otlp-errors-severity (disabled if empty)")
+	fs.StringVar(&c.OtlpErrorsSeverity, "otlp-errors-severity", DEFAULT_OTLP_ERRORS_SEVERITY,
+		"minimum severity of the records sent to otlp-errors-url (\"debug\", \"info\", \"warn\", \"error\" or \"fatal\")")
+
+	fs.StringVar(&c.OtlpTLSCertFile, "otlp-tls-cert-file", "", "Path to the TLS certificate file")
+	fs.StringVar(&c.OtlpTLSKeyFile, "otlp-tls-key-file", "", "Path to the TLS key file")
+	fs.StringVar(&c.OtlpTLSCertPEM, "otlp-tls-cert-pem", "",
+		"PEM TLS certificate, replacing otlp-tls-cert-file (default from the "+ENV_TLS_CERT_PEM+" environment variable)")
+	fs.StringVar(&c.OtlpTLSKeyPEM, "otlp-tls-key-pem", "",
+		"PEM TLS key, replacing otlp-tls-key-file (default from the "+ENV_TLS_KEY_PEM+" environment variable)")
+	fs.StringVar(&c.OtlpTLSCAPEM, "otlp-tls-ca-pem", "",
+		"PEM CA certificate, replacing the TLS certificate as CA; it can be used without a client certificate (default from the "+ENV_TLS_CA_PEM+" environment variable)")
+	fs.StringVar(&c.OtlpTLSServerName, "otlp-tls-server-name", "",
+		"server name sent as SNI and verified in the certificate of the collector, instead of the host of the URL")
+	fs.StringVar(&c.OtlpCompression, "otlp-compression", DEFAULT_OTLP_COMPRESSION,
+		"OpenTelemetry compression algorithm (\"gzip\" or \"none\")")
+	fs.IntVar(&c.OtlpGzipLevel, "otlp-gzip-level", 0,
+		"gzip compression level, from 1 (fastest) to 9 (smallest); only supported by the gRPC exporter, the HTTP one always uses the default (0 for the default)")
+	fs.StringVar(&c.OtlpUserAgent, "otlp-user-agent", DEFAULT_OTLP_USER_AGENT,
+		"User-Agent sent to the OpenTelemetry collector (the library default if empty)")
+	fs.IntVar(&c.OtlpInitialInterval, "otlp-initial-interval",
+		DEFAULT_OTLP_INITIAL_INTERVAL, "OpenTelemetry time to wait after the first failure before retrying in seconds")
+	fs.IntVar(&c.OtlpMaxInterval, "otlp-max-interval",
+		DEFAULT_OTLP_MAX_INTERVAL, "OpenTelemetry upper bound on backoff interval in seconds")
+	fs.IntVar(&c.OtlpMaxElapsedTime, "otlp-max-elapsed-time",
+		DEFAULT_OTLP_MAX_ELAPSED_TIME, "OpenTelemetry maximum amount of time (including retries) spent trying to send a request/batch in seconds")
+	fs.IntVar(&c.OtlpTimeout, "otlp-timeout",
+		DEFAULT_OTLP_TIMEOUT, "OpenTelemetry timeout in milliseconds")
+
+	fs.IntVar(&c.OtlpgRPCReconnectionPeriod, "otlp-grpc-reconnection-period",
+		DEFAULT_OTLP_GRPC_RECONNECTION_PERIOD, "OpenTelemetry minimum amount of time between connection attempts to the target endpoint in seconds")
+	fs.IntVar(&c.OtlpCreateRetries, "otlp-create-retries", DEFAULT_OTLP_CREATE_RETRIES,
+		"number of times the creation of the logger of the PVE node is retried at startup")
+	fs.IntVar(&c.OtlpCreateRetryDelay, "otlp-create-retry-delay", DEFAULT_OTLP_CREATE_RETRY_DELAY,
+		"seconds to wait before the first retry of the creation of a logger at startup; doubled at each retry")
+
+	fs.StringVar(&c.OtlpProcessor, "otlp-processor", DEFAULT_OTLP_PROCESSOR,
+		"OpenTelemetry processor (\"batch\" or \"simple\", to export every record immediately ignoring the otlp-batch-* options)")
+	fs.BoolVar(&c.OtlpSharedExporter, "otlp-shared-exporter", false,
+		"send the records of all the VMs over a single exporter and connection, each VM keeping its own resource")
+	fs.IntVar(&c.OtlpBatchBufferSize, "otlp-batch-buffer-size",
+		DEFAULT_OTLP_BATCH_BUFFER_SIZE, "OpenTelemetry batch buffer size that is kept in memory")
+	fs.IntVar(&c.OtlpBatchExportInterval, "otlp-batch-export-interval",
+		DEFAULT_OTLP_BATCH_EXPORT_INTERVAL, "OpenTelemetry maximum duration between batched exports in seconds")
+	fs.IntVar(&c.OtlpBatchMaxBatchSize, "otlp-batch-max-batch-size",
+		DEFAULT_OTLP_BATCH_MAX_BATCH_SIZE, "OpenTelemetry maximum batch size of every export")
+	fs.IntVar(&c.OtlpBatchMaxQueueSize, "otlp-batch-max-queue-size",
+		DEFAULT_OTLP_BATCH_MAX_QUEUE_SIZE, "OpenTelemetry maximum number of records queued before being batched")
+	fs.IntVar(&c.OtlpgRPCBatchExportInterval, "otlp-grpc-batch-export-interval", 0,
+		"otlp-batch-export-interval used with the gRPC exporter (0 to use otlp-batch-export-interval)")
+	fs.IntVar(&c.OtlpgRPCBatchMaxBatchSize, "otlp-grpc-batch-max-batch-size", 0,
+		"otlp-batch-max-batch-size used with the gRPC exporter (0 to use otlp-batch-max-batch-size)")
+	fs.IntVar(&c.OtlpHTTPBatchExportInterval, "otlp-http-batch-export-interval", 0,
+		"otlp-batch-export-interval used with the HTTP exporter (0 to use otlp-batch-export-interval)")
+	fs.IntVar(&c.OtlpHTTPBatchMaxBatchSize, "otlp-http-batch-max-batch-size", 0,
+		"otlp-batch-max-batch-size used with the HTTP exporter (0 to use otlp-batch-max-batch-size)")
+	fs.IntVar(&c.OtlpBatchMemoryBudget, "otlp-batch-memory-budget",
+		DEFAULT_OTLP_BATCH_MEMORY_BUDGET, "warn when the records that can be held in memory by all the VMs exceed this number (0 to disable)")
+
+	var traceIdFields string
+	var spanIdFields string
+	var keepFields string
+	fs.StringVar(&keepFields, "keep-fields", "",
+		"Comma-separated list of the only journald fields kept, before the record is built (include PRIORITY and __REALTIME_TIMESTAMP to keep the severity and the timestamp); MESSAGE is always kept, unless -MESSAGE is listed (disabled if empty)")
+	fs.Func("drop-field-pattern",
+		"regular expression matching the names of journald fields to drop, before the record is built (e.g. '^_SELINUX'); can be repeated",
+		func(s string) error {
+			c.DropFieldPatterns = append(c.DropFieldPatterns, s)
+			return nil
+		})
+	fs.StringVar(&traceIdFields, "trace-id-fields", DEFAULT_TRACE_ID_FIELDS,
+		"Comma-separated list of journald fields containing the trace ID of a log entry")
+	fs.StringVar(&spanIdFields, "span-id-fields", DEFAULT_SPAN_ID_FIELDS,
+		"Comma-separated list of journald fields containing the span ID of a log entry")
+	fs.IntVar(&c.MaxRecordBytes, "max-record-bytes", 0,
+		"maximum total bytes of the strings of the body and the attributes of a record; the record is truncated, and marked with the \"truncated\" attribute (0 for no limit)")
+	fs.StringVar(&c.BodyFormat, "body-format", DEFAULT_BODY_FORMAT,
+		"format of the body of the records of journald entries: \"map\" of the fields, \"string\" with the fields as JSON, or \"logfmt\" string")
+	fs.StringVar(&c.AttrKeyStyle, "attr-key-style", DEFAULT_ATTR_KEY_STYLE,
+		"style of the keys of the attributes of the records: \"dotted\" (like boot.id) or \"snake\" (like boot_id)")
+	fs.StringVar(&c.TimestampSource, "timestamp-source", DEFAULT_TIMESTAMP_SOURCE,
+		"journald field used as the event timestamp: \"journal\" (__REALTIME_TIMESTAMP, set by journald) or "+
+			"\"source\" (_SOURCE_REALTIME_TIMESTAMP, reported by the client); __REALTIME_TIMESTAMP is the observed timestamp, unless observed-ingest-time is set")
+	fs.IntVar(&c.MaxInflightRecords, "max-inflight-records", 0,
+		"maximum number of records of all the VMs waiting to be exported by the batch processors (0 for no limit)")
+	fs.StringVar(&c.InflightPolicy, "inflight-policy", DEFAULT_INFLIGHT_POLICY,
+		"what to do with a record when max-inflight-records is reached: \"block\" until there's room, or \"drop\" it")
+	fs.BoolVar(&c.Backpressure, "backpressure", false,
+		"stop reading the logs of a VM while its export queue is full, instead of dropping records")
+	fs.BoolVar(&c.AddIngestLatency, "add-ingest-latency", false,
+		"send the milliseconds between the reception of a record by journald and its reading as the \"ingest.latency.ms\" attribute")
+	fs.BoolVar(&c.ObservedIngestTime, "observed-ingest-time", false,
+		"set the observed timestamp of the records to the time they are read, instead of __REALTIME_TIMESTAMP")
+	fs.BoolVar(&c.BootIdAttr, "boot-id-attr", false, "send the _BOOT_ID journald field as the \"boot.id\" attribute")
+	fs.BoolVar(&c.KeepRawLine, "keep-raw-line", false,
+		"attach the original line, as produced by the monitoring command, as the \"raw\" attribute of each record")
+
+	fs.StringVar(&c.ServiceNameTemplate, "service-name-template", DEFAULT_SERVICE_NAME_TEMPLATE,
+		"service name of the logs of a VM; {id}, {name}, {type} and {node} are replaced with the ID, the name (or the ID, if missing), the type of the VM and the name of the PVE node")
+	fs.StringVar(&c.ServiceNamePrefix, "service-name-prefix", "",
+		"string prepended to the service names, to tell apart the VMs of different clusters sending to the same collector")
+	fs.StringVar(&c.LXCMonitorCmd, "lxc-monitor-cmd", DEFAULT_LXC_MONITOR_CMD,
+		"command used to follow the JSON logs of a LXC; {id} and {name} are replaced with the ID and the name of the LXC")
+	var logSources string
+	fs.StringVar(&logSources, "lxc-log-sources", "",
+		"Semicolon-separated list of NAME=COMMAND items, additional commands following the logs of a LXC "+
+			"(e.g. \"app=pct exec {id} -- tail -F /var/log/app.log\"); the name is sent as the log.source attribute, "+
+			"\""+JOURNAL_LOG_SOURCE+"\" for the records of lxc-monitor-cmd")
+	fs.StringVar(&c.NestedTag, "nested-tag", "",
+		"follow the logs of the containers running inside the LXCs with this tag, listed by nested-list-cmd (disabled if empty)")
+	fs.StringVar(&c.NestedListCmd, "nested-list-cmd", DEFAULT_NESTED_LIST_CMD,
+		"command printing the names or IDs of the containers running inside a LXC, one per line; {id} and {name} are replaced")
+	fs.StringVar(&c.NestedMonitorCmd, "nested-monitor-cmd", DEFAULT_NESTED_MONITOR_CMD,
+		"command following the logs of a nested container; {id}, {name} and {container} are replaced, "+
+			"and the log.source attribute is \"nested:\" followed by the container")
+	fs.StringVar(&c.JournalGrep, "journal-grep", "",
+		"only send the LXCs records whose message matches this pattern (journalctl --grep)")
+	fs.StringVar(&c.JournalPriority, "journal-priority", "",
+		"only send the LXCs records with this priority or range of priorities, like \"err\" or \"0..4\" (journalctl --priority)")
+	fs.StringVar(&c.JournalFacility, "journal-facility", "",
+		"only send the LXCs records of this comma-separated list of syslog facilities (journalctl --facility)")
+	fs.IntVar(&c.MonitorMaxLifetime, "monitor-max-lifetime", 0,
+		"restart the monitoring command of a VM after it ran for these seconds; lines logged while restarting are lost (0 to disable)")
+	fs.IntVar(&c.MonitorIdleTimeout, "monitor-idle-timeout", 0,
+		"restart the monitoring command of a VM that produced no output for these seconds (0 to disable)")
+	fs.IntVar(&c.RefreshInterval, "refresh-interval", DEFAULT_REFRESH_INTERVAL, "refresh interval in seconds")
+	fs.IntVar(&c.DiscoveryRetries, "discovery-retries", DEFAULT_DISCOVERY_RETRIES,
+		"number of times the commands listing the VMs are retried, before skipping a refresh")
+	fs.IntVar(&c.DiscoveryRetryDelay, "discovery-retry-delay", DEFAULT_DISCOVERY_RETRY_DELAY,
+		"seconds to wait before retrying a command listing the VMs")
+	fs.IntVar(&c.VMRemovalGrace, "vm-removal-grace", 0,
+		"number of consecutive refreshes a VM can be missing before its monitoring is removed")
+	fs.IntVar(&c.StartupDelay, "startup-delay", 0, "seconds to wait before the first refresh")
+	fs.IntVar(&c.StartupSplay, "startup-splay", 0,
+		"maximum random number of seconds added to the startup delay, to spread the load of several nodes")
+	fs.IntVar(&c.CmdRetryTimes, "cmd-retry-times", DEFAULT_CMD_RETRY_TIMES,
+		"number of times a process is restarted before giving up (0 to run it only once); once given up, the VM is monitored again from the next refresh")
+	noRetry := fs.Bool("no-retry", false,
+		"run the monitoring process only once per refresh (same as -cmd-retry-times 0): a failed one is run again at the next refresh")
+	fs.IntVar(&c.CmdRetryDelay, "cmd-retry-delay", DEFAULT_CMD_RETRY_DELAY, "seconds to wait before a process is restarted on failure")
+	fs.IntVar(&c.DrainTimeout, "drain-timeout", DEFAULT_DRAIN_TIMEOUT,
+		"seconds to wait for the logs of a stopped VM to be exported")
+	fs.IntVar(&c.ShutdownTimeout, "shutdown-timeout", DEFAULT_SHUTDOWN_TIMEOUT,
+		"overall seconds to wait for the logs of all VMs to be exported at exit")
+	fs.BoolVar(&c.StopMarker, "stop-marker", false,
+		"send a last record for each VM when its monitoring stops, with the monitoring.stopped and monitoring.stop_reason attributes")
+	fs.IntVar(&c.DedupWindow, "dedup-window", DEFAULT_DEDUP_WINDOW,
+		"collapse identical consecutive log lines received within this window in milliseconds (0 to disable)")
+	fs.IntVar(&c.ReorderWindow, "reorder-window", 0,
+		"hold the records of a VM for this window in milliseconds, sending them sorted by timestamp; adds as much latency (0 to disable)")
+	fs.StringVar(&c.MultilineStart, "multiline-start", "",
+		"regular expression matching the first line of a multiline message, like a stack trace; the following lines of the same process not matching it are joined to its record (disabled if empty)")
+	fs.IntVar(&c.MultilineTimeout, "multiline-timeout", DEFAULT_MULTILINE_TIMEOUT,
+		"milliseconds to wait for the next line of a multiline message before sending it")
+	fs.IntVar(&c.RateLimit.Rate, "rate-limit", DEFAULT_RATE_LIMIT,
+		"maximum number of log lines per second sent for each VM; excess lines are dropped (0 to disable)")
+	fs.IntVar(&c.RateLimit.Burst, "rate-limit-burst", DEFAULT_RATE_LIMIT_BURST,
+		"number of log lines that can exceed the rate limit in a burst (0 means the same as rate-limit)")
+	var vmRateLimits string
+	fs.StringVar(&vmRateLimits, "rate-limit-vm", "",
+		"Comma-separated list of ID:RATE[:BURST] items overriding the rate limit of specific VMs")
+	fs.StringVar(&c.MinSeverity, "min-severity", DEFAULT_MIN_SEVERITY,
+		"minimum severity of the records sent (\"debug\", \"info\", \"warn\", \"error\" or \"fatal\")")
+	var logRules string
+	fs.StringVar(&logRules, "log-rules", "",
+		"Comma-separated list of FIELD=VALUE:ACTION rules applied to the log entries having a journald field set to a value; "+
+			"ACTION is drop, keep (ignoring the minimum severity) or route (also sending it to otlp-errors-url); the first matching rule wins")
+	var vmMinSeverities string
+	fs.StringVar(&vmMinSeverities, "min-severity-vm", "",
+		"Comma-separated list of ID:SEVERITY items overriding the minimum severity of specific VMs")
+	fs.BoolVar(&c.SkipLXCs, "skip-lxcs", false, "do not monitor LXCs virtuals")
+	fs.BoolVar(&c.SkipPVE, "skip-pve", false, "do not monitor this PVE node")
+	var pveUnits string
+	fs.StringVar(&pveUnits, "pve-units", "",
+		"Comma-separated list of systemd units (e.g. pvedaemon.service) of this PVE node to monitor, instead of its whole journal")
+	var pveExcludeUnits string
+	fs.StringVar(&pveExcludeUnits, "pve-exclude-units", "",
+		"Comma-separated list of systemd units (e.g. pvestatd.service) of this PVE node whose logs are not sent")
+	// it will be reintroduced if we'll find a way to get the stdout stream from a qm exec command.
+	//fs.BoolVar(&c.SkipKVMs, "skip-vms", false, "do not consider Qemu/KVM virtuals")
+	var monitorInclude string
+	var monitorExclude string
+	fs.StringVar(&monitorInclude, "monitor-include", "", "Comma-separated list of IDs to include in monitoring")
+	fs.StringVar(&monitorExclude, "monitor-exclude", "", "Comma-separated list of IDs to exclude from monitoring")
+	var monitorIncludeName, monitorExcludeName string
+	fs.StringVar(&monitorIncludeName, "monitor-include-name", "",
+		"Comma-separated list of name glob patterns (e.g. db-*) to include in monitoring")
+	fs.StringVar(&monitorExcludeName, "monitor-exclude-name", "",
+		"Comma-separated list of name glob patterns to exclude from monitoring; exclusions always win")
+	var monitorTags string
+	fs.StringVar(&monitorTags, "monitor-tag", "",
+		"Comma-separated list of tags; if specified, only VMs with at least one of them are monitored")
+
+	fs.StringVar(&c.MetricsAddress, "metrics-address", "",
+		"address (e.g. \":9464\") where metrics are served on the /metrics path (disabled if empty)")
+
+	fs.BoolVar(&c.ListVMs, "list-vms", false, "print the discovered VMs and whether they would be monitored, then quit")
+	fs.IntVar(&c.IncludeStoppedHistory, "include-stopped-history", 0,
+		"at startup, send in the background the last N records of the journal of each stopped LXC (disabled if 0); an LXC whose root filesystem is not a directory (e.g. on LVM) is mounted meanwhile, and can't be started until unmounted, at the end of the reading or when the program stops")
+	fs.IntVar(&c.TestVM, "test-vm", 0,
+		"monitor only the VM with this ID, print its first records as JSON to standard output and quit")
+	fs.IntVar(&c.TestVMRecords, "test-vm-records", DEFAULT_TEST_VM_RECORDS, "number of records printed by test-vm")
+	fs.BoolVar(&c.TestVMSend, "test-vm-send", false,
+		"send the records of test-vm to the collector instead of printing them, reporting whether they were delivered")
+	fs.BoolVar(&c.RequireVMs, "require-vms", false, "exit with an error if no VM can be monitored at startup")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "do not execute any command")
+	fs.StringVar(&c.LogFormat, "log-format", DEFAULT_LOG_FORMAT, "format of the program's own logs (\"text\" or \"json\")")
+	fs.StringVar(&c.LogLevel, "log-level", DEFAULT_LOG_LEVEL,
+		"level of the program's own logs (\"debug\", \"info\", \"warn\" or \"error\")")
+	fs.BoolVar(&c.Verbose, "verbose", false, "be more verbose (same as -log-level debug)")
+
+	return func() error {
+		if *noRetry {
+			c.CmdRetryTimes = 0
+		}
+		c.MonitorTags = splitStrings(monitorTags)
+		c.PveUnits = splitStrings(pveUnits)
+		c.PveExcludeUnits = splitStrings(pveExcludeUnits)
+		c.IncludeNames = splitStrings(monitorIncludeName)
+		c.ExcludeNames = splitStrings(monitorExcludeName)
+		c.TraceIdFields = splitStrings(traceIdFields)
+		c.SpanIdFields = splitStrings(spanIdFields)
+		c.KeepFields = splitStrings(keepFields)
+		// not used as flag defaults, so that they are not printed by -help
+		for _, v := range []struct {
+			value *string
+			env   string
+		}{{&c.OtlpTLSCertPEM, ENV_TLS_CERT_PEM}, {&c.OtlpTLSKeyPEM, ENV_TLS_KEY_PEM}, {&c.OtlpTLSCAPEM, ENV_TLS_CA_PEM}} {
+			if *v.value == "" {
+				*v.value = os.Getenv(v.env)
+			}
+		}
+
+		var err error
+		if monitorInclude != "" {
+			c.MonitorInclude, err = splitAndTrim(monitorInclude)
+			if err != nil {
+				return err
+			}
+		}
+		if monitorExclude != "" {
+			c.MonitorExclude, err = splitAndTrim(monitorExclude)
+			if err != nil {
+				return err
+			}
+		}
+		if vmRateLimits != "" {
+			c.VMRateLimits, err = parseRateLimits(vmRateLimits)
+			if err != nil {
+				return err
+			}
+		}
+		c.LXCLogSources, err = parseLogSources(logSources)
+		if err != nil {
+			return err
+		}
+		if logRules != "" {
+			c.LogRules, err = parseLogRules(logRules)
+			if err != nil {
+				return err
+			}
+		}
+		if vmMinSeverities != "" {
+			c.VMMinSeverities, err = parseSeverities(vmMinSeverities)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// return a configuration with the default values of all the options, for
+// programs using pve2otelcol as a library; it must be validated before use
+func Default() *Config {
+	c := Config{}
+	fs := flag.NewFlagSet("pve2otelcol", flag.ContinueOnError)
+	complete := c.registerFlags(fs)
+	fs.Parse(nil)
+	// the default values are always valid
+	complete()
+	return &c
+}
+
+// parse command line arguments.
+func ParseArgs() *Config {
+	c := Config{}
+	complete := c.registerFlags(flag.CommandLine)
+	printConfig := flag.Bool("print-config", false, "print the effective configuration as JSON and quit")
+	getVer := flag.Bool("version", false, "print version and quit")
+
+	flag.Parse()
+
+	if *getVer {
+		fmt.Printf("version %s\n", version.VERSION)
+		os.Exit(0)
 	}
 
-	if monitorInclude != "" {
-		c.MonitorInclude = splitAndTrim(monitorInclude)
+	if err := complete(); err != nil {
+		exitWithError(err)
 	}
-	if monitorExclude != "" {
-		c.MonitorExclude = splitAndTrim(monitorExclude)
+
+	if err := c.Validate(); err != nil {
+		exitWithError(err)
 	}
-	for _, id := range c.MonitorInclude {
-		if slices.Contains(c.MonitorExclude, id) {
-			slog.Error(fmt.Sprintf("error: ID %d is present in both include and exclude lists", id))
-			flag.PrintDefaults()
-			os.Exit(1)
+	if *printConfig {
+		out, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			exitWithError(err)
 		}
+		fmt.Println(string(out))
+		os.Exit(0)
 	}
 
+	c.SetupLogging()
+
 	return &c
 }
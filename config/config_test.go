@@ -0,0 +1,486 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// return a valid configuration, that doesn't need the Proxmox commands
+func testConfig() *Config {
+	c := Default()
+	c.DryRun = true
+	return c
+}
+
+// parse the given command line arguments the way ParseArgs does, without exiting
+func parseFlags(args ...string) (*Config, error) {
+	c := Config{}
+	fs := flag.NewFlagSet("pve2otelcol", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	complete := c.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := complete(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := testConfig().Validate(); err != nil {
+		t.Fatalf("the default configuration is not valid: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	attrsFile := filepath.Join(t.TempDir(), "attrs")
+	if err := os.WriteFile(attrsFile, []byte("no separator\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		mutate func(c *Config)
+		// part of the expected error
+		err string
+	}{
+		{"bad exporter", func(c *Config) { c.OtlpExporter = "kafka" }, "otlp-exporter"},
+		{"file exporter without path", func(c *Config) { c.OtlpExporter = "file" }, "file-path"},
+		{"file exporter with errors url", func(c *Config) {
+			c.OtlpExporter, c.FilePath, c.OtlpErrorsURL = "file", "/tmp/records", "http://errors:4317"
+		}, "otlp-errors-url"},
+		{"no grpc url", func(c *Config) { c.OtlpgRPCURL = " , " }, "otlp-grpc-url"},
+		{"grpc url without host", func(c *Config) { c.OtlpgRPCURL = "localhost" }, "otlp-grpc-url"},
+		{"bad fallback http url", func(c *Config) {
+			c.OtlpExporter, c.OtlpHTTPURL = "http", "https://collector:4318,:bad"
+		}, "otlp-http-url"},
+		{"bad errors url", func(c *Config) { c.OtlpErrorsURL = "errors" }, "otlp-errors-url"},
+		{"bad errors severity", func(c *Config) { c.OtlpErrorsSeverity = "critical" }, "otlp-errors-severity"},
+		{"tls cert without key", func(c *Config) { c.OtlpTLSCertFile = "cert.pem" }, "tls-key-file"},
+		{"tls key without cert", func(c *Config) { c.OtlpTLSKeyFile = "key.pem" }, "tls-cert-file"},
+		{"pem cert without key", func(c *Config) { c.OtlpTLSCertPEM = "cert" }, "otlp-tls-key-pem"},
+		{"pem key without cert", func(c *Config) { c.OtlpTLSKeyPEM = "key" }, "otlp-tls-cert-pem"},
+		{"tls server name with file exporter", func(c *Config) {
+			c.OtlpExporter, c.FilePath, c.OtlpTLSServerName = "file", "/tmp/records", "collector"
+		}, "otlp-tls-server-name"},
+		{"relative http path", func(c *Config) { c.OtlpHTTPPath = "v1/logs" }, "otlp-http-path"},
+		{"blank http path", func(c *Config) { c.OtlpHTTPPath = " " }, "otlp-http-path"},
+		{"bad compression", func(c *Config) { c.OtlpCompression = "zstd" }, "compression"},
+		{"gzip level out of range", func(c *Config) { c.OtlpGzipLevel = 10 }, "otlp-gzip-level"},
+		{"gzip level with http", func(c *Config) {
+			c.OtlpExporter, c.OtlpGzipLevel = "http", 5
+		}, "otlp-gzip-level"},
+		{"negative reconnection period", func(c *Config) { c.OtlpgRPCReconnectionPeriod = -1 },
+			"otlp-grpc-reconnection-period"},
+		{"missing attrs file", func(c *Config) { c.AttrsFile = attrsFile + ".missing" }, "attrs-file"},
+		{"malformed attrs file", func(c *Config) { c.AttrsFile = attrsFile }, "attrs-file"},
+		{"negative create retries", func(c *Config) { c.OtlpCreateRetries = -1 }, "otlp-create-retries"},
+		{"zero create retry delay", func(c *Config) { c.OtlpCreateRetryDelay = 0 }, "otlp-create-retry-delay"},
+		{"bad processor", func(c *Config) { c.OtlpProcessor = "async" }, "otlp-processor"},
+		{"zero batch buffer", func(c *Config) { c.OtlpBatchBufferSize = 0 }, "otlp-batch-buffer-size"},
+		{"zero export interval", func(c *Config) { c.OtlpBatchExportInterval = 0 }, "otlp-batch-export-interval"},
+		{"zero max batch size", func(c *Config) { c.OtlpBatchMaxBatchSize = 0 }, "otlp-batch-max-batch-size"},
+		{"zero max queue size", func(c *Config) { c.OtlpBatchMaxQueueSize = 0 }, "otlp-batch-max-queue-size"},
+		{"negative grpc export interval", func(c *Config) { c.OtlpgRPCBatchExportInterval = -1 },
+			"otlp-grpc-batch-export-interval"},
+		{"negative http max batch size", func(c *Config) { c.OtlpHTTPBatchMaxBatchSize = -1 },
+			"otlp-http-batch-max-batch-size"},
+		{"negative memory budget", func(c *Config) { c.OtlpBatchMemoryBudget = -1 }, "otlp-batch-memory-budget"},
+		{"bad service name template", func(c *Config) { c.ServiceNameTemplate = "{vmid}" }, "service-name-template"},
+		{"empty monitor command", func(c *Config) { c.LXCMonitorCmd = " " }, "lxc-monitor-cmd"},
+		{"bad monitor command template", func(c *Config) { c.LXCMonitorCmd = "pct exec {id -- journalctl" },
+			"lxc-monitor-cmd"},
+		{"bad log source template", func(c *Config) {
+			c.LXCLogSources = []LogSource{{Name: "nginx", Cmd: "pct exec {vmid} -- tail -F /var/log/nginx"}}
+		}, "lxc-log-sources"},
+		{"bad nested list command", func(c *Config) {
+			c.NestedTag, c.NestedListCmd = "docker", "pct exec {container} -- docker ps"
+		}, "nested-list-cmd"},
+		{"bad nested monitor command", func(c *Config) {
+			c.NestedTag, c.NestedMonitorCmd = "docker", "pct exec {id} -- docker logs {image}"
+		}, "nested-monitor-cmd"},
+		{"bad journal grep", func(c *Config) { c.JournalGrep = " error" }, "journal-grep"},
+		{"bad journal priority", func(c *Config) { c.JournalPriority = "err..loud" }, "journal-priority"},
+		{"bad journal facility", func(c *Config) { c.JournalFacility = "kern,printer" }, "journal-facility"},
+		{"skip everything", func(c *Config) { c.SkipLXCs, c.SkipPVE = true, true }, "nothing to monitor"},
+		{"negative stopped history", func(c *Config) { c.IncludeStoppedHistory = -1 }, "include-stopped-history"},
+		{"negative max lifetime", func(c *Config) { c.MonitorMaxLifetime = -1 }, "monitor-max-lifetime"},
+		{"negative idle timeout", func(c *Config) { c.MonitorIdleTimeout = -1 }, "monitor-idle-timeout"},
+		{"negative refresh interval", func(c *Config) { c.RefreshInterval = -1 }, "refresh-interval"},
+		{"negative discovery retries", func(c *Config) { c.DiscoveryRetries = -1 }, "discovery-retries"},
+		{"negative discovery retry delay", func(c *Config) { c.DiscoveryRetryDelay = -1 }, "discovery-retry-delay"},
+		{"route rule without errors url", func(c *Config) {
+			c.LogRules = []LogRule{{Field: "_COMM", Value: "sshd", Action: RULE_ROUTE}}
+		}, "otlp-errors-url"},
+		{"bad min severity", func(c *Config) { c.MinSeverity = "notice" }, "min-severity"},
+		{"bad vm min severity", func(c *Config) { c.VMMinSeverities = map[int]string{100: "loud"} }, "min-severity-vm"},
+		{"bad node name source", func(c *Config) { c.NodeNameSource = "dns" }, "node-name-source"},
+		{"bad body format", func(c *Config) { c.BodyFormat = "xml" }, "body-format"},
+		{"bad attr key style", func(c *Config) { c.AttrKeyStyle = "camel" }, "attr-key-style"},
+		{"bad timestamp source", func(c *Config) { c.TimestampSource = "now" }, "timestamp-source"},
+		{"negative inflight records", func(c *Config) { c.MaxInflightRecords = -1 }, "max-inflight-records"},
+		{"bad inflight policy", func(c *Config) { c.InflightPolicy = "wait" }, "inflight-policy"},
+		{"negative max record bytes", func(c *Config) { c.MaxRecordBytes = -1 }, "max-record-bytes"},
+		{"zero test vm records", func(c *Config) { c.TestVMRecords = 0 }, "test-vm-records"},
+		{"negative removal grace", func(c *Config) { c.VMRemovalGrace = -1 }, "vm-removal-grace"},
+		{"negative startup delay", func(c *Config) { c.StartupDelay = -1 }, "startup-delay"},
+		{"negative startup splay", func(c *Config) { c.StartupSplay = -1 }, "startup-splay"},
+		{"negative retry times", func(c *Config) { c.CmdRetryTimes = -1 }, "cmd-retry-times"},
+		{"negative retry delay", func(c *Config) { c.CmdRetryDelay = -1 }, "cmd-retry-delay"},
+		{"zero drain timeout", func(c *Config) { c.DrainTimeout = 0 }, "drain-timeout"},
+		{"zero shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "shutdown-timeout"},
+		{"negative dedup window", func(c *Config) { c.DedupWindow = -1 }, "dedup-window"},
+		{"negative reorder window", func(c *Config) { c.ReorderWindow = -1 }, "reorder-window"},
+		{"bad drop field pattern", func(c *Config) { c.DropFieldPatterns = []string{"_SYSTEMD_("} },
+			"drop-field-pattern"},
+		{"bad multiline start", func(c *Config) { c.MultilineStart = "[0-9" }, "multiline-start"},
+		{"zero multiline timeout", func(c *Config) { c.MultilineTimeout = 0 }, "multiline-timeout"},
+		{"negative rate limit", func(c *Config) { c.RateLimit.Rate = -1 }, "rate-limit"},
+		{"negative rate limit burst", func(c *Config) { c.RateLimit.Burst = -1 }, "rate-limit-burst"},
+		{"bad log level", func(c *Config) { c.LogLevel = "trace" }, "log-level"},
+		{"bad log format", func(c *Config) { c.LogFormat = "xml" }, "log-format"},
+		{"include and exclude overlap", func(c *Config) {
+			c.MonitorInclude, c.MonitorExclude = []int{100, 101}, []int{101}
+		}, "ID 101 is present in both include and exclude lists"},
+		{"bad include name pattern", func(c *Config) { c.IncludeNames = []string{"web["} }, "web["},
+		{"bad exclude name pattern", func(c *Config) { c.ExcludeNames = []string{"db["} }, "db["},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig()
+			tt.mutate(c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatalf("expected an error mentioning %q", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected an error mentioning %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	c, err := parseFlags("-monitor-include", "100, 101", "-monitor-exclude", "200", "-lxc-log-sources",
+		"nginx=pct exec {id} -- tail -F /var/log/nginx/access.log; app=pct exec {id} -- tail -F /app.log",
+		"-rate-limit-vm", "100:50,101:10:20", "-log-rules", "_COMM=sshd:keep,_SYSTEMD_UNIT=cron.service:drop",
+		"-min-severity-vm", "100:WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.MonitorInclude; len(got) != 2 || got[0] != 100 || got[1] != 101 {
+		t.Errorf("unexpected include list: %v", got)
+	}
+	if got := c.MonitorExclude; len(got) != 1 || got[0] != 200 {
+		t.Errorf("unexpected exclude list: %v", got)
+	}
+	if got := c.LXCLogSources; len(got) != 2 || got[0].Name != "nginx" || got[1].Cmd != "pct exec {id} -- tail -F /app.log" {
+		t.Errorf("unexpected log sources: %+v", got)
+	}
+	if got := c.VMRateLimit(101); got != (RateLimit{Rate: 10, Burst: 20}) {
+		t.Errorf("unexpected rate limit of VM 101: %+v", got)
+	}
+	if got := c.VMRateLimit(102); got != c.RateLimit {
+		t.Errorf("VM 102 must use the global rate limit, got %+v", got)
+	}
+	if got := c.LogRules; len(got) != 2 || got[1] != (LogRule{Field: "_SYSTEMD_UNIT", Value: "cron.service", Action: RULE_DROP}) {
+		t.Errorf("unexpected log rules: %+v", got)
+	}
+	if got := c.VMMinSeverity(100); got != "warn" {
+		t.Errorf("unexpected min severity of VM 100: %s", got)
+	}
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"-monitor-include", "100,ct101"},
+		{"-monitor-exclude", "100,"},
+		{"-lxc-log-sources", "nginx"},
+		{"-lxc-log-sources", "journal=tail -F /var/log/syslog"},
+		{"-lxc-log-sources", "a=tail -F /a; a=tail -F /b"},
+		{"-rate-limit-vm", "100"},
+		{"-rate-limit-vm", "100:-5"},
+		{"-log-rules", "_COMM=sshd:ignore"},
+		{"-log-rules", "_COMM:drop"},
+		{"-min-severity-vm", "ct100:warn"},
+	} {
+		if _, err := parseFlags(args...); err == nil {
+			t.Errorf("expected an error parsing %q", args)
+		}
+	}
+}
+
+func TestParseOtlpExporter(t *testing.T) {
+	tests := []struct {
+		args  []string
+		want  string
+		valid bool
+	}{
+		{[]string{}, DEFAULT_OTLP_EXPORTER, true},
+		{[]string{"-otlp-exporter", "grpc"}, "grpc", true},
+		{[]string{"-otlp-exporter", "http"}, "http", true},
+		{[]string{"-otlp-exporter", "kafka"}, "kafka", false},
+		{[]string{"-otlp-exporter", ""}, "", false},
+	}
+	for _, tt := range tests {
+		c, err := parseFlags(append(tt.args, "-dry-run")...)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", tt.args, err)
+		}
+		if c.OtlpExporter != tt.want {
+			t.Errorf("parsing %q: exporter %q, want %q", tt.args, c.OtlpExporter, tt.want)
+		}
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("parsing %q: validation error %v, valid: %v", tt.args, err, tt.valid)
+		}
+	}
+}
+
+func TestParseIdFields(t *testing.T) {
+	c, err := parseFlags("-trace-id-fields", " REQUEST_TRACE, ,TRACE ", "-span-id-fields", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.TraceIdFields; len(got) != 2 || got[0] != "REQUEST_TRACE" || got[1] != "TRACE" {
+		t.Errorf("unexpected trace ID fields: %q", got)
+	}
+	if got := c.SpanIdFields; len(got) != 0 {
+		t.Errorf("unexpected span ID fields: %q", got)
+	}
+}
+
+func TestOtlpURLs(t *testing.T) {
+	c := testConfig()
+	c.OtlpgRPCURL = "http://primary:4317, http://fallback:4317,"
+	if got := c.OtlpURLs(); len(got) != 2 || got[0] != "http://primary:4317" || got[1] != "http://fallback:4317" {
+		t.Errorf("unexpected gRPC URLs: %q", got)
+	}
+	c.OtlpExporter = "http"
+	c.OtlpHTTPURL = "https://collector:4318"
+	if got := c.OtlpURLs(); len(got) != 1 || got[0] != "https://collector:4318" {
+		t.Errorf("unexpected HTTP URLs: %q", got)
+	}
+	c.OtlpExporter, c.FilePath = "file", "/tmp/records"
+	if got := c.OtlpURLs(); len(got) != 1 || got[0] != "/tmp/records" {
+		t.Errorf("unexpected file exporter endpoint: %q", got)
+	}
+}
+
+func TestSetupLoggingJSON(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	c := testConfig()
+	c.LogFormat = "json"
+	c.LogLevel = "warn"
+	var buf strings.Builder
+	c.setupLogging(&buf)
+	handler := slog.Default().Handler()
+	if _, ok := handler.(*slog.JSONHandler); !ok {
+		t.Fatalf("expected a JSON handler, got %T", handler)
+	}
+	ctx := context.Background()
+	if handler.Enabled(ctx, slog.LevelInfo) || !handler.Enabled(ctx, slog.LevelWarn) {
+		t.Error("the JSON handler must use the configured level")
+	}
+	slog.Info("not logged")
+	slog.Warn("failure reading the attributes file", "path", "/etc/attrs", "attributes", 2)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("%d lines logged, want 1:\n%s", len(lines), buf.String())
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("invalid JSON logged: %v\n%s", err, lines[0])
+	}
+	want := map[string]interface{}{"level": "WARN", "msg": "failure reading the attributes file",
+		"path": "/etc/attrs", "attributes": float64(2)}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["time"].(string); !ok {
+		t.Errorf("time missing from the entry: %s", lines[0])
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for in, want := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"Warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		if got, err := ParseLogLevel(in); err != nil || got != want {
+			t.Errorf("ParseLogLevel(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "trace", "warning"} {
+		if _, err := ParseLogLevel(in); err == nil {
+			t.Errorf("ParseLogLevel(%q): expected an error", in)
+		}
+	}
+}
+
+func TestSetupLoggingVerbose(t *testing.T) {
+	defer slog.SetLogLoggerLevel(slog.LevelInfo)
+	c := testConfig()
+	c.LogLevel = "error"
+	c.Verbose = true
+	c.SetupLogging()
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("verbose must enable the debug level, whatever log-level is")
+	}
+}
+
+func TestParseAttrsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		err     string
+	}{
+		{"empty", "", map[string]string{}, ""},
+		{"attributes", "deployment.environment=prod\nhost.rack = r12 \n",
+			map[string]string{"deployment.environment": "prod", "host.rack": "r12"}, ""},
+		{"comments and blank lines", "# site\n\n  # rack\nsite=milan\n", map[string]string{"site": "milan"}, ""},
+		{"separator in the value", "query=a=b\n", map[string]string{"query": "a=b"}, ""},
+		{"empty value", "team=\n", map[string]string{"team": ""}, ""},
+		{"last one wins", "site=milan\nsite=rome\n", map[string]string{"site": "rome"}, ""},
+		{"missing separator", "site=milan\nrome\n", nil, ":2: invalid attribute 'rome'"},
+		{"missing key", "=milan\n", nil, ":1: invalid attribute '=milan'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "attrs")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseAttrsFile(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("attributes %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		interval int
+		size     int
+	}{
+		{"shared values", []string{"-otlp-exporter", "grpc", "-otlp-batch-export-interval", "3",
+			"-otlp-batch-max-batch-size", "100"}, 3, 100},
+		{"grpc overrides", []string{"-otlp-exporter", "grpc", "-otlp-batch-export-interval", "3",
+			"-otlp-batch-max-batch-size", "100", "-otlp-grpc-batch-export-interval", "7",
+			"-otlp-grpc-batch-max-batch-size", "50", "-otlp-http-batch-export-interval", "9"}, 7, 50},
+		{"http overrides", []string{"-otlp-exporter", "http", "-otlp-batch-export-interval", "3",
+			"-otlp-batch-max-batch-size", "100", "-otlp-http-batch-max-batch-size", "20",
+			"-otlp-grpc-batch-max-batch-size", "50"}, 3, 20},
+		{"overrides of the other exporter", []string{"-otlp-exporter", "http", "-otlp-batch-export-interval", "3",
+			"-otlp-batch-max-batch-size", "100", "-otlp-grpc-batch-export-interval", "7",
+			"-otlp-grpc-batch-max-batch-size", "50"}, 3, 100},
+		{"file exporter", []string{"-otlp-exporter", "file", "-file-path", "/tmp/records.jsonl",
+			"-otlp-batch-export-interval", "3", "-otlp-batch-max-batch-size", "100",
+			"-otlp-http-batch-export-interval", "9", "-otlp-grpc-batch-max-batch-size", "50"}, 3, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseFlags(tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.BatchExportInterval(); got != tt.interval {
+				t.Errorf("export interval %d, want %d", got, tt.interval)
+			}
+			if got := c.BatchMaxBatchSize(); got != tt.size {
+				t.Errorf("max batch size %d, want %d", got, tt.size)
+			}
+		})
+	}
+}
+
+// -print-config marshals the whole configuration: the PEM data, that
+// includes the private key, must never be part of it
+func TestPrintConfigHidesPEM(t *testing.T) {
+	t.Setenv(ENV_TLS_CA_PEM, "")
+	c, err := parseFlags("-otlp-tls-cert-pem", "cert-pem-from-flag", "-otlp-tls-key-pem", "key-pem-from-flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"cert-pem-from-flag", "key-pem-from-flag"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("%q printed in the configuration", secret)
+		}
+	}
+	printed := map[string]interface{}{}
+	if err := json.Unmarshal(out, &printed); err != nil {
+		t.Fatal(err)
+	}
+	// every field is printed, the secret ones telling only whether they're set
+	for key, want := range map[string]string{"OtlpTLSCertPEM": REDACTED, "OtlpTLSKeyPEM": REDACTED, "OtlpTLSCAPEM": "",
+		"OtlpTLSKeyFile": ""} {
+		if got, found := printed[key]; !found || got != want {
+			t.Errorf("%s printed as %v (found: %t), want %q", key, got, found, want)
+		}
+	}
+	fields := reflect.TypeOf(Config{})
+	for i := 0; i < fields.NumField(); i++ {
+		if field := fields.Field(i); field.IsExported() {
+			if _, found := printed[field.Name]; !found {
+				t.Errorf("%s missing from the printed configuration", field.Name)
+			}
+		}
+	}
+	if c.OtlpTLSKeyPEM != "key-pem-from-flag" {
+		t.Error("the configuration itself must not be redacted")
+	}
+}
+
+// the commands are looked for only when the monitoring starts, so that the
+// configuration can be validated and printed on any host
+func TestCheckCommands(t *testing.T) {
+	c := Default()
+	c.LXCMonitorCmd = "/nonexistent/pct exec {id}"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("a missing command must not fail the validation: %v", err)
+	}
+	if err := c.CheckCommands(); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("unexpected error for a missing command: %v", err)
+	}
+	c.SkipLXCs = true
+	if err := c.CheckCommands(); err != nil {
+		t.Errorf("the command must not be looked for without LXCs: %v", err)
+	}
+	c.SkipLXCs, c.DryRun = false, true
+	if err := c.CheckCommands(); err != nil {
+		t.Errorf("the command must not be looked for in dry run mode: %v", err)
+	}
+	c.DryRun, c.LXCMonitorCmd = false, "sh -c {id}"
+	if err := c.CheckCommands(); err != nil {
+		t.Errorf("unexpected error for a command in the PATH: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// priorities accepted by the --priority option of journalctl
+var JOURNAL_PRIORITIES = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	"0", "1", "2", "3", "4", "5", "6", "7"}
+
+// facilities accepted by the --facility option of journalctl
+var JOURNAL_FACILITIES = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "local0", "local1", "local2", "local3", "local4", "local5",
+	"local6", "local7"}
+
+// check that a journalctl filter can be safely passed as a single argument
+func checkJournalArg(name, value string) error {
+	if strings.TrimSpace(value) != value {
+		return fmt.Errorf("%s must not start or end with spaces", name)
+	}
+	if strings.ContainsFunc(value, unicode.IsControl) {
+		return fmt.Errorf("%s must not contain control characters", name)
+	}
+	return nil
+}
+
+// check the value of the --priority option: a single priority or a "FROM..TO" range
+func checkJournalPriority(value string) error {
+	for _, p := range strings.SplitN(value, "..", 2) {
+		if !slices.Contains(JOURNAL_PRIORITIES, p) {
+			return fmt.Errorf("journal-priority: unknown priority '%s'", p)
+		}
+	}
+	return nil
+}
+
+// check the value of the --facility option: a comma-separated list of facilities
+func checkJournalFacility(value string) error {
+	for _, f := range strings.Split(value, ",") {
+		if !slices.Contains(JOURNAL_FACILITIES, f) {
+			return fmt.Errorf("journal-facility: unknown facility '%s'", f)
+		}
+	}
+	return nil
+}
+
+// check the journalctl filters
+func (c *Config) validateJournalFilters() error {
+	for name, value := range map[string]string{
+		"journal-grep":     c.JournalGrep,
+		"journal-priority": c.JournalPriority,
+		"journal-facility": c.JournalFacility,
+	} {
+		if err := checkJournalArg(name, value); err != nil {
+			return err
+		}
+	}
+	if c.JournalPriority != "" {
+		if err := checkJournalPriority(c.JournalPriority); err != nil {
+			return err
+		}
+	}
+	if c.JournalFacility != "" {
+		if err := checkJournalFacility(c.JournalFacility); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return the arguments to append to the journalctl command run in the LXCs.
+// Values are joined to their option, so that they can't be parsed as other options
+func (c *Config) JournalFilterArgs() []string {
+	args := []string{}
+	if c.JournalGrep != "" {
+		args = append(args, "--grep="+c.JournalGrep)
+	}
+	if c.JournalPriority != "" {
+		args = append(args, "--priority="+c.JournalPriority)
+	}
+	if c.JournalFacility != "" {
+		args = append(args, "--facility="+c.JournalFacility)
+	}
+	return args
+}
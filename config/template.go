@@ -0,0 +1,60 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// expand a command template, like "pct exec {id} -- journalctl", into the
+// command and its arguments; placeholders are replaced after the template is
+// split on whitespace, so that values are never split
+func ExpandCmdTemplate(tmpl string, values map[string]string) ([]string, error) {
+	fields := strings.Fields(tmpl)
+	if len(fields) == 0 {
+		return nil, errors.New("empty command template")
+	}
+	args := []string{}
+	for _, field := range fields {
+		arg, err := ExpandTemplate(field, values)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command template '%s': %w", tmpl, err)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// replace the {placeholders} found in a template with the given values
+func ExpandTemplate(field string, values map[string]string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.IndexAny(field, "{}")
+		if start < 0 {
+			b.WriteString(field)
+			return b.String(), nil
+		}
+		if field[start] == '}' {
+			return "", errors.New("unbalanced '}'")
+		}
+		end := strings.IndexAny(field[start+1:], "{}")
+		if end < 0 || field[start+1+end] == '{' {
+			return "", errors.New("unbalanced '{'")
+		}
+		name := field[start+1 : start+1+end]
+		value, ok := values[name]
+		if !ok {
+			names := []string{}
+			for n := range values {
+				names = append(names, n)
+			}
+			slices.Sort(names)
+			return "", fmt.Errorf("unknown placeholder '{%s}'; valid ones: {%s}", name,
+				strings.Join(names, "}, {"))
+		}
+		b.WriteString(field[:start])
+		b.WriteString(value)
+		field = field[start+2+end:]
+	}
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandCmdTemplate(t *testing.T) {
+	values := map[string]string{"id": "100", "name": "web server"}
+	args, err := ExpandCmdTemplate("pct exec {id} -- journalctl --unit={name}.service", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// values are never split, even with spaces
+	want := []string{"pct", "exec", "100", "--", "journalctl", "--unit=web server.service"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Errorf("ExpandCmdTemplate = %q, want %q", args, want)
+	}
+	for tmpl, wantErr := range map[string]string{
+		"":                     "empty command template",
+		"pct exec {vmid}":      "unknown placeholder '{vmid}'; valid ones: {id}, {name}",
+		"pct exec {id":         "unbalanced '{'",
+		"pct exec id}":         "unbalanced '}'",
+		"pct exec {{id}}":      "unbalanced '{'",
+		"pct exec {id}{name}}": "unbalanced '}'",
+	} {
+		if _, err := ExpandCmdTemplate(tmpl, values); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("ExpandCmdTemplate(%q): got error %v, want %q", tmpl, err, wantErr)
+		}
+	}
+}
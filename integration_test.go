@@ -0,0 +1,174 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// output of the fake "pct list"
+const FAKE_PCT_LIST = `VMID       Status     Lock         Name
+100        running                 web
+101        running                 db
+102        stopped                 cache
+`
+
+// record received by the fake collector
+type receivedRecord struct {
+	resource map[string]string
+	// MESSAGE field of the journal entry
+	message  string
+	severity string
+}
+
+// return the MESSAGE field of the body of a record, sent as a map
+func bodyMessage(v *commonpb.AnyValue) string {
+	for _, kv := range v.GetKvlistValue().GetValues() {
+		if kv.Key == "MESSAGE" {
+			return kv.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+// OTLP/HTTP collector keeping the received records in memory
+type fakeCollector struct {
+	mu      sync.Mutex
+	records []receivedRecord
+}
+
+// return the string form of an OTLP value
+func anyValueString(v *commonpb.AnyValue) string {
+	switch v.GetValue().(type) {
+	case *commonpb.AnyValue_IntValue:
+		return fmt.Sprint(v.GetIntValue())
+	case *commonpb.AnyValue_BoolValue:
+		return fmt.Sprint(v.GetBoolValue())
+	}
+	return v.GetStringValue()
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := collogspb.ExportLogsServiceRequest{}
+	if err := proto.Unmarshal(data, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	for _, rl := range req.ResourceLogs {
+		resource := map[string]string{}
+		for _, kv := range rl.GetResource().GetAttributes() {
+			resource[kv.Key] = anyValueString(kv.Value)
+		}
+		for _, sl := range rl.ScopeLogs {
+			for _, lr := range sl.LogRecords {
+				c.records = append(c.records, receivedRecord{resource: resource,
+					message: bodyMessage(lr.Body), severity: lr.SeverityText})
+			}
+		}
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// return the records received so far
+func (c *fakeCollector) received() []receivedRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]receivedRecord{}, c.records...)
+}
+
+// write an executable shell script to a directory
+func writeScript(t *testing.T, dir string, name string, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// run the whole program against a fake "pct" and a fake journal of the LXCs,
+// sending the records to a collector running in the test
+func TestDiscoverMonitorAndExport(t *testing.T) {
+	collector := &fakeCollector{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+	bin := t.TempDir()
+	writeScript(t, bin, "pct", fmt.Sprintf(`case "$1" in
+list) printf '%%s' '%s' ;;
+config) echo "hostname: ct$2" ;;
+*) exit 1 ;;
+esac`, FAKE_PCT_LIST))
+	journal := writeScript(t, bin, "journal", `echo "{\"MESSAGE\": \"hello from $2\", \"PRIORITY\": \"6\"}"
+echo "{\"MESSAGE\": \"failure in $2\", \"PRIORITY\": \"3\"}"
+exec sleep 60`)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$", "--", "-discovery-retries", "0",
+		"-skip-pve", "-otlp-exporter", "http", "-otlp-http-url", srv.URL, "-otlp-compression", "none",
+		"-otlp-processor", "simple", "-lxc-monitor-cmd", journal+" {id} {name}")
+	cmd.Env = append(os.Environ(), RUN_MAIN_ENV+"=1", "PATH="+bin+":"+os.Getenv("PATH"))
+	var out strings.Builder
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(collector.received()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("the program failed: %v\n%s", err, out.String())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("the program did not stop\n%s", out.String())
+	}
+
+	records := collector.received()
+	if len(records) != 4 {
+		t.Fatalf("received %d records, want 4\n%s", len(records), out.String())
+	}
+	for _, vm := range []struct{ id, name string }{{"100", "web"}, {"101", "db"}} {
+		messages := map[string]string{}
+		for _, r := range records {
+			if r.resource["proxmox.vmid"] != vm.id {
+				continue
+			}
+			messages[r.message] = r.severity
+			if r.resource["service.name"] != vm.name || r.resource["proxmox.vm.type"] != "lxc" {
+				t.Errorf("unexpected resource of VM %s: %v", vm.id, r.resource)
+			}
+		}
+		want := map[string]string{"hello from " + vm.name: "INFO", "failure in " + vm.name: "ERROR"}
+		if fmt.Sprint(messages) != fmt.Sprint(want) {
+			t.Errorf("records of VM %s: %v, want %v", vm.id, messages, want)
+		}
+	}
+}
@@ -1,35 +1,101 @@
 package main
 
 import (
+	"context"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/alberanid/pve2otelcol/config"
+	"github.com/alberanid/pve2otelcol/metrics"
+	"github.com/alberanid/pve2otelcol/ologgers"
 	"github.com/alberanid/pve2otelcol/pve"
 )
 
+// read the attributes file, if any, keeping the previous attributes on failure
+func loadAttrsFile(cfg *config.Config, p *pve.Pve) {
+	if cfg.AttrsFile == "" {
+		return
+	}
+	attrs, err := config.ParseAttrsFile(cfg.AttrsFile)
+	if err != nil {
+		slog.Error("failure reading the attributes file", "path", cfg.AttrsFile, "err", err)
+		return
+	}
+	slog.Info("attributes file loaded", "path", cfg.AttrsFile, "attributes", len(attrs))
+	p.SetFileAttrs(attrs)
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run the program until it's asked to stop, returning the exit code
+func run() int {
 	cfg := config.ParseArgs()
-	done := make(chan bool, 1)
-	stopSigs := make(chan os.Signal, 1)
-	signal.Notify(stopSigs, syscall.SIGINT, syscall.SIGTERM)
+	ologgers.SetInternalLogger()
+	if err := ologgers.SetGzipLevel(cfg.OtlpGzipLevel); err != nil {
+		slog.Error("failure setting the gzip level", "level", cfg.OtlpGzipLevel, "err", err)
+		return 1
+	}
+	// cancelled at the first SIGINT or SIGTERM: everything winds down from here
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	p := pve.New(ctx, cfg)
+	loadAttrsFile(cfg, p)
+	if cfg.ListVMs {
+		p.ListVMs(os.Stdout)
+		return 0
+	}
+	if cfg.TestVM > 0 {
+		if err := p.TestVM(cfg.TestVM, cfg.TestVMRecords); err != nil {
+			slog.Error("failure testing the VM", "vm_id", cfg.TestVM, "err", err)
+			return 1
+		}
+		return 0
+	}
 	refreshSig := make(chan os.Signal, 1)
-	signal.Notify(refreshSig, syscall.SIGUSR1)
+	flushSig := make(chan os.Signal, 1)
+	reloadSig := make(chan os.Signal, 1)
+	dumpSig := make(chan os.Signal, 1)
+	notifyControlSignals(refreshSig, flushSig, reloadSig, dumpSig)
 
-	p := pve.New(cfg)
-	p.Start()
+	if cfg.MetricsAddress != "" {
+		go metrics.Serve(cfg.MetricsAddress)
+	}
+	if err := p.Start(); err != nil {
+		slog.Error("failure starting the monitoring", "err", err)
+		return 1
+	}
 
 	go func() {
-		<-stopSigs
-		p.Stop()
-		done <- true
+		for {
+			<-refreshSig
+			p.RequestRefresh()
+		}
 	}()
 	go func() {
 		for {
-			<-refreshSig
-			p.RefreshVMsMonitoring()
+			<-flushSig
+			p.Flush()
+		}
+	}()
+	go func() {
+		for {
+			<-reloadSig
+			loadAttrsFile(cfg, p)
+		}
+	}()
+	go func() {
+		for {
+			<-dumpSig
+			p.WriteSnapshot(os.Stderr)
 		}
 	}()
-	<-done
+	<-ctx.Done()
+	// a second signal terminates the program right away
+	stop()
+	p.Stop()
+	return 0
 }
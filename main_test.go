@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// when set, the test binary runs the program with the arguments following "--"
+const RUN_MAIN_ENV = "PVE2OTELCOL_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(RUN_MAIN_ENV) != "" {
+		for i, arg := range os.Args {
+			if arg == "--" {
+				os.Args = append([]string{"pve2otelcol"}, os.Args[i+1:]...)
+				break
+			}
+		}
+		os.Exit(run())
+	}
+	os.Exit(m.Run())
+}
+
+// run the program with the given arguments, returning its exit code and output
+func runMain(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	// no retries, since the Proxmox commands are missing
+	args = append([]string{"-test.run=^$", "--", "-discovery-retries", "0"}, args...)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), RUN_MAIN_ENV+"=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"list vms", []string{"-dry-run", "-skip-pve", "-list-vms"}, 0},
+		{"print config without the Proxmox commands", []string{"-print-config"}, 0},
+		{"missing monitoring command", []string{"-skip-pve", "-lxc-monitor-cmd", "/nonexistent/pct exec {id}"}, 1},
+		{"invalid configuration", []string{"-skip-lxcs", "-skip-pve"}, 1},
+		{"no vm to monitor", []string{"-dry-run", "-skip-pve", "-require-vms"}, 1},
+		{"test vm not found", []string{"-dry-run", "-skip-pve", "-test-vm", "100"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, out := runMain(t, tt.args...)
+			if code != tt.want {
+				t.Errorf("exit code %d, want %d; output:\n%s", code, tt.want, out)
+			}
+		})
+	}
+}
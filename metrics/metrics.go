@@ -0,0 +1,153 @@
+package metrics
+
+/*
+Minimal registry of metrics exposed in the Prometheus text format.
+*/
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const GAUGE = "gauge"
+const COUNTER = "counter"
+
+// a metric with all its series, identified by their labels
+type family struct {
+	name   string
+	typ    string
+	help   string
+	series map[string]float64
+}
+
+var mu sync.Mutex
+var families = map[string]*family{}
+
+// functions called to update the metrics before they are written
+var collectors = []*func(){}
+
+// return the family of a metric, creating it if needed; the lock must be held
+func getFamily(name string) *family {
+	f, ok := families[name]
+	if !ok {
+		f = &family{name: name, typ: "untyped", series: map[string]float64{}}
+		families[name] = f
+	}
+	return f
+}
+
+// escape a label value
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// render a list of key, value pairs as Prometheus labels
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], escape(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// describe a metric, with its type and help text
+func Register(name string, typ string, help string) {
+	mu.Lock()
+	defer mu.Unlock()
+	f := getFamily(name)
+	f.typ = typ
+	f.help = help
+}
+
+// set the value of a series; labels are key, value pairs
+func Set(name string, value float64, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	getFamily(name).series[renderLabels(labels)] = value
+}
+
+// add a delta to the value of a series; labels are key, value pairs
+func Add(name string, delta float64, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	getFamily(name).series[renderLabels(labels)] += delta
+}
+
+// remove a series; labels are key, value pairs
+func Delete(name string, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(getFamily(name).series, renderLabels(labels))
+}
+
+// add a function called to update the metrics before they are written; the
+// returned function removes it
+func OnCollect(f func()) func() {
+	mu.Lock()
+	defer mu.Unlock()
+	collector := &f
+	collectors = append(collectors, collector)
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		collectors = slices.DeleteFunc(collectors, func(c *func()) bool { return c == collector })
+	}
+}
+
+// remove all the series of a metric
+func Reset(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	clear(getFamily(name).series)
+}
+
+// write all the metrics in the Prometheus text format
+func Write(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	fns := slices.Clone(collectors)
+	mu.Unlock()
+	for _, f := range fns {
+		(*f)()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	names := []string{}
+	for name := range families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		f := families[name]
+		if f.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		keys := []string{}
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, key, strconv.FormatFloat(f.series[key], 'f', -1, 64))
+		}
+	}
+}
+
+// serve the metrics on the /metrics path of the given address
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Write)
+	slog.Info("serving metrics", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		slog.Error("failure serving metrics", "address", address, "err", err)
+	}
+}
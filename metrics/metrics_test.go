@@ -0,0 +1,19 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOnCollectRemove(t *testing.T) {
+	calls := 0
+	remove := OnCollect(func() { calls++ })
+	Write(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	remove()
+	// removing it twice is harmless
+	remove()
+	Write(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	if calls != 1 {
+		t.Errorf("the function was called %d times, want once before its removal", calls)
+	}
+}
@@ -0,0 +1,21 @@
+package ologgers
+
+import (
+	"sort"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// return the attributes read from the attributes file, sorted by key
+func fileAttrs(attrs map[string]string) []attribute.KeyValue {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	kvs := make([]attribute.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, attribute.String(key, attrs[key]))
+	}
+	return kvs
+}
@@ -0,0 +1,29 @@
+package ologgers
+
+import (
+	"testing"
+)
+
+func TestFileAttrs(t *testing.T) {
+	cfg, _ := testConfig(t)
+	r := firstRecord(t, cfg, OLoggerOptions{ServiceId: "lxc/100", ServiceName: "ct100", VMId: 100, VMType: "lxc",
+		FileAttrs: map[string]string{"site": "milan", "service.name": "overridden", "proxmox.vmid": "999"}})
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"site", "milan"},
+		// the attributes of the file can't override the others
+		{"service.name", "ct100"},
+		{"proxmox.vmid", "100"},
+	}
+	for _, tt := range tests {
+		if got, _ := resourceAttr(r, tt.key); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+	r = firstRecord(t, cfg, OLoggerOptions{ServiceId: "lxc/101", ServiceName: "ct101", VMId: 101, VMType: "lxc"})
+	if got, found := resourceAttr(r, "site"); found {
+		t.Errorf("site = %q without attributes", got)
+	}
+}
@@ -0,0 +1,74 @@
+package ologgers
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// return the body of a record in the configured format: "map" keeps the
+// fields of a log entry as a map, "string" serializes them as JSON and
+// "logfmt" as space-separated KEY=VALUE pairs sorted by key; entries that
+// are not maps are kept as they are
+func (o *OLogger) formatBody(i interface{}, body otellog.Value) otellog.Value {
+	obj, ok := i.(map[string]interface{})
+	if !ok {
+		return body
+	}
+	switch o.cfg.BodyFormat {
+	case "string":
+		if data, err := json.Marshal(obj); err == nil {
+			return otellog.StringValue(string(data))
+		}
+	case "logfmt":
+		return otellog.StringValue(logfmt(obj))
+	}
+	return body
+}
+
+// serialize a log entry in the logfmt format
+func logfmt(obj map[string]interface{}) string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var b strings.Builder
+	for n, k := range keys {
+		if n > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(obj[k]))
+	}
+	return b.String()
+}
+
+// format a value for logfmt, quoting it when needed
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case nil:
+		return ""
+	case bool, float64, int, int64:
+		return fmt.Sprint(v)
+	default:
+		// binary journald fields are arrays of bytes
+		data, _ := json.Marshal(v)
+		s = string(data)
+	}
+	if s == "" || strings.ContainsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+	}) {
+		return strconv.Quote(s)
+	}
+	return s
+}
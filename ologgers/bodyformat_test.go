@@ -0,0 +1,74 @@
+package ologgers
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLogfmtValue(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{"plain", "started", "started"},
+		{"unicode", "café", "café"},
+		{"empty", "", `""`},
+		{"spaces", "two words", `"two words"`},
+		{"equal sign", "a=b", `"a=b"`},
+		{"quotes", `say "hi"`, `"say \"hi\""`},
+		{"backslash", `C:\temp`, `"C:\\temp"`},
+		{"newline", "line\nbreak", `"line\nbreak"`},
+		{"control character", "bell\a", `"bell\a"`},
+		{"null", nil, ""},
+		{"bool", true, "true"},
+		{"number", 1.5, "1.5"},
+		{"int", 42, "42"},
+		{"binary field", []interface{}{float64(104), float64(105)}, "[104,105]"},
+		{"map", map[string]interface{}{"a": "b"}, `"{\"a\":\"b\"}"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logfmtValue(tt.in); got != tt.want {
+				t.Errorf("logfmtValue(%#v) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyFormat(t *testing.T) {
+	entry := map[string]interface{}{"MESSAGE": "disk full", "PRIORITY": "3", "_PID": "42",
+		"BINARY": []interface{}{float64(1), float64(2)}}
+	tests := []struct {
+		name     string
+		format   string
+		in       interface{}
+		want     interface{}
+		severity string
+	}{
+		{"logfmt sorted by key", "logfmt", entry, `BINARY=[1,2] MESSAGE="disk full" PRIORITY=3 _PID=42`, "ERROR"},
+		{"json string", "string", entry, `{"BINARY":[1,2],"MESSAGE":"disk full","PRIORITY":"3","_PID":"42"}`, "ERROR"},
+		{"logfmt of an empty entry", "logfmt", map[string]interface{}{}, "", ""},
+		{"line not a map", "logfmt", "plain line", "plain line", ""},
+		{"map", "map", map[string]interface{}{"MESSAGE": "hi"}, map[string]interface{}{"MESSAGE": "hi"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.BodyFormat = tt.format
+			o := newTestLogger(t, cfg)
+			o.Log(tt.in)
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", records)
+			}
+			if got := records[0]["body"]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("body %#v, want %#v", got, tt.want)
+			}
+			// the fields are still read to build the record
+			if got := records[0]["severity_text"]; got != tt.severity {
+				t.Errorf("severity %q, want %q", got, tt.severity)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package ologgers
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// count the records emitted to a provider, the ones handed to its exporter
+// and the ones its exporter failed to send; the difference between the
+// accepted and the exported ones is the number of records held in memory
+type recordCounter struct {
+	emitted  atomic.Int64
+	exported atomic.Int64
+	failed   atomic.Int64
+	// records accepted by the processor and not yet received by the exporter
+	pending atomic.Int64
+}
+
+// processor counting the emitted records; over limit pending records (if
+// greater than zero) the new ones are dropped: the batch processor would drop
+// the oldest queued one instead, without telling which, so that the pending
+// records could no longer be counted
+type countingProcessor struct {
+	sdklog.Processor
+	counter *recordCounter
+	limit   int
+}
+
+func (p countingProcessor) OnEmit(ctx context.Context, r *sdklog.Record) error {
+	p.counter.emitted.Add(1)
+	if n := p.counter.pending.Add(1); p.limit > 0 && n > int64(p.limit) {
+		p.counter.pending.Add(-1)
+		queueDrops.add(1)
+		return nil
+	}
+	return p.Processor.OnEmit(ctx, r)
+}
+
+// exporter counting the records it received, whether they were sent successfully or not
+type countingExporter struct {
+	sdklog.Exporter
+	counter   *recordCounter
+	serviceId string
+}
+
+// the failures are logged and not returned: the batch processor would not export
+// the following chunks of a flush, that would never be counted as exported
+func (e countingExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	err := e.Exporter.Export(ctx, records)
+	e.counter.exported.Add(int64(len(records)))
+	e.counter.pending.Add(-int64(len(records)))
+	if err != nil {
+		e.counter.failed.Add(int64(len(records)))
+		slog.Warn("failure exporting records", "service", e.serviceId, "records", len(records), "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package ologgers
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alberanid/pve2otelcol/metrics"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+)
+
+// minimum time between two warnings about dropped records
+const DROPS_WARNING_INTERVAL = time.Minute
+
+func init() {
+	metrics.Register("pve2otelcol_dropped_records_total", metrics.COUNTER,
+		"Number of records dropped by the batch processors because their queue was full.")
+}
+
+// Send the messages of the OpenTelemetry SDK to the program logs, counting the
+// records it reports as dropped; the SDK logger is global to the process, so it's
+// set by the program and not by the package, that can be embedded in another one
+func SetInternalLogger() {
+	otel.SetLogger(logr.New(&internalSink{drops: queueDrops}))
+}
+
+// records dropped because the queue of a batch processor was full
+var queueDrops = &dropCounter{}
+
+// records dropped since the last warning
+type dropCounter struct {
+	mu       sync.Mutex
+	lastWarn time.Time
+	dropped  uint64
+}
+
+// receive the messages of the OpenTelemetry SDK, which is the only way to know
+// about the records dropped by a batch processor, and log them with slog
+type internalSink struct {
+	drops      *dropCounter
+	attributes []any
+}
+
+func (s *internalSink) Init(info logr.RuntimeInfo) {}
+
+// only errors and warnings are of interest
+func (s *internalSink) Enabled(level int) bool {
+	return level <= 1
+}
+
+func (s *internalSink) Info(level int, msg string, keysAndValues ...any) {
+	if msg == "dropped log records" {
+		for i := 0; i+1 < len(keysAndValues); i += 2 {
+			if d, ok := keysAndValues[i+1].(uint64); ok && keysAndValues[i] == "dropped" {
+				s.drops.add(d)
+			}
+		}
+		return
+	}
+	slog.Warn("OpenTelemetry: "+msg, slices.Concat(s.attributes, keysAndValues)...)
+}
+
+func (s *internalSink) Error(err error, msg string, keysAndValues ...any) {
+	slog.Error("OpenTelemetry: "+msg, slices.Concat(s.attributes, []any{"err", err}, keysAndValues)...)
+}
+
+func (s *internalSink) WithValues(keysAndValues ...any) logr.LogSink {
+	return &internalSink{drops: s.drops, attributes: slices.Concat(s.attributes, keysAndValues)}
+}
+
+func (s *internalSink) WithName(name string) logr.LogSink {
+	return s
+}
+
+// count the dropped records, warning at most once every DROPS_WARNING_INTERVAL
+func (c *dropCounter) add(d uint64) {
+	metrics.Add("pve2otelcol_dropped_records_total", float64(d))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropped += d
+	if time.Since(c.lastWarn) < DROPS_WARNING_INTERVAL {
+		return
+	}
+	slog.Warn("log records dropped because the export queue is full; consider increasing otlp-batch-max-queue-size",
+		"dropped", c.dropped)
+	c.dropped = 0
+	c.lastWarn = time.Now()
+}
@@ -0,0 +1,59 @@
+package ologgers
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alberanid/pve2otelcol/metrics"
+	"github.com/go-logr/logr"
+)
+
+// return the value of a metric series, as written by the metrics endpoint
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Write(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, found := strings.CutPrefix(line, series+" "); found {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestDroppedRecordsCounter(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.OtlpProcessor = "batch"
+	cfg.OtlpBatchMaxQueueSize = 4
+	cfg.OtlpBatchMaxBatchSize = 2
+	cfg.OtlpBatchExportInterval = 3600
+	exporter := &memoryExporter{gate: make(chan struct{})}
+	defer close(exporter.gate)
+	o := newMemoryLogger(t, cfg, exporter)
+	before := metricValue(t, "pve2otelcol_dropped_records_total")
+	for n := range 10 {
+		o.Log(fmt.Sprint(n))
+	}
+	if dropped := metricValue(t, "pve2otelcol_dropped_records_total") - before; dropped != 6 {
+		t.Errorf("%v records counted as dropped, want 6", dropped)
+	}
+}
+
+func TestInternalSinkCountsDrops(t *testing.T) {
+	before := metricValue(t, "pve2otelcol_dropped_records_total")
+	// as logged by the batch processor of the SDK, with global.Warn
+	logger := logr.New(&internalSink{drops: queueDrops})
+	logger.V(1).Info("dropped log records", "dropped", uint64(3))
+	// debug messages are ignored
+	logger.V(8).Info("dropped log records", "dropped", uint64(5))
+	if dropped := metricValue(t, "pve2otelcol_dropped_records_total") - before; dropped != 3 {
+		t.Errorf("%v records counted as dropped, want 3", dropped)
+	}
+}
@@ -0,0 +1,73 @@
+package ologgers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// exporter sending records to the first working endpoint of a list.
+// Once an endpoint fails (after its own retries), the next one is used
+// and it remains the preferred one until it fails, in turn.
+type failoverExporter struct {
+	mu        sync.Mutex
+	exporters []sdklog.Exporter
+	urls      []string
+	current   int
+}
+
+// return a failoverExporter instance; exporters and urls must have the same length.
+func newFailoverExporter(exporters []sdklog.Exporter, urls []string) *failoverExporter {
+	return &failoverExporter{
+		exporters: exporters,
+		urls:      urls,
+	}
+}
+
+// export records to the current endpoint, trying the next ones on failure.
+// The lock is not held during the exports: with a shared exporter, an
+// endpoint retrying a failure must not stall the exports of the other VMs.
+func (f *failoverExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	f.mu.Lock()
+	current := f.current
+	f.mu.Unlock()
+	var err error
+	for n := range f.exporters {
+		idx := (current + n) % len(f.exporters)
+		err = f.exporters[idx].Export(ctx, records)
+		if err == nil {
+			if idx != current {
+				f.mu.Lock()
+				if f.current != idx {
+					slog.Warn("switching OTLP endpoint", "url", f.urls[idx])
+					f.current = idx
+				}
+				f.mu.Unlock()
+			}
+			return nil
+		}
+		slog.Warn("failure exporting records", "url", f.urls[idx], "err", err)
+	}
+	return err
+}
+
+// shut down all the exporters
+func (f *failoverExporter) Shutdown(ctx context.Context) error {
+	errs := []error{}
+	for _, e := range f.exporters {
+		errs = append(errs, e.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// flush all the exporters
+func (f *failoverExporter) ForceFlush(ctx context.Context) error {
+	errs := []error{}
+	for _, e := range f.exporters {
+		errs = append(errs, e.ForceFlush(ctx))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+package ologgers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// exporter counting the records it receives, failing while fail is set
+type stubExporter struct {
+	fail      bool
+	exported  int
+	shutdowns int
+}
+
+func (e *stubExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	if e.fail {
+		return errors.New("unreachable")
+	}
+	e.exported += len(records)
+	return nil
+}
+
+func (e *stubExporter) Shutdown(ctx context.Context) error {
+	e.shutdowns++
+	return nil
+}
+
+func (e *stubExporter) ForceFlush(ctx context.Context) error { return nil }
+
+// exporter blocking its first export until released
+type blockingExporter struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (e *blockingExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	if e.calls.Add(1) == 1 {
+		<-e.release
+	}
+	return nil
+}
+
+func (e *blockingExporter) Shutdown(ctx context.Context) error   { return nil }
+func (e *blockingExporter) ForceFlush(ctx context.Context) error { return nil }
+
+func TestFailoverExporter(t *testing.T) {
+	primary, fallback := &stubExporter{}, &stubExporter{}
+	f := newFailoverExporter([]sdklog.Exporter{primary, fallback}, []string{"http://primary", "http://fallback"})
+	records := make([]sdklog.Record, 2)
+	ctx := context.Background()
+
+	if err := f.Export(ctx, records); err != nil || primary.exported != 2 {
+		t.Fatalf("records must go to the primary endpoint: err=%v, exported=%d", err, primary.exported)
+	}
+	primary.fail = true
+	if err := f.Export(ctx, records); err != nil || fallback.exported != 2 {
+		t.Fatalf("records must go to the fallback endpoint: err=%v, exported=%d", err, fallback.exported)
+	}
+	// the fallback remains the preferred one until it fails
+	primary.fail = false
+	if err := f.Export(ctx, records); err != nil || fallback.exported != 4 || primary.exported != 2 {
+		t.Fatalf("the fallback endpoint must stay in use: primary=%d, fallback=%d", primary.exported, fallback.exported)
+	}
+	fallback.fail = true
+	if err := f.Export(ctx, records); err != nil || primary.exported != 4 {
+		t.Fatalf("records must go back to the primary endpoint: err=%v, exported=%d", err, primary.exported)
+	}
+	primary.fail = true
+	if err := f.Export(ctx, records); err == nil {
+		t.Fatal("expected an error when all the endpoints fail")
+	}
+}
+
+// an export retrying on a slow endpoint doesn't block the other ones
+func TestFailoverExporterConcurrentExports(t *testing.T) {
+	slow := &blockingExporter{release: make(chan struct{})}
+	f := newFailoverExporter([]sdklog.Exporter{slow}, []string{"http://slow"})
+	blocked := make(chan struct{})
+	go func() {
+		f.Export(context.Background(), make([]sdklog.Record, 1))
+		close(blocked)
+	}()
+	waitFor(t, "the first export to start", func() bool { return slow.calls.Load() == 1 })
+	done := make(chan struct{})
+	go func() {
+		f.Export(context.Background(), make([]sdklog.Record, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("an export waited for the blocked one")
+	}
+	close(slow.release)
+	<-blocked
+}
@@ -0,0 +1,117 @@
+package ologgers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// exporter appending the records to a file, one JSON object per line
+type fileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// create an exporter appending records to the given file, creating it if needed
+func newFileExporter(path string) (*fileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: f}, nil
+}
+
+// convert an OpenTelemetry value to an object that can be marshalled to JSON
+func valueToJSON(v otellog.Value) interface{} {
+	switch v.Kind() {
+	case otellog.KindBool:
+		return v.AsBool()
+	case otellog.KindFloat64:
+		return v.AsFloat64()
+	case otellog.KindInt64:
+		return v.AsInt64()
+	case otellog.KindString:
+		return v.AsString()
+	case otellog.KindBytes:
+		return v.AsBytes()
+	case otellog.KindSlice:
+		items := []interface{}{}
+		for _, item := range v.AsSlice() {
+			items = append(items, valueToJSON(item))
+		}
+		return items
+	case otellog.KindMap:
+		return keyValuesToJSON(v.AsMap())
+	}
+	return nil
+}
+
+// convert a list of OpenTelemetry key/values to a map that can be marshalled to JSON
+func keyValuesToJSON(kvs []otellog.KeyValue) map[string]interface{} {
+	m := map[string]interface{}{}
+	for _, kv := range kvs {
+		m[kv.Key] = valueToJSON(kv.Value)
+	}
+	return m
+}
+
+// convert a record to an object that can be marshalled to JSON
+func recordToJSON(r *sdklog.Record) map[string]interface{} {
+	attrs := []otellog.KeyValue{}
+	r.WalkAttributes(func(kv otellog.KeyValue) bool {
+		attrs = append(attrs, kv)
+		return true
+	})
+	res := r.Resource()
+	resource := map[string]interface{}{}
+	for _, kv := range res.Attributes() {
+		resource[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	obj := map[string]interface{}{
+		"timestamp":          r.Timestamp().Format(time.RFC3339Nano),
+		"observed_timestamp": r.ObservedTimestamp().Format(time.RFC3339Nano),
+		"severity":           int(r.Severity()),
+		"severity_text":      r.SeverityText(),
+		"body":               valueToJSON(r.Body()),
+		"attributes":         keyValuesToJSON(attrs),
+		"resource":           resource,
+	}
+	if r.TraceID().IsValid() {
+		obj["trace_id"] = r.TraceID().String()
+	}
+	if r.SpanID().IsValid() {
+		obj["span_id"] = r.SpanID().String()
+	}
+	return obj
+}
+
+func (e *fileExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		if err := enc.Encode(recordToJSON(&records[i])); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// a single write in append mode, so that the lines of loggers sharing the file are not mixed up
+	_, err := e.file.Write(buf.Bytes())
+	return err
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+func (e *fileExporter) ForceFlush(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package ologgers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+func TestFileExporterFormat(t *testing.T) {
+	cfg, path := testConfig(t)
+	o := newTestLogger(t, cfg)
+	o.Log(map[string]interface{}{
+		"MESSAGE":              "disk full",
+		"PRIORITY":             "3",
+		"__REALTIME_TIMESTAMP": "1700000000123456",
+		"TRACE_ID":             "4bf92f3577b34da6a3ce929d0e0e4736",
+		"SPAN_ID":              "00f067aa0ba902b7",
+		"BINARY":               []interface{}{float64(1), float64(2)},
+		"NESTED":               map[string]interface{}{"ok": true},
+	}, otellog.String("log.source", "journal"))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one JSON line, got %q", data)
+	}
+	record := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456000).Format(time.RFC3339Nano)
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"timestamp", `"` + ts + `"`},
+		{"observed_timestamp", `"` + ts + `"`},
+		{"severity", "17"},
+		{"severity_text", `"ERROR"`},
+		{"trace_id", `"4bf92f3577b34da6a3ce929d0e0e4736"`},
+		{"span_id", `"00f067aa0ba902b7"`},
+		{"body", `{"BINARY":[1,2],"MESSAGE":"disk full","NESTED":{"ok":true},"PRIORITY":"3",` +
+			`"SPAN_ID":"00f067aa0ba902b7","TRACE_ID":"4bf92f3577b34da6a3ce929d0e0e4736",` +
+			`"__REALTIME_TIMESTAMP":"1700000000123456"}`},
+		{"attributes", `{"log.source":"journal"}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(record[tt.key])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+	resource, _ := record["resource"].(map[string]interface{})
+	if resource["service.name"] != "ct100" || resource["proxmox.vmid"] != float64(100) {
+		t.Errorf("unexpected resource: %v", resource)
+	}
+}
+
+func TestFileExporterAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	if err := os.WriteFile(path, []byte("{\"previous\":true}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := testConfig(t)
+	cfg.FilePath = path
+	// two loggers writing to the same file
+	first, second := newTestLogger(t, cfg), newTestLogger(t, cfg)
+	for range 10 {
+		first.Log("first")
+		second.Log("second")
+	}
+	records := readRecords(t, path)
+	if len(records) != 21 || records[0]["previous"] != true {
+		t.Fatalf("the records must be appended to the file: %d records", len(records))
+	}
+	first.Shutdown(context.Background())
+	second.Log("after")
+	if records := readRecords(t, path); len(records) != 22 {
+		t.Errorf("a logger must keep writing after another one is shut down: %d records", len(records))
+	}
+}
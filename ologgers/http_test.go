@@ -0,0 +1,200 @@
+package ologgers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alberanid/pve2otelcol/config"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// start an HTTP server accepting OTLP requests, returning its URL and a
+// channel receiving the requests
+func newHTTPCollector(t *testing.T) (string, chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests
+}
+
+// return the first request received by a collector
+func receiveRequest(t *testing.T, requests chan *http.Request) *http.Request {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received by the collector")
+		return nil
+	}
+}
+
+func TestHTTPURLPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		urlPath string
+		flag    string
+		want    string
+	}{
+		{"default", "", "", "/v1/logs"},
+		{"path of the url", "/otlp/v1/logs", "", "/otlp/v1/logs"},
+		{"flag", "", "/custom/logs", "/custom/logs"},
+		{"flag over the path of the url", "/otlp/v1/logs", "/custom/logs", "/custom/logs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collectorURL, requests := newHTTPCollector(t)
+			cfg, _ := testConfig(t)
+			cfg.OtlpExporter = "http"
+			cfg.OtlpHTTPURL = collectorURL + tt.urlPath
+			cfg.OtlpHTTPPath = tt.flag
+			o := newTestLogger(t, cfg)
+			o.Log("line")
+			if got := receiveRequest(t, requests).URL.Path; got != tt.want {
+				t.Errorf("records sent to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorsExporter(t *testing.T) {
+	mainURL, mainRequests := newHTTPCollector(t)
+	errorsURL, errorsRequests := newHTTPCollector(t)
+	cfg, _ := testConfig(t)
+	cfg.OtlpExporter = "http"
+	cfg.OtlpHTTPURL = mainURL
+	cfg.OtlpErrorsURL = errorsURL
+	cfg.OtlpErrorsSeverity = "error"
+	cfg.LogRules = []config.LogRule{{Field: "_COMM", Value: "sshd", Action: config.RULE_ROUTE}}
+	o := newTestLogger(t, cfg)
+	o.Log(map[string]interface{}{"MESSAGE": "info", "PRIORITY": "6"})
+	o.Log(map[string]interface{}{"MESSAGE": "error", "PRIORITY": "3"})
+	o.Log(map[string]interface{}{"MESSAGE": "routed", "PRIORITY": "6", "_COMM": "sshd"})
+	// records are exported synchronously, one per request
+	if n := len(mainRequests); n != 3 {
+		t.Errorf("the main endpoint received %d records, want 3", n)
+	}
+	if n := len(errorsRequests); n != 2 {
+		t.Errorf("the errors endpoint received %d records, want 2", n)
+	}
+}
+
+// gRPC collector sending the user agent of the requests to a channel
+type grpcCollector struct {
+	collogspb.UnimplementedLogsServiceServer
+	agents chan string
+}
+
+func (c *grpcCollector) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	c.agents <- strings.Join(md.Get("user-agent"), " ")
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+// start a gRPC server accepting OTLP requests, returning its URL and a
+// channel receiving the user agents of the requests
+func newGRPCCollector(t *testing.T) (string, chan string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &grpcCollector{agents: make(chan string, 16)}
+	srv := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(srv, collector)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return "http://" + lis.Addr().String(), collector.agents
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter string
+		agent    string
+		want     string
+	}{
+		{"http default", "http", config.DEFAULT_OTLP_USER_AGENT, config.DEFAULT_OTLP_USER_AGENT},
+		{"http custom", "http", "collector-test/1.0", "collector-test/1.0"},
+		{"http library default", "http", "", "OTel Go OTLP over HTTP/protobuf logs exporter/"},
+		{"grpc default", "grpc", config.DEFAULT_OTLP_USER_AGENT, config.DEFAULT_OTLP_USER_AGENT + " grpc-go/"},
+		{"grpc custom", "grpc", "collector-test/1.0", "collector-test/1.0 grpc-go/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.OtlpExporter = tt.exporter
+			cfg.OtlpUserAgent = tt.agent
+			var got string
+			if tt.exporter == "http" {
+				collectorURL, requests := newHTTPCollector(t)
+				cfg.OtlpHTTPURL = collectorURL
+				o := newTestLogger(t, cfg)
+				o.Log("line")
+				got = receiveRequest(t, requests).UserAgent()
+			} else {
+				collectorURL, agents := newGRPCCollector(t)
+				cfg.OtlpgRPCURL = collectorURL
+				o := newTestLogger(t, cfg)
+				o.Log("line")
+				select {
+				case got = <-agents:
+				case <-time.After(5 * time.Second):
+					t.Fatal("no request received by the collector")
+				}
+			}
+			// the libraries append their own version
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("user agent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPBatchOverrides(t *testing.T) {
+	collectorURL, requests := newHTTPCollector(t)
+	cfg, _ := testConfig(t)
+	cfg.OtlpExporter = "http"
+	cfg.OtlpHTTPURL = collectorURL
+	cfg.OtlpProcessor = "batch"
+	cfg.OtlpBatchExportInterval = 3600
+	cfg.OtlpBatchMaxBatchSize = 100
+	cfg.OtlpHTTPBatchMaxBatchSize = 2
+	cfg.OtlpgRPCBatchExportInterval = 1
+	o := newTestLogger(t, cfg)
+	for range 5 {
+		o.Log("line")
+	}
+	// the full batches of 2 records are exported right away, the last
+	// record waits: the export interval of the gRPC exporter is not used
+	time.Sleep(1500 * time.Millisecond)
+	if n := len(requests); n != 2 {
+		t.Fatalf("%d requests before the export interval, want 2", n)
+	}
+	if err := o.ForceFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(requests); n != 3 {
+		t.Errorf("%d requests after the flush, want 3", n)
+	}
+
+	cfg.OtlpHTTPBatchExportInterval = 1
+	o = newTestLogger(t, cfg)
+	for len(requests) > 0 {
+		<-requests
+	}
+	o.Log("line")
+	receiveRequest(t, requests)
+}
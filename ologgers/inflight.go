@@ -0,0 +1,56 @@
+package ologgers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alberanid/pve2otelcol/metrics"
+)
+
+// loggers not yet shut down, whose queues count towards the global limit
+var liveLoggers = struct {
+	mu  sync.Mutex
+	set map[*OLogger]struct{}
+}{set: map[*OLogger]struct{}{}}
+
+func init() {
+	metrics.Register("pve2otelcol_inflight_records", metrics.GAUGE,
+		"Number of records of all the VMs waiting to be exported.")
+	metrics.Register("pve2otelcol_inflight_dropped_records_total", metrics.COUNTER,
+		"Number of records dropped because of the global limit of records waiting to be exported.")
+	metrics.OnCollect(func() {
+		metrics.Set("pve2otelcol_inflight_records", float64(InflightRecords()))
+	})
+}
+
+// Return the number of records of all the loggers waiting to be exported
+func InflightRecords() int {
+	liveLoggers.mu.Lock()
+	defer liveLoggers.mu.Unlock()
+	total := 0
+	for o := range liveLoggers.set {
+		total += o.QueueDepth()
+	}
+	return total
+}
+
+// tell whether a record can be emitted under the global limit of records waiting
+// to be exported, waiting for room unless the policy is to drop it
+func (o *OLogger) admitInflight() bool {
+	limit := o.cfg.MaxInflightRecords
+	if limit <= 0 {
+		return true
+	}
+	for InflightRecords() >= limit {
+		if o.cfg.InflightPolicy == "drop" {
+			metrics.Add("pve2otelcol_inflight_dropped_records_total", 1)
+			return false
+		}
+		if o.stopped.Load() {
+			// the records logged while shutting down are always exported
+			return true
+		}
+		time.Sleep(QUEUE_POLL_INTERVAL)
+	}
+	return true
+}
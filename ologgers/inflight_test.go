@@ -0,0 +1,74 @@
+package ologgers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInflightLimitWithFailingExporter(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.OtlpProcessor = "batch"
+	cfg.OtlpBatchMaxQueueSize = 4
+	cfg.OtlpBatchMaxBatchSize = 2
+	cfg.OtlpBatchExportInterval = 3600
+	cfg.MaxInflightRecords = 4
+	cfg.InflightPolicy = "block"
+	exporter := &memoryExporter{fail: true, gate: make(chan struct{})}
+	o := newMemoryLogger(t, cfg, exporter)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := range 30 {
+			o.Log(fmt.Sprint(n))
+		}
+	}()
+	waitFor(t, "the limit to be reached", func() bool { return InflightRecords() == 4 })
+	select {
+	case <-done:
+		t.Fatal("the reader must wait while the limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the records leave the queue even if the collector rejects them
+	close(exporter.gate)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reader is stuck, although the failed records left the queue")
+	}
+	o.ForceFlush()
+	waitFor(t, "the queue to be emptied", func() bool { return InflightRecords() == 0 })
+	if emitted, delivered := o.DeliveryStats(); emitted != 30 || delivered != 0 {
+		t.Errorf("emitted %d records and delivered %d, want 30 and 0", emitted, delivered)
+	}
+}
+
+func TestInflightDropPolicy(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.OtlpProcessor = "batch"
+	cfg.OtlpBatchMaxQueueSize = 4
+	cfg.OtlpBatchMaxBatchSize = 2
+	cfg.OtlpBatchExportInterval = 3600
+	cfg.MaxInflightRecords = 3
+	cfg.InflightPolicy = "drop"
+	exporter := &memoryExporter{gate: make(chan struct{})}
+	o := newMemoryLogger(t, cfg, exporter)
+	for n := range 10 {
+		o.Log(fmt.Sprint(n))
+	}
+	if depth := InflightRecords(); depth != 3 {
+		t.Errorf("%d records in flight, want 3", depth)
+	}
+	close(exporter.gate)
+	o.ForceFlush()
+	if n := len(exporter.exported()); n != 3 {
+		t.Errorf("%d records exported, want the 3 accepted ones", n)
+	}
+	// once the queue is emptied, records are accepted again
+	o.Log("after")
+	o.ForceFlush()
+	if n := len(exporter.exported()); n != 4 {
+		t.Errorf("%d records exported, want 4", n)
+	}
+}
@@ -0,0 +1,20 @@
+package ologgers
+
+import (
+	"strings"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// add attributes to a record, with their keys in the configured style:
+// "dotted" keeps them as they are, "snake" replaces the dots with underscores
+func (o *OLogger) addAttributes(record *otellog.Record, attrs ...otellog.KeyValue) {
+	if o.cfg.AttrKeyStyle == "snake" {
+		renamed := make([]otellog.KeyValue, len(attrs))
+		for i, kv := range attrs {
+			renamed[i] = otellog.KeyValue{Key: strings.ReplaceAll(kv.Key, ".", "_"), Value: kv.Value}
+		}
+		attrs = renamed
+	}
+	record.AddAttributes(attrs...)
+}
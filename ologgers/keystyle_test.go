@@ -0,0 +1,48 @@
+package ologgers
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+func TestAttrKeyStyle(t *testing.T) {
+	entry := map[string]interface{}{"MESSAGE": "hello", "_PID": "42", "_COMM": "cron", "_BOOT_ID": "b00t",
+		"__REALTIME_TIMESTAMP": strconv.FormatInt(time.Now().UnixMicro(), 10)}
+	tests := []struct {
+		style string
+		want  []string
+	}{
+		{"dotted", []string{"boot.id", "command", "ingest.latency.ms", "log.source", "pid"}},
+		{"snake", []string{"boot_id", "command", "ingest_latency_ms", "log_source", "pid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.AttrKeyStyle = tt.style
+			cfg.BootIdAttr = true
+			cfg.AddIngestLatency = true
+			o := newTestLogger(t, cfg)
+			o.Log(entry, otellog.String("log.source", "journal"))
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", records)
+			}
+			got := []string{}
+			for key := range attributes(records[0]) {
+				got = append(got, key)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("attribute keys %q, want %q", got, tt.want)
+			}
+			// the resource attributes are not renamed
+			if _, found := records[0]["resource"].(map[string]interface{})["service.name"]; !found {
+				t.Errorf("missing service.name resource attribute: %v", records[0]["resource"])
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package ologgers
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// maximum number of lines joined in a single record
+const MULTILINE_MAX_LINES = 500
+
+// state used to join the lines of multiline messages, like stack traces
+type multilineState struct {
+	mu      sync.Mutex
+	start   *regexp.Regexp
+	timeout time.Duration
+	// held entries, by process: lines of different processes can be interleaved
+	held map[string]*heldEntry
+}
+
+// entry whose message is being joined with its following lines
+type heldEntry struct {
+	entry map[string]interface{}
+	attrs []otellog.KeyValue
+	lines int
+	timer *time.Timer
+}
+
+// return a key identifying the process that produced a journald entry
+func processKey(obj map[string]interface{}) string {
+	return fmt.Sprint(obj["_PID"]) + "\x00" + fmt.Sprint(obj["_COMM"])
+}
+
+// remove and return the entry held for a process, if any; the multiline lock
+// must be held. The entries are logged once the lock is released, so that an
+// export waiting for room doesn't block the other processes and the timers
+func (o *OLogger) takeHeldLocked(key string) *heldEntry {
+	h, ok := o.multiline.held[key]
+	if !ok {
+		return nil
+	}
+	h.timer.Stop()
+	delete(o.multiline.held, key)
+	return h
+}
+
+// log the given held entries
+func (o *OLogger) logHeld(entries ...*heldEntry) {
+	for _, h := range entries {
+		if h != nil {
+			o.logEntry(h.entry, h.attrs...)
+		}
+	}
+}
+
+// log all the held entries
+func (o *OLogger) flushMultiline() {
+	if o.multiline == nil {
+		return
+	}
+	o.multiline.mu.Lock()
+	entries := []*heldEntry{}
+	for key := range o.multiline.held {
+		entries = append(entries, o.takeHeldLocked(key))
+	}
+	o.multiline.mu.Unlock()
+	o.logHeld(entries...)
+}
+
+// (re)start the timer logging a held entry; the multiline lock must be held
+func (o *OLogger) holdLocked(key string, h *heldEntry) {
+	m := o.multiline
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(m.timeout, func() {
+		m.mu.Lock()
+		var expired *heldEntry
+		// ignore the timers of entries already logged
+		if m.held[key] == h {
+			expired = o.takeHeldLocked(key)
+		}
+		m.mu.Unlock()
+		o.logHeld(expired)
+	})
+}
+
+// hold an entry whose message matches the start pattern, appending to its message
+// the following ones of the same process that don't match it, until another entry
+// of that process matches it or the multiline timeout expires
+func (o *OLogger) logMultiline(i interface{}, attrs ...otellog.KeyValue) {
+	m := o.multiline
+	obj, ok := i.(map[string]interface{})
+	msg, isString := obj["MESSAGE"].(string)
+	if !ok || !isString {
+		o.logEntry(i, attrs...)
+		return
+	}
+	m.mu.Lock()
+	key := processKey(obj)
+	h, held := m.held[key]
+	if held && !m.start.MatchString(msg) {
+		h.entry["MESSAGE"] = h.entry["MESSAGE"].(string) + "\n" + msg
+		h.lines++
+		var full *heldEntry
+		if h.lines >= MULTILINE_MAX_LINES {
+			full = o.takeHeldLocked(key)
+		} else {
+			o.holdLocked(key, h)
+		}
+		m.mu.Unlock()
+		o.logHeld(full)
+		return
+	}
+	previous := o.takeHeldLocked(key)
+	if !m.start.MatchString(msg) {
+		m.mu.Unlock()
+		// a continuation line without its first line
+		o.logEntry(i, attrs...)
+		return
+	}
+	// the entry is modified while held
+	h = &heldEntry{entry: make(map[string]interface{}, len(obj)), attrs: attrs, lines: 1}
+	for k, v := range obj {
+		h.entry[k] = v
+	}
+	m.held[key] = h
+	o.holdLocked(key, h)
+	m.mu.Unlock()
+	o.logHeld(previous)
+}
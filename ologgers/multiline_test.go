@@ -0,0 +1,155 @@
+package ologgers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// return a journald entry of a process
+func processEntry(pid string, msg interface{}) map[string]interface{} {
+	return map[string]interface{}{"MESSAGE": msg, "PRIORITY": "6", "_PID": pid, "_COMM": "java"}
+}
+
+// return the messages of the records written by the file exporter
+func recordMessages(records []map[string]interface{}) []string {
+	messages := []string{}
+	for _, record := range records {
+		if body, ok := record["body"].(map[string]interface{}); ok {
+			messages = append(messages, fmt.Sprint(body["MESSAGE"]))
+		} else {
+			messages = append(messages, fmt.Sprint(record["body"]))
+		}
+	}
+	return messages
+}
+
+func TestMultiline(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []interface{}
+		want    []string
+		// more entries are held at the flush, and logged in no particular order
+		anyOrder bool
+	}{
+		{"continuation lines", []interface{}{
+			processEntry("1", "Exception in thread main"),
+			processEntry("1", "  at a()"),
+			processEntry("1", "  at b()"),
+			processEntry("1", "Next"),
+		}, []string{"Exception in thread main\n  at a()\n  at b()", "Next"}, false},
+		{"interleaved processes", []interface{}{
+			processEntry("1", "Error one"),
+			processEntry("2", "Error two"),
+			processEntry("1", "  at one()"),
+			processEntry("2", "  at two()"),
+		}, []string{"Error one\n  at one()", "Error two\n  at two()"}, true},
+		{"continuation without its first line", []interface{}{
+			processEntry("1", "  at orphan()"),
+		}, []string{"  at orphan()"}, false},
+		{"message not a string", []interface{}{
+			processEntry("1", "Started"),
+			processEntry("1", []interface{}{float64(0x20), float64(0x61)}),
+			processEntry("1", "  at a()"),
+		}, []string{"[32 97]", "Started\n  at a()"}, false},
+		{"not a journald entry", []interface{}{
+			processEntry("1", "Started"),
+			"  plain line",
+		}, []string{"  plain line", "Started"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.MultilineStart = `^\S`
+			cfg.MultilineTimeout = 60000
+			o := newTestLogger(t, cfg)
+			for _, entry := range tt.entries {
+				o.Log(entry)
+			}
+			if err := o.ForceFlush(); err != nil {
+				t.Fatal(err)
+			}
+			got := recordMessages(readRecords(t, path))
+			if tt.anyOrder {
+				slices.Sort(got)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("messages %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultilineTimeout(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.MultilineStart = `^\S`
+	cfg.MultilineTimeout = 50
+	o := newTestLogger(t, cfg)
+	o.Log(processEntry("1", "Exception"))
+	o.Log(processEntry("1", "  at a()"))
+	if records := readRecords(t, path); len(records) != 0 {
+		t.Fatalf("records logged before the timeout: %v", records)
+	}
+	waitFor(t, "the held entry to be logged", func() bool { return len(readRecords(t, path)) == 1 })
+	if got := recordMessages(readRecords(t, path)); got[0] != "Exception\n  at a()" {
+		t.Errorf("unexpected message %q", got[0])
+	}
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.MultilineStart = `^\S`
+	cfg.MultilineTimeout = 60000
+	o := newTestLogger(t, cfg)
+	o.Log(processEntry("1", "Exception"))
+	for range MULTILINE_MAX_LINES {
+		o.Log(processEntry("1", "  at a()"))
+	}
+	// the entry is logged as soon as it's full, and the following line on its own
+	got := recordMessages(readRecords(t, path))
+	if len(got) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(got))
+	}
+	if lines := strings.Count(got[0], "\n") + 1; lines != MULTILINE_MAX_LINES {
+		t.Errorf("%d lines joined, want %d", lines, MULTILINE_MAX_LINES)
+	}
+	if got[1] != "  at a()" {
+		t.Errorf("unexpected message after the full entry: %q", got[1])
+	}
+}
+
+// an export waiting for room doesn't block the entries of the other processes
+func TestMultilineLogsOutsideTheLock(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.MultilineStart = `^\S`
+	cfg.MultilineTimeout = 60000
+	exporter := &memoryExporter{gate: make(chan struct{})}
+	o := newMemoryLogger(t, cfg, exporter)
+	o.Log(processEntry("1", "Exception"))
+	// the entry held for the process is exported, and the export blocks
+	blocked := make(chan struct{})
+	go func() {
+		o.Log(processEntry("1", "Next"))
+		close(blocked)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	held := make(chan struct{})
+	go func() {
+		o.Log(processEntry("2", "Error"))
+		close(held)
+	}()
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Error("an entry of another process waited for the blocked export")
+	}
+	close(exporter.gate)
+	<-blocked
+	o.Shutdown(context.Background())
+	if n := len(exporter.exported()); n != 3 {
+		t.Errorf("%d records exported, want 3", n)
+	}
+}
@@ -7,22 +7,30 @@ Interface to the OpenTelemetry modules.
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"log/slog"
-	"os"
+	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alberanid/pve2otelcol/config"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
 	otellog "go.opentelemetry.io/otel/log"
 	sdklog "go.opentelemetry.io/otel/sdk/log"
 	"go.opentelemetry.io/otel/sdk/resource"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // map syslog severity levels (priority, in systemd) to OTLP severity.
@@ -51,6 +59,28 @@ var prio2string = map[string]string{
 	"7": "DEBUG",
 }
 
+// severity of the entries with a malformed or out of range PRIORITY
+const FALLBACK_SEVERITY = otellog.SeverityInfo
+const FALLBACK_SEVERITY_TEXT = "INFO"
+
+var warnInvalidPriority sync.Once
+
+// return the OTLP severity and severity text of a journald PRIORITY; values
+// that are not a number between 0 and 7 get the fallback severity, with a
+// warning logged the first time
+func priority2severity(prio string) (otellog.Severity, string) {
+	prio = strings.TrimSpace(prio)
+	if n, err := strconv.Atoi(prio); err == nil && n >= 0 && n <= 7 {
+		prio = strconv.Itoa(n)
+		return prio2severity[prio], prio2string[prio]
+	}
+	warnInvalidPriority.Do(func() {
+		slog.Warn("invalid journald PRIORITY; using the fallback severity (further occurrences are not reported)",
+			"priority", prio, "severity", FALLBACK_SEVERITY_TEXT)
+	})
+	return FALLBACK_SEVERITY, FALLBACK_SEVERITY_TEXT
+}
+
 // Transform an interface to an object suitable to be logged by OpenTelemetry
 func transformBody(i interface{}) otellog.Value {
 	// the OpenTelemetry SDK replaces JSON null or unknown values to the "INVALID" string, which is an odd choice;
@@ -99,11 +129,12 @@ func transformBody(i interface{}) otellog.Value {
 	}
 }
 
-// convert a string timestamp in microseconds to a time.Time instance
+// convert a string timestamp in microseconds to a time.Time instance;
+// a zero time.Time and the parsing error are returned for invalid input
 func str2time(s string) (time.Time, error) {
 	i, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
-		return time.Now(), nil
+		return time.Time{}, err
 	}
 	secs := int64(i / 1000000)
 	micros := int64(i%1000000) * 1000
@@ -111,54 +142,128 @@ func str2time(s string) (time.Time, error) {
 	return tm, nil
 }
 
+// how often a full queue is checked, while waiting for room
+const QUEUE_POLL_INTERVAL = 10 * time.Millisecond
+
+// journald fields used to tell if two consecutive records are identical
+var dedupFields = []string{"MESSAGE", "PRIORITY", "_COMM", "_PID"}
+
+// return a copy of a log entry with only the listed fields and MESSAGE,
+// unless "-MESSAGE" is listed
+func keepFields(i interface{}, fields []string) interface{} {
+	obj, ok := i.(map[string]interface{})
+	if !ok {
+		return i
+	}
+	kept := map[string]interface{}{}
+	for _, field := range fields {
+		if value, found := obj[field]; found {
+			kept[field] = value
+		}
+	}
+	if value, found := obj["MESSAGE"]; found && !slices.Contains(fields, "-MESSAGE") {
+		kept["MESSAGE"] = value
+	}
+	return kept
+}
+
+// return a copy of a log entry without the fields whose name matches any of the patterns
+func dropFields(i interface{}, patterns []*regexp.Regexp) interface{} {
+	obj, ok := i.(map[string]interface{})
+	if !ok {
+		return i
+	}
+	kept := make(map[string]interface{}, len(obj))
+	for field, value := range obj {
+		if !slices.ContainsFunc(patterns, func(re *regexp.Regexp) bool { return re.MatchString(field) }) {
+			kept[field] = value
+		}
+	}
+	return kept
+}
+
+// return a key identifying a log entry, used to find duplicated records
+func dedupKey(i interface{}) string {
+	obj, ok := i.(map[string]interface{})
+	if !ok {
+		return fmt.Sprint(i)
+	}
+	parts := []string{}
+	for _, field := range dedupFields {
+		parts = append(parts, fmt.Sprint(obj[field]))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// state used to collapse identical consecutive records
+type dedupState struct {
+	mu       sync.Mutex
+	window   time.Duration
+	key      string
+	ctx      context.Context
+	record   *otellog.Record
+	repeated int
+	timer    *time.Timer
+	// incremented every time a new record is held, to ignore stale timers
+	gen int
+}
+
 // Object used to log to an OpenTelemetry instance
 type OLogger struct {
-	Logger otellog.Logger
-	Ctx    context.Context
+	Logger    otellog.Logger
+	Provider  *sdklog.LoggerProvider
+	Ctx       context.Context
+	cfg       *config.Config
+	dedup     *dedupState
+	reorder   *reorderState
+	multiline *multilineState
+	counter   *recordCounter
+	minSev    otellog.Severity
+	// service instance ID, to identify the logger in debug logs
+	serviceId string
+	// set when shutting down
+	stopped atomic.Bool
 }
 
 // Options of an OLogger instance
 type OLoggerOptions struct {
 	ServiceId   string
 	ServiceName string
+	// ID and type of the VM, sent as resource attributes
+	VMId   int
+	VMType string
+	// name of the PVE node, sent as a resource attribute
+	Node string
+	// resource pool of the VM, sent as a resource attribute if not empty
+	Pool string
+	// exporters shared with the other loggers of the same instance, used with
+	// OtlpSharedExporter; without them, the logger creates its own (optional)
+	SharedExporters *SharedExporters
+	// attributes read from the attributes file, added to the resource; they
+	// can't override the other resource attributes
+	FileAttrs map[string]string
+	// records below this severity are discarded; records without a severity are always sent
+	MinSeverity string
+	// exporter receiving the records instead of the configured one, e.g. to
+	// embed the monitoring in a program handling the records itself (optional)
+	Exporter sdklog.Exporter
 }
 
-// Create an OLogger instance
-func New(cfg *config.Config, opts OLoggerOptions) (*OLogger, error) {
-	ctx := context.Background()
-	var exporter sdklog.Exporter
-	var err error
-
-	withTLS := cfg.OtlpTLSCertFile != "" && cfg.OtlpTLSKeyFile != ""
-	tlsConfig := tls.Config{}
-	if withTLS {
-		certificate, err := tls.LoadX509KeyPair(cfg.OtlpTLSCertFile, cfg.OtlpTLSKeyFile)
-		if err != nil {
-			slog.Error(fmt.Sprintf("failed to load TLS certificate and key: %v", err))
-			return nil, err
-		}
-
-		certPool := x509.NewCertPool()
-		ca, err := os.ReadFile(cfg.OtlpTLSCertFile)
-		if err != nil {
-			slog.Error(fmt.Sprintf("failed to read CA certificate: %v", err))
-			return nil, err
-		}
-
-		if ok := certPool.AppendCertsFromPEM(ca); !ok {
-			slog.Error("failed to append CA certificate to cert pool")
-			return nil, fmt.Errorf("failed to append CA certificate to cert pool")
-		}
-
-		tlsConfig = tls.Config{
-			Certificates: []tls.Certificate{certificate},
-			RootCAs:      certPool,
-		}
+// Set the level of the gRPC gzip compressor, unless it's 0; the level is global
+// to the process and, as gRPC requires, it must be set once at startup, before
+// any logger is created
+func SetGzipLevel(level int) error {
+	if level == 0 {
+		return nil
 	}
+	return gzip.SetLevel(level)
+}
 
+// create an exporter sending records to the given OTLP endpoint
+func newExporter(ctx context.Context, cfg *config.Config, endpointURL string, tlsConfig *tls.Config) (sdklog.Exporter, error) {
 	if cfg.OtlpExporter == "grpc" {
 		rpcOptions := []otlploggrpc.Option{
-			otlploggrpc.WithEndpointURL(cfg.OtlpgRPCURL),
+			otlploggrpc.WithEndpointURL(endpointURL),
 			otlploggrpc.WithCompressor(cfg.OtlpCompression),
 			otlploggrpc.WithReconnectionPeriod(time.Duration(cfg.OtlpgRPCReconnectionPeriod) * time.Second),
 			otlploggrpc.WithRetry(otlploggrpc.RetryConfig{
@@ -170,20 +275,20 @@ func New(cfg *config.Config, opts OLoggerOptions) (*OLogger, error) {
 			),
 			otlploggrpc.WithTimeout(time.Duration(cfg.OtlpTimeout) * time.Millisecond),
 		}
+		if cfg.OtlpUserAgent != "" {
+			// gRPC appends its own identifier to the user agent
+			rpcOptions = append(rpcOptions, otlploggrpc.WithDialOption(grpc.WithUserAgent(cfg.OtlpUserAgent)))
+		}
 
-		if withTLS {
-			creds := credentials.NewTLS(&tlsConfig)
+		if tlsConfig != nil {
+			creds := credentials.NewTLS(tlsConfig)
 			rpcOptions = append(rpcOptions, otlploggrpc.WithTLSCredentials(creds))
 		}
 
-		exporter, err = otlploggrpc.New(ctx, rpcOptions...)
-		if err != nil {
-			slog.Error(fmt.Sprintf("failure creating gRPC logger with options %v; error: %v", opts, err))
-			return nil, err
-		}
+		return otlploggrpc.New(ctx, rpcOptions...)
 	} else if cfg.OtlpExporter == "http" {
 		httpOptions := []otlploghttp.Option{
-			otlploghttp.WithEndpointURL(cfg.OtlpHTTPURL),
+			otlploghttp.WithEndpointURL(endpointURL),
 			otlploghttp.WithRetry(otlploghttp.RetryConfig{
 				Enabled:         true,
 				InitialInterval: time.Duration(cfg.OtlpInitialInterval) * time.Second,
@@ -192,32 +297,177 @@ func New(cfg *config.Config, opts OLoggerOptions) (*OLogger, error) {
 			}),
 			otlploghttp.WithTimeout(time.Duration(cfg.OtlpTimeout) * time.Millisecond),
 		}
+		// the path of the URL is used, unless otlp-http-path is set; these options
+		// must follow WithEndpointURL, so that they take precedence over it
+		if cfg.OtlpHTTPPath != "" {
+			httpOptions = append(httpOptions, otlploghttp.WithURLPath(cfg.OtlpHTTPPath))
+		} else if u, err := url.Parse(endpointURL); err == nil && u.Path == "" {
+			httpOptions = append(httpOptions, otlploghttp.WithURLPath(config.DEFAULT_OTLP_HTTP_PATH))
+		}
+		if cfg.OtlpUserAgent != "" {
+			// custom headers take precedence over the default User-Agent
+			httpOptions = append(httpOptions, otlploghttp.WithHeaders(map[string]string{"User-Agent": cfg.OtlpUserAgent}))
+		}
 		if cfg.OtlpCompression == "gzip" {
 			httpOptions = append(httpOptions, otlploghttp.WithCompression(otlploghttp.GzipCompression))
 		}
 
-		if withTLS {
-			httpOptions = append(httpOptions, otlploghttp.WithTLSClientConfig(&tlsConfig))
+		if tlsConfig != nil {
+			httpOptions = append(httpOptions, otlploghttp.WithTLSClientConfig(tlsConfig))
 		}
 
-		exporter, err = otlploghttp.New(ctx, httpOptions...)
+		return otlploghttp.New(ctx, httpOptions...)
+	}
+	return nil, fmt.Errorf("no valid OTLP endpoint provided")
+}
+
+// create an exporter sending records to the given OTLP endpoints; if more
+// than one is provided, the others are used as fallbacks of the first one
+func newEndpointsExporter(ctx context.Context, cfg *config.Config, urls []string, reloader *certReloader,
+	opts OLoggerOptions) (sdklog.Exporter, error) {
+	exporters := []sdklog.Exporter{}
+	for _, endpointURL := range urls {
+		var tlsConfig *tls.Config
+		u, _ := url.Parse(endpointURL)
+		serverName := u.Hostname()
+		if cfg.OtlpTLSServerName != "" {
+			// e.g. connecting to an IP address of a gateway routing by SNI
+			serverName = cfg.OtlpTLSServerName
+		}
+		if reloader != nil {
+			tlsConfig = reloader.tlsConfig(serverName)
+		} else if cfg.OtlpTLSServerName != "" && u.Scheme == "https" {
+			tlsConfig = &tls.Config{ServerName: serverName}
+		}
+		e, err := newExporter(ctx, cfg, endpointURL, tlsConfig)
 		if err != nil {
-			slog.Error(fmt.Sprintf("failure creating HTTP logger with options %v; error: %v", opts, err))
+			slog.Error("failure creating logger", "exporter", cfg.OtlpExporter, "url", endpointURL,
+				"service_id", opts.ServiceId, "service_name", opts.ServiceName, "err", err)
+			return nil, err
+		}
+		exporters = append(exporters, e)
+	}
+	if len(exporters) == 1 {
+		return exporters[0], nil
+	}
+	return newFailoverExporter(exporters, urls), nil
+}
+
+// create the processor handing the records to an exporter: batching them
+// or, with the "simple" processor, exporting each one synchronously
+func newProcessor(cfg *config.Config, exporter sdklog.Exporter) sdklog.Processor {
+	if cfg.OtlpProcessor == "simple" {
+		return sdklog.NewSimpleProcessor(exporter)
+	}
+	return sdklog.NewBatchProcessor(exporter,
+		sdklog.WithMaxQueueSize(cfg.OtlpBatchMaxQueueSize),
+		sdklog.WithExportBufferSize(cfg.OtlpBatchBufferSize),
+		sdklog.WithExportInterval(time.Duration(cfg.BatchExportInterval())*time.Second),
+		sdklog.WithExportMaxBatchSize(cfg.BatchMaxBatchSize()))
+}
+
+// return the kind of source of the logs, independent of the naming of the services
+func sourceKind(vmType string) string {
+	switch vmType {
+	case "qm":
+		return "qemu"
+	case "pve":
+		return "pve-host"
+	}
+	return vmType
+}
+
+// Create an OLogger instance, retrying up to OtlpCreateRetries times with
+// an exponential backoff; it stops trying when the context is cancelled
+func NewWithRetry(ctx context.Context, cfg *config.Config, opts OLoggerOptions) (*OLogger, error) {
+	delay := time.Duration(cfg.OtlpCreateRetryDelay) * time.Second
+	for attempt := 0; ; attempt++ {
+		logger, err := New(ctx, cfg, opts)
+		if err == nil || attempt >= cfg.OtlpCreateRetries {
+			return logger, err
+		}
+		slog.Warn("failure creating a logger; retrying", "service", opts.ServiceId, "delay", delay, "err", err)
+		select {
+		case <-ctx.Done():
 			return nil, err
+		case <-time.After(delay):
 		}
-	} else {
-		return nil, fmt.Errorf("no valid OTLP endpoint provided")
+		delay *= 2
 	}
+}
 
+// Create an OLogger instance
+func New(ctx context.Context, cfg *config.Config, opts OLoggerOptions) (*OLogger, error) {
+
+	var reloader *certReloader
+	if (cfg.OtlpTLSCertFile != "" && cfg.OtlpTLSKeyFile != "") || (cfg.OtlpTLSCertPEM != "" && cfg.OtlpTLSKeyPEM != "") ||
+		cfg.OtlpTLSCAPEM != "" {
+		// the certificate is also used as CA, unless one is provided
+		caFile, caPEM := cfg.OtlpTLSCertFile, cfg.OtlpTLSCAPEM
+		if caPEM == "" && cfg.OtlpTLSKeyPEM != "" {
+			caPEM = cfg.OtlpTLSCertPEM
+		}
+		var err error
+		reloader, err = newCertReloader(cfg.OtlpTLSCertFile, cfg.OtlpTLSKeyFile, caFile,
+			cfg.OtlpTLSCertPEM, cfg.OtlpTLSKeyPEM, caPEM)
+		if err != nil {
+			slog.Error("failure loading TLS certificates", "err", err)
+			return nil, err
+		}
+	}
+
+	// with a shared exporter, the exporters are created by the first logger
+	getExporter := func(name string, create func() (sdklog.Exporter, error)) (sdklog.Exporter, error) {
+		if cfg.OtlpSharedExporter && opts.SharedExporters != nil {
+			return opts.SharedExporters.acquire(name, create)
+		}
+		return create()
+	}
+	exporter := opts.Exporter
+	var err error
+	if exporter == nil {
+		exporter, err = getExporter("main", func() (sdklog.Exporter, error) {
+			if cfg.OtlpExporter == "file" {
+				exporter, err := newFileExporter(cfg.FilePath)
+				if err != nil {
+					slog.Error("failure opening the file of the file exporter", "path", cfg.FilePath, "err", err)
+				}
+				return exporter, err
+			}
+			return newEndpointsExporter(ctx, cfg, cfg.OtlpURLs(), reloader, opts)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var errorsExporter sdklog.Exporter
+	if errorsURLs := cfg.OtlpErrorsURLs(); len(errorsURLs) > 0 {
+		errorsExporter, err = getExporter("errors", func() (sdklog.Exporter, error) {
+			return newEndpointsExporter(ctx, cfg, errorsURLs, reloader, opts)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the attributes of the file come first, so that they can't override the others
 	providerResources, err := resource.Merge(
 		resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, fileAttrs(opts.FileAttrs)...),
+	)
+	if err != nil {
+		slog.Error("failure setting the attributes of the attributes file", "err", err)
+		return nil, err
+	}
+	providerResources, err = resource.Merge(
+		providerResources,
 		resource.NewWithAttributes(
 			semconv.SchemaURL,
 			semconv.ServiceInstanceID(opts.ServiceId),
 		),
 	)
 	if err != nil {
-		slog.Error(fmt.Sprintf("failure setting service instance id of logger; error: %v", err))
+		slog.Error("failure setting service instance id of logger", "err", err)
 		return nil, err
 	}
 	providerResources, err = resource.Merge(
@@ -228,68 +478,382 @@ func New(cfg *config.Config, opts OLoggerOptions) (*OLogger, error) {
 		),
 	)
 	if err != nil {
-		slog.Error(fmt.Sprintf("failure setting service name of logger; error: %v", err))
+		slog.Error("failure setting service name of logger", "err", err)
+		return nil, err
+	}
+	proxmoxAttrs := []attribute.KeyValue{
+		attribute.Int("proxmox.vmid", opts.VMId),
+		attribute.String("proxmox.vm.type", opts.VMType),
+		attribute.String("source.kind", sourceKind(opts.VMType)),
+	}
+	if opts.Node != "" {
+		proxmoxAttrs = append(proxmoxAttrs, attribute.String("proxmox.node", opts.Node))
+	}
+	if cfg.ClusterName != "" {
+		proxmoxAttrs = append(proxmoxAttrs, attribute.String("proxmox.cluster", cfg.ClusterName))
+	}
+	if opts.Pool != "" {
+		proxmoxAttrs = append(proxmoxAttrs, attribute.String("proxmox.pool", opts.Pool))
+	}
+	providerResources, err = resource.Merge(
+		providerResources,
+		resource.NewWithAttributes(semconv.SchemaURL, proxmoxAttrs...),
+	)
+	if err != nil {
+		slog.Error("failure setting Proxmox attributes of logger", "err", err)
 		return nil, err
 	}
 
-	processor := sdklog.NewBatchProcessor(exporter,
-		sdklog.WithExportBufferSize(cfg.OtlpBatchBufferSize),
-		sdklog.WithExportInterval(time.Duration(cfg.OtlpBatchExportInterval)*time.Second),
-		sdklog.WithExportMaxBatchSize(cfg.OtlpBatchMaxBatchSize))
-	provider := sdklog.NewLoggerProvider(
-		sdklog.WithProcessor(processor),
+	counter := &recordCounter{}
+	exporter = countingExporter{Exporter: exporter, counter: counter, serviceId: opts.ServiceId}
+	queueLimit := 0
+	if cfg.OtlpProcessor != "simple" {
+		queueLimit = cfg.OtlpBatchMaxQueueSize
+	}
+	providerOptions := []sdklog.LoggerProviderOption{
+		sdklog.WithProcessor(countingProcessor{Processor: newProcessor(cfg, exporter), counter: counter,
+			limit: queueLimit}),
 		sdklog.WithResource(providerResources),
-	)
-	logger := provider.Logger(cfg.OtlpLoggerName)
+	}
+	if errorsExporter != nil {
+		// records at or above the threshold are also sent to the errors endpoint
+		providerOptions = append(providerOptions, sdklog.WithProcessor(severityProcessor{
+			Processor: newProcessor(cfg, errorsExporter),
+			min:       parseSeverity(cfg.OtlpErrorsSeverity),
+		}))
+	}
+	provider := sdklog.NewLoggerProvider(providerOptions...)
+	logger := provider.Logger(cfg.OtlpLoggerName, otellog.WithInstrumentationVersion(cfg.OtlpScopeVersion))
+
+	// records logged while shutting down must still be exported
+	ologger := OLogger{
+		Logger:    logger,
+		Provider:  provider,
+		Ctx:       context.WithoutCancel(ctx),
+		cfg:       cfg,
+		counter:   counter,
+		minSev:    parseSeverity(opts.MinSeverity),
+		serviceId: opts.ServiceId,
+	}
+	if cfg.DedupWindow > 0 {
+		ologger.dedup = &dedupState{
+			window: time.Duration(cfg.DedupWindow) * time.Millisecond,
+		}
+	}
+	if cfg.ReorderWindow > 0 {
+		ologger.reorder = &reorderState{
+			window: time.Duration(cfg.ReorderWindow) * time.Millisecond,
+		}
+	}
+	liveLoggers.mu.Lock()
+	liveLoggers.set[&ologger] = struct{}{}
+	liveLoggers.mu.Unlock()
+	if cfg.MultilineStart != "" {
+		// the pattern is validated at startup
+		ologger.multiline = &multilineState{
+			start:   regexp.MustCompile(cfg.MultilineStart),
+			timeout: time.Duration(cfg.MultilineTimeout) * time.Millisecond,
+			held:    map[string]*heldEntry{},
+		}
+	}
+	return &ologger, nil
+}
+
+// Force the export of all the pending records
+func (o *OLogger) ForceFlush() error {
+	o.flushMultiline()
+	o.flushDedup()
+	o.flushReorder()
+	return o.Provider.ForceFlush(o.Ctx)
+}
+
+// Return the number of records not yet handed to the exporter, including the
+// ones being exported synchronously by the simple processor
+func (o *OLogger) QueueDepth() int {
+	return int(o.counter.pending.Load())
+}
+
+// Return the number of records emitted to the provider and, of them, the ones
+// its exporter sent successfully; call ForceFlush first to account for all of them
+func (o *OLogger) DeliveryStats() (emitted int64, delivered int64) {
+	return o.counter.emitted.Load(), o.counter.exported.Load() - o.counter.failed.Load()
+}
+
+// Block until the batch processor can queue another record without dropping
+// it, or the context is done; the queue is full when QueueDepth reaches
+// OtlpBatchMaxQueueSize
+func (o *OLogger) WaitQueue(ctx context.Context) {
+	if o.cfg.OtlpProcessor == "simple" {
+		// records are exported synchronously
+		return
+	}
+	for o.QueueDepth() >= o.cfg.OtlpBatchMaxQueueSize {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(QUEUE_POLL_INTERVAL):
+		}
+	}
+}
+
+// Log a record marking the end of the monitoring, after the held entries
+func (o *OLogger) LogStopped(reason string) {
+	o.flushMultiline()
+	o.logEntry("monitoring stopped: "+reason,
+		otellog.KeyValue{Key: "monitoring.stopped", Value: otellog.BoolValue(true)},
+		otellog.KeyValue{Key: "monitoring.stop_reason", Value: otellog.StringValue(reason)})
+}
+
+// Export all the pending records and shut down the logger
+func (o *OLogger) Shutdown(ctx context.Context) error {
+	o.stopped.Store(true)
+	o.flushMultiline()
+	o.flushDedup()
+	o.flushReorder()
+	err := o.Provider.Shutdown(ctx)
+	liveLoggers.mu.Lock()
+	delete(liveLoggers.set, o)
+	liveLoggers.mu.Unlock()
+	return err
+}
+
+// emit the held record, if any; the dedup lock must be held
+func (o *OLogger) flushDedupLocked() {
+	d := o.dedup
+	if d.record == nil {
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.repeated > 1 {
+		d.record.AddAttributes(otellog.KeyValue{
+			Key:   "repeated",
+			Value: otellog.IntValue(d.repeated),
+		})
+	}
+	o.emit(d.ctx, *d.record)
+	d.ctx = nil
+	d.record = nil
+	d.key = ""
+	d.repeated = 0
+}
 
-	return &OLogger{
-		Logger: logger,
-		Ctx:    ctx,
-	}, nil
+// emit the held record, if any
+func (o *OLogger) flushDedup() {
+	if o.dedup == nil {
+		return
+	}
+	o.dedup.mu.Lock()
+	defer o.dedup.mu.Unlock()
+	o.flushDedupLocked()
+}
+
+// hold a record until a different one is received or the dedup window expires,
+// counting how many identical records were seen in the meantime
+func (o *OLogger) logDedup(ctx context.Context, r otellog.Record, key string) {
+	d := o.dedup
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.record != nil && d.key == key {
+		d.repeated++
+		return
+	}
+	o.flushDedupLocked()
+	d.gen++
+	gen := d.gen
+	d.ctx = ctx
+	d.record = &r
+	d.key = key
+	d.repeated = 1
+	d.timer = time.AfterFunc(d.window, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.gen == gen {
+			o.flushDedupLocked()
+		}
+	})
 }
 
 // Emit a Record
 func (o *OLogger) LogRecord(r otellog.Record) {
-	o.Logger.Emit(o.Ctx, r)
+	o.emit(o.Ctx, r)
 }
 
-// Log any object
-func (o *OLogger) Log(i interface{}) {
+// Emit a Record in the given context, that may carry a span context
+func (o *OLogger) emit(ctx context.Context, r otellog.Record) {
+	if o.reorder != nil {
+		o.logReorder(ctx, r)
+		return
+	}
+	o.Logger.Emit(ctx, r)
+}
+
+// log, at debug level, how a log entry was mapped to a record
+func (o *OLogger) traceRecord(i interface{}, record otellog.Record, action string) {
+	attrs := map[string]string{}
+	record.WalkAttributes(func(kv otellog.KeyValue) bool {
+		attrs[kv.Key] = kv.Value.String()
+		return true
+	})
+	slog.Debug("log entry mapped to a record",
+		"service", o.serviceId,
+		"input", i,
+		"severity", record.Severity().String(),
+		"severity_text", record.SeverityText(),
+		"timestamp", record.Timestamp(),
+		"observed_timestamp", record.ObservedTimestamp(),
+		"attributes", attrs,
+		"rule_action", action)
+}
+
+// return the action of the first rule matching a log entry, or an empty string
+func (o *OLogger) matchRule(i interface{}) string {
+	obj, ok := i.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, rule := range o.cfg.LogRules {
+		if value, found := obj[rule.Field]; found && fmt.Sprint(value) == rule.Value {
+			return rule.Action
+		}
+	}
+	return ""
+}
+
+// Log any object, with optional additional attributes
+func (o *OLogger) Log(i interface{}, attrs ...otellog.KeyValue) {
+	if o.multiline != nil {
+		o.logMultiline(i, attrs...)
+		return
+	}
+	o.logEntry(i, attrs...)
+}
+
+// log a single log entry, with optional additional attributes
+func (o *OLogger) logEntry(i interface{}, attrs ...otellog.KeyValue) {
+	if len(o.cfg.KeepFields) > 0 {
+		i = keepFields(i, o.cfg.KeepFields)
+	}
+	if patterns := o.cfg.DropFieldRegexps(); len(patterns) > 0 {
+		i = dropFields(i, patterns)
+	}
+	truncated := false
+	if o.cfg.MaxRecordBytes > 0 {
+		// a single budget for the body and the attributes
+		budget := &byteBudget{left: o.cfg.MaxRecordBytes}
+		i = budget.truncateBody(i)
+		attrs = budget.truncateAttrs(attrs)
+		// the line may have been already cut while reading it
+		truncated = budget.truncated && !slices.ContainsFunc(attrs, func(kv otellog.KeyValue) bool {
+			return kv.Key == "truncated"
+		})
+	}
 	body := transformBody(i)
 	record := otellog.Record{}
-	record.SetBody(body)
-	for _, kv := range body.AsMap() {
+	record.SetBody(o.formatBody(i, body))
+	if o.cfg.ObservedIngestTime {
+		record.SetObservedTimestamp(time.Now())
+	}
+	o.addAttributes(&record, attrs...)
+	if truncated {
+		o.addAttributes(&record, otellog.KeyValue{
+			Key:   "truncated",
+			Value: otellog.BoolValue(true),
+		})
+	}
+	spanCfg := trace.SpanContextConfig{}
+	var fields []otellog.KeyValue
+	if body.Kind() == otellog.KindMap {
+		// lines that are not JSON, common for log sources other than the journal
+		fields = body.AsMap()
+	}
+	for _, kv := range fields {
 		if kv.Key == "_SOURCE_REALTIME_TIMESTAMP" {
-			tm, err := str2time(kv.Value.AsString())
-			if err != nil {
-				record.SetTimestamp(tm)
+			// time reported by the client, not always present nor trustworthy
+			if o.cfg.TimestampSource == "source" {
+				if tm, err := str2time(kv.Value.AsString()); err == nil {
+					record.SetTimestamp(tm)
+				}
 			}
 		} else if kv.Key == "__REALTIME_TIMESTAMP" {
-			tm, err := str2time(kv.Value.AsString())
-			if err != nil {
-				record.SetObservedTimestamp(tm)
+			// time the entry was received by journald
+			if tm, err := str2time(kv.Value.AsString()); err == nil {
+				if o.cfg.TimestampSource == "journal" {
+					record.SetTimestamp(tm)
+				}
+				if !o.cfg.ObservedIngestTime {
+					record.SetObservedTimestamp(tm)
+				}
+				if o.cfg.AddIngestLatency {
+					// invalid or missing timestamps don't produce the attribute
+					o.addAttributes(&record, otellog.KeyValue{
+						Key:   "ingest.latency.ms",
+						Value: otellog.Int64Value(time.Since(tm).Milliseconds()),
+					})
+				}
 			}
 		} else if kv.Key == "PRIORITY" {
-			if severity, ok := prio2severity[kv.Value.AsString()]; ok {
-				record.SetSeverity(severity)
-			}
-			if severityTxt, ok := prio2string[kv.Value.AsString()]; ok {
-				record.SetSeverityText(severityTxt)
-			}
+			severity, severityTxt := priority2severity(kv.Value.AsString())
+			record.SetSeverity(severity)
+			record.SetSeverityText(severityTxt)
 		} else if kv.Key == "_PID" {
 			i, err := strconv.Atoi(kv.Value.AsString())
 			if err == nil {
-				record.AddAttributes(otellog.KeyValue{
+				o.addAttributes(&record, otellog.KeyValue{
 					Key:   "pid",
 					Value: otellog.IntValue(i),
 				})
 			}
+		} else if kv.Key == "_BOOT_ID" {
+			if o.cfg.BootIdAttr {
+				o.addAttributes(&record, otellog.KeyValue{
+					Key:   "boot.id",
+					Value: otellog.StringValue(kv.Value.AsString()),
+				})
+			}
 		} else if kv.Key == "_COMM" {
-			record.AddAttributes(otellog.KeyValue{
+			o.addAttributes(&record, otellog.KeyValue{
 				Key:   "command",
 				Value: otellog.StringValue(kv.Value.AsString()),
 			})
+		} else if slices.Contains(o.cfg.TraceIdFields, kv.Key) {
+			// malformed identifiers are ignored
+			if traceId, err := trace.TraceIDFromHex(strings.ToLower(kv.Value.AsString())); err == nil {
+				spanCfg.TraceID = traceId
+			}
+		} else if slices.Contains(o.cfg.SpanIdFields, kv.Key) {
+			if spanId, err := trace.SpanIDFromHex(strings.ToLower(kv.Value.AsString())); err == nil {
+				spanCfg.SpanID = spanId
+			}
 		}
 	}
-	o.LogRecord(record)
+	ctx := o.Ctx
+	action := o.matchRule(i)
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		o.traceRecord(i, record, action)
+	}
+	if action == config.RULE_DROP {
+		return
+	}
+	if severity := record.Severity(); action != config.RULE_KEEP &&
+		severity != otellog.SeverityUndefined && severity < o.minSev {
+		return
+	}
+	if action == config.RULE_ROUTE {
+		ctx = context.WithValue(ctx, routeKey{}, true)
+	}
+	if spanCfg.TraceID.IsValid() {
+		// the SDK reads the trace and span IDs of the record from the context
+		ctx = trace.ContextWithSpanContext(ctx, trace.NewSpanContext(spanCfg))
+	}
+	if !o.admitInflight() {
+		return
+	}
+	if o.dedup != nil {
+		o.logDedup(ctx, record, dedupKey(i))
+		return
+	}
+	o.emit(ctx, record)
 }
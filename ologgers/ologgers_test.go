@@ -0,0 +1,1012 @@
+package ologgers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alberanid/pve2otelcol/config"
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// return a configuration writing each record synchronously, as a JSON line,
+// to a file of a temporary directory, whose path is also returned
+func testConfig(t *testing.T) (*config.Config, string) {
+	t.Helper()
+	cfg := config.Default()
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	cfg.OtlpExporter = "file"
+	cfg.FilePath = path
+	cfg.OtlpProcessor = "simple"
+	return cfg, path
+}
+
+// return a logger using the given configuration, shut down at the end of the test
+func newTestLogger(t *testing.T, cfg *config.Config) *OLogger {
+	t.Helper()
+	o, err := New(context.Background(), cfg, OLoggerOptions{ServiceId: "lxc/100", ServiceName: "ct100",
+		VMId: 100, VMType: "lxc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Shutdown(context.Background()) })
+	return o
+}
+
+// exporter keeping the records in memory; while fail is set the records are
+// rejected, and while the gate is set the exports wait for it to be closed
+type memoryExporter struct {
+	mu      sync.Mutex
+	records []sdklog.Record
+	fail    bool
+	gate    chan struct{}
+}
+
+func (e *memoryExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	e.mu.Lock()
+	gate, fail := e.gate, e.fail
+	e.mu.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		return errors.New("collector unreachable")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range records {
+		e.records = append(e.records, r.Clone())
+	}
+	return nil
+}
+
+func (e *memoryExporter) Shutdown(ctx context.Context) error   { return nil }
+func (e *memoryExporter) ForceFlush(ctx context.Context) error { return nil }
+
+// return the records received by the exporter
+func (e *memoryExporter) exported() []sdklog.Record {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.records)
+}
+
+// return a logger sending the records to an exporter kept in memory, shut
+// down at the end of the test
+func newMemoryLogger(t *testing.T, cfg *config.Config, exporter *memoryExporter) *OLogger {
+	t.Helper()
+	o, err := New(context.Background(), cfg, OLoggerOptions{ServiceId: "lxc/100", ServiceName: "ct100",
+		VMId: 100, VMType: "lxc", Exporter: exporter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Shutdown(context.Background()) })
+	return o
+}
+
+// wait for a condition, failing the test if it's not met in a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// return the records written by the file exporter
+func readRecords(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// return the attributes of a record written by the file exporter
+func attributes(record map[string]interface{}) map[string]interface{} {
+	attrs, _ := record["attributes"].(map[string]interface{})
+	return attrs
+}
+
+// return a timestamp of a record written by the file exporter
+func recordTime(record map[string]interface{}, key string) time.Time {
+	s, _ := record[key].(string)
+	tm, _ := time.Parse(time.RFC3339Nano, s)
+	return tm
+}
+
+func TestDedupCollapsesIdenticalRecords(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.DedupWindow = 60000
+	o := newTestLogger(t, cfg)
+	entry := func(msg string) map[string]interface{} {
+		return map[string]interface{}{"MESSAGE": msg, "PRIORITY": "6", "_COMM": "cron", "_PID": "42"}
+	}
+	for range 3 {
+		o.Log(entry("same"))
+	}
+	o.Log(entry("other"))
+	records := readRecords(t, path)
+	if len(records) != 1 {
+		t.Fatalf("expected only the collapsed record before the flush, got %v", records)
+	}
+	if repeated := attributes(records[0])["repeated"]; repeated != float64(3) {
+		t.Errorf("expected repeated=3, got %v", repeated)
+	}
+	// the last record is held until the window expires or a flush
+	if err := o.ForceFlush(); err != nil {
+		t.Fatal(err)
+	}
+	records = readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records after the flush, got %v", records)
+	}
+	if _, found := attributes(records[1])["repeated"]; found {
+		t.Errorf("a record seen once must not have the repeated attribute: %v", records[1])
+	}
+}
+
+func TestTransformBody(t *testing.T) {
+	empty := otellog.StringValue("")
+	tests := []struct {
+		name string
+		in   interface{}
+		want otellog.Value
+	}{
+		{"string", "line", otellog.StringValue("line")},
+		{"bytes", []byte{0x01, 0x02}, otellog.BytesValue([]byte{0x01, 0x02})},
+		{"int", 42, otellog.IntValue(42)},
+		{"float32", float32(1.5), otellog.Float64Value(1.5)},
+		{"float64", 2.25, otellog.Float64Value(2.25)},
+		{"bool", true, otellog.BoolValue(true)},
+		{"nil", nil, empty},
+		{"struct", struct{ A int }{1}, empty},
+		{"slice with nulls", []interface{}{"a", nil, 3.0},
+			otellog.SliceValue(otellog.StringValue("a"), empty, otellog.Float64Value(3))},
+		{"nested maps", map[string]interface{}{
+			"MESSAGE": "hello",
+			"EMPTY":   nil,
+			"NESTED": map[string]interface{}{
+				"LIST":  []interface{}{map[string]interface{}{"DEEP": false}, nil},
+				"OTHER": struct{}{},
+			},
+		}, otellog.MapValue(
+			otellog.String("MESSAGE", "hello"),
+			otellog.KeyValue{Key: "EMPTY", Value: empty},
+			otellog.Map("NESTED",
+				otellog.Slice("LIST", otellog.MapValue(otellog.Bool("DEEP", false)), empty),
+				otellog.KeyValue{Key: "OTHER", Value: empty},
+			),
+		)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transformBody(tt.in); !got.Equal(tt.want) {
+				t.Errorf("transformBody(%#v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStr2time(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"0", time.Unix(0, 0)},
+		{"1700000000123456", time.Unix(1700000000, 123456000)},
+		{"999999", time.Unix(0, 999999000)},
+		{"-1500000", time.Unix(-1, -500000000)},
+	}
+	for _, tt := range tests {
+		got, err := str2time(tt.in)
+		if err != nil {
+			t.Errorf("str2time(%q): unexpected error %v", tt.in, err)
+		} else if !got.Equal(tt.want) {
+			t.Errorf("str2time(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{"", "abc", "1.5", "99999999999999999999"} {
+		if got, err := str2time(in); err == nil || !got.IsZero() {
+			t.Errorf("str2time(%q) = %v, %v; want a zero time and an error", in, got, err)
+		}
+	}
+}
+
+func TestInvalidTimestampIsNotSet(t *testing.T) {
+	cfg, path := testConfig(t)
+	o := newTestLogger(t, cfg)
+	o.Log(map[string]interface{}{"MESSAGE": "valid", "__REALTIME_TIMESTAMP": "1700000000123456"})
+	o.Log(map[string]interface{}{"MESSAGE": "invalid", "__REALTIME_TIMESTAMP": "yesterday"})
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	if ts := recordTime(records[0], "timestamp"); !ts.Equal(time.Unix(1700000000, 123456000)) {
+		t.Errorf("unexpected timestamp of a valid entry: %v", ts)
+	}
+	// the collector sets the time, instead of a made up one
+	if ts := recordTime(records[1], "timestamp"); !ts.IsZero() {
+		t.Errorf("expected no timestamp for an unparseable value, got %v", ts)
+	}
+}
+
+func TestTraceAndSpanIds(t *testing.T) {
+	const traceId = "4BF92F3577B34DA6A3CE929D0E0E4736"
+	const spanId = "00F067AA0BA902B7"
+	tests := []struct {
+		name      string
+		entry     map[string]interface{}
+		wantTrace string
+		wantSpan  string
+	}{
+		{"valid", map[string]interface{}{"TRACE_ID": traceId, "SPAN_ID": spanId},
+			strings.ToLower(traceId), strings.ToLower(spanId)},
+		{"alternative fields", map[string]interface{}{"OTEL_TRACE_ID": traceId, "OTEL_SPAN_ID": spanId},
+			strings.ToLower(traceId), strings.ToLower(spanId)},
+		{"trace only", map[string]interface{}{"TRACE_ID": traceId}, strings.ToLower(traceId), ""},
+		{"invalid trace", map[string]interface{}{"TRACE_ID": "not-a-trace", "SPAN_ID": spanId}, "", ""},
+		{"zero trace", map[string]interface{}{"TRACE_ID": strings.Repeat("0", 32)}, "", ""},
+		{"short span", map[string]interface{}{"TRACE_ID": traceId, "SPAN_ID": "00f067aa"},
+			strings.ToLower(traceId), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			o := newTestLogger(t, cfg)
+			tt.entry["MESSAGE"] = "traced"
+			o.Log(tt.entry)
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", records)
+			}
+			if got, _ := records[0]["trace_id"].(string); got != tt.wantTrace {
+				t.Errorf("trace ID = %q, want %q", got, tt.wantTrace)
+			}
+			if got, _ := records[0]["span_id"].(string); got != tt.wantSpan {
+				t.Errorf("span ID = %q, want %q", got, tt.wantSpan)
+			}
+		})
+	}
+}
+
+func TestTraceIdFieldsFlag(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.TraceIdFields = []string{"REQUEST_TRACE"}
+	cfg.SpanIdFields = []string{"REQUEST_SPAN"}
+	o := newTestLogger(t, cfg)
+	o.Log(map[string]interface{}{"TRACE_ID": "4bf92f3577b34da6a3ce929d0e0e4736"})
+	o.Log(map[string]interface{}{"REQUEST_TRACE": "4bf92f3577b34da6a3ce929d0e0e4736", "REQUEST_SPAN": "00f067aa0ba902b7"})
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	if _, found := records[0]["trace_id"]; found {
+		t.Errorf("fields not listed must be ignored: %v", records[0])
+	}
+	if records[1]["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || records[1]["span_id"] != "00f067aa0ba902b7" {
+		t.Errorf("the configured fields must be used: %v", records[1])
+	}
+}
+
+func TestSimpleProcessorIsSynchronous(t *testing.T) {
+	for _, processor := range []string{"simple", "batch"} {
+		t.Run(processor, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.OtlpProcessor = processor
+			cfg.OtlpBatchExportInterval = 3600
+			o := newTestLogger(t, cfg)
+			o.Log("line")
+			exported := len(readRecords(t, path)) == 1
+			if exported != (processor == "simple") {
+				t.Errorf("record exported before the flush: %t", exported)
+			}
+			if depth := o.QueueDepth(); (depth == 0) != (processor == "simple") {
+				t.Errorf("unexpected queue depth: %d", depth)
+			}
+		})
+	}
+}
+
+func TestMinSeverity(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.LogRules = []config.LogRule{{Field: "_COMM", Value: "sshd", Action: config.RULE_KEEP}}
+	o, err := New(context.Background(), cfg, OLoggerOptions{ServiceId: "lxc/100", VMId: 100, VMType: "lxc",
+		MinSeverity: "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Shutdown(context.Background())
+	o.Log(map[string]interface{}{"MESSAGE": "info", "PRIORITY": "6"})
+	o.Log(map[string]interface{}{"MESSAGE": "warning", "PRIORITY": "4"})
+	o.Log(map[string]interface{}{"MESSAGE": "no priority"})
+	o.Log(map[string]interface{}{"MESSAGE": "kept", "PRIORITY": "7", "_COMM": "sshd"})
+	messages := []string{}
+	for _, record := range readRecords(t, path) {
+		body, _ := record["body"].(map[string]interface{})
+		messages = append(messages, fmt.Sprint(body["MESSAGE"]))
+	}
+	if want := []string{"warning", "no priority", "kept"}; strings.Join(messages, ",") != strings.Join(want, ",") {
+		t.Errorf("records sent: %q, want %q", messages, want)
+	}
+}
+
+func TestWaitQueueAfterDrops(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.OtlpProcessor = "batch"
+	cfg.OtlpBatchMaxQueueSize = 4
+	cfg.OtlpBatchMaxBatchSize = 2
+	cfg.OtlpBatchExportInterval = 3600
+	exporter := &memoryExporter{gate: make(chan struct{})}
+	o := newMemoryLogger(t, cfg, exporter)
+	// the records over the size of the queue are dropped
+	for n := range 20 {
+		o.Log(fmt.Sprint(n))
+	}
+	if depth := o.QueueDepth(); depth != 4 {
+		t.Fatalf("queue depth %d, want 4", depth)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	o.WaitQueue(ctx)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("WaitQueue returned after %v with a full queue", elapsed)
+	}
+
+	// the dropped records don't keep the queue full once the others are exported
+	close(exporter.gate)
+	waited := make(chan struct{})
+	go func() {
+		o.WaitQueue(context.Background())
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitQueue still waiting once the queue was emptied")
+	}
+	o.ForceFlush()
+	if depth := o.QueueDepth(); depth != 0 {
+		t.Errorf("queue depth %d after the flush, want 0", depth)
+	}
+	if emitted, delivered := o.DeliveryStats(); emitted != 20 || delivered != 4 {
+		t.Errorf("emitted %d records and delivered %d, want 20 and 4", emitted, delivered)
+	}
+}
+
+func TestSetGzipLevel(t *testing.T) {
+	tests := []struct {
+		level int
+		valid bool
+	}{
+		{0, true},
+		{1, true},
+		{9, true},
+		{10, false},
+	}
+	for _, tt := range tests {
+		if err := SetGzipLevel(tt.level); (err == nil) != tt.valid {
+			t.Errorf("SetGzipLevel(%d) = %v, valid: %v", tt.level, err, tt.valid)
+		}
+	}
+	// the loggers don't set the level themselves
+	cfg, _ := testConfig(t)
+	cfg.OtlpExporter = "grpc"
+	cfg.OtlpGzipLevel = 9
+	newTestLogger(t, cfg)
+}
+
+// return the sorted field names of the body of a record written by the file exporter
+func bodyFields(record map[string]interface{}) []string {
+	body, _ := record["body"].(map[string]interface{})
+	fields := []string{}
+	for field := range body {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+func TestKeepFields(t *testing.T) {
+	entry := map[string]interface{}{"MESSAGE": "hello", "PRIORITY": "3", "_COMM": "cron",
+		"_PID": "42", "_SELINUX_CONTEXT": "unconfined"}
+	tests := []struct {
+		name     string
+		fields   []string
+		want     []string
+		severity string
+	}{
+		{"disabled", nil, []string{"MESSAGE", "PRIORITY", "_COMM", "_PID", "_SELINUX_CONTEXT"}, "ERROR"},
+		{"message always kept", []string{"_COMM"}, []string{"MESSAGE", "_COMM"}, ""},
+		{"priority kept", []string{"PRIORITY", "_PID"}, []string{"MESSAGE", "PRIORITY", "_PID"}, "ERROR"},
+		{"message excluded", []string{"-MESSAGE", "_COMM"}, []string{"_COMM"}, ""},
+		{"missing fields", []string{"UNIT", "_HOSTNAME"}, []string{"MESSAGE"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.KeepFields = tt.fields
+			o := newTestLogger(t, cfg)
+			o.Log(entry)
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", records)
+			}
+			if got := bodyFields(records[0]); !slices.Equal(got, tt.want) {
+				t.Errorf("fields %q, want %q", got, tt.want)
+			}
+			// the severity is read from the kept fields only
+			if got := records[0]["severity_text"]; got != tt.severity {
+				t.Errorf("severity %q, want %q", got, tt.severity)
+			}
+		})
+	}
+	if len(entry) != 5 {
+		t.Error("the original entry must not be changed")
+	}
+}
+
+func TestDropFieldPatterns(t *testing.T) {
+	entry := map[string]interface{}{"MESSAGE": "hello", "PRIORITY": "6", "_COMM": "cron",
+		"_SELINUX_CONTEXT": "unconfined", "_SYSTEMD_CGROUP": "/system.slice", "_SYSTEMD_UNIT": "cron.service"}
+	tests := []struct {
+		name     string
+		patterns []string
+		keep     []string
+		want     []string
+	}{
+		{"disabled", nil, nil,
+			[]string{"MESSAGE", "PRIORITY", "_COMM", "_SELINUX_CONTEXT", "_SYSTEMD_CGROUP", "_SYSTEMD_UNIT"}},
+		{"prefix", []string{"^_SYSTEMD_"}, nil, []string{"MESSAGE", "PRIORITY", "_COMM", "_SELINUX_CONTEXT"}},
+		{"unanchored", []string{"CONTEXT"}, nil,
+			[]string{"MESSAGE", "PRIORITY", "_COMM", "_SYSTEMD_CGROUP", "_SYSTEMD_UNIT"}},
+		{"several patterns", []string{"^_SELINUX", "CGROUP$"}, nil,
+			[]string{"MESSAGE", "PRIORITY", "_COMM", "_SYSTEMD_UNIT"}},
+		{"message can be dropped", []string{"^MESSAGE$"}, nil,
+			[]string{"PRIORITY", "_COMM", "_SELINUX_CONTEXT", "_SYSTEMD_CGROUP", "_SYSTEMD_UNIT"}},
+		{"after the kept fields", []string{"^_SYSTEMD_"}, []string{"_COMM", "_SYSTEMD_UNIT"},
+			[]string{"MESSAGE", "_COMM"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.DropFieldPatterns = tt.patterns
+			cfg.KeepFields = tt.keep
+			// the patterns are compiled by Validate
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			o := newTestLogger(t, cfg)
+			o.Log(entry)
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", records)
+			}
+			if got := bodyFields(records[0]); !slices.Equal(got, tt.want) {
+				t.Errorf("fields %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if len(entry) != 6 {
+		t.Error("the original entry must not be changed")
+	}
+}
+
+// send the log messages of the program to a buffer, until the end of the test
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return buf
+}
+
+// buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSeverity(t *testing.T) {
+	tests := []struct {
+		priority interface{}
+		want     otellog.Severity
+		text     string
+	}{
+		{"0", otellog.SeverityFatal, "FATAL"},
+		{"2", otellog.SeverityError, "ERROR"},
+		{"3", otellog.SeverityError, "ERROR"},
+		{"4", otellog.SeverityWarn, "WARN"},
+		{"5", otellog.SeverityInfo, "INFO"},
+		{"7", otellog.SeverityDebug, "DEBUG"},
+		{" 4 ", otellog.SeverityWarn, "WARN"},
+		{"04", otellog.SeverityWarn, "WARN"},
+		{"8", FALLBACK_SEVERITY, FALLBACK_SEVERITY_TEXT},
+		{"-1", FALLBACK_SEVERITY, FALLBACK_SEVERITY_TEXT},
+		{"warning", FALLBACK_SEVERITY, FALLBACK_SEVERITY_TEXT},
+		{"", FALLBACK_SEVERITY, FALLBACK_SEVERITY_TEXT},
+	}
+	logs := captureLogs(t)
+	warnInvalidPriority = sync.Once{}
+	cfg, _ := testConfig(t)
+	exporter := &memoryExporter{}
+	o := newMemoryLogger(t, cfg, exporter)
+	for _, tt := range tests {
+		o.Log(map[string]interface{}{"MESSAGE": "hello", "PRIORITY": tt.priority})
+	}
+	// entries without a PRIORITY have no severity
+	o.Log(map[string]interface{}{"MESSAGE": "hello"})
+	records := exporter.exported()
+	if len(records) != len(tests)+1 {
+		t.Fatalf("%d records exported, want %d", len(records), len(tests)+1)
+	}
+	for i, tt := range tests {
+		if got, text := records[i].Severity(), records[i].SeverityText(); got != tt.want || text != tt.text {
+			t.Errorf("PRIORITY %q: severity %v %q, want %v %q", tt.priority, got, text, tt.want, tt.text)
+		}
+	}
+	if got := records[len(tests)].Severity(); got != otellog.SeverityUndefined {
+		t.Errorf("severity %v of an entry without PRIORITY, want none", got)
+	}
+	if n := strings.Count(logs.String(), "invalid journald PRIORITY"); n != 1 {
+		t.Errorf("the invalid priorities were reported %d times, want once:\n%s", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), "priority=8") {
+		t.Errorf("the first invalid priority must be reported:\n%s", logs.String())
+	}
+}
+
+func TestTimestampSource(t *testing.T) {
+	journal, source := time.Unix(1700000010, 0), time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		source    string
+		entry     map[string]interface{}
+		timestamp time.Time
+	}{
+		{"journal", "journal", map[string]interface{}{
+			"__REALTIME_TIMESTAMP": "1700000010000000", "_SOURCE_REALTIME_TIMESTAMP": "1700000000000000"}, journal},
+		{"source", "source", map[string]interface{}{
+			"__REALTIME_TIMESTAMP": "1700000010000000", "_SOURCE_REALTIME_TIMESTAMP": "1700000000000000"}, source},
+		{"source missing", "source", map[string]interface{}{
+			"__REALTIME_TIMESTAMP": "1700000010000000"}, time.Time{}},
+		{"source invalid", "source", map[string]interface{}{
+			"__REALTIME_TIMESTAMP": "1700000010000000", "_SOURCE_REALTIME_TIMESTAMP": "soon"}, time.Time{}},
+		{"journal missing", "journal", map[string]interface{}{
+			"_SOURCE_REALTIME_TIMESTAMP": "1700000000000000"}, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.TimestampSource = tt.source
+			exporter := &memoryExporter{}
+			o := newMemoryLogger(t, cfg, exporter)
+			tt.entry["MESSAGE"] = "hello"
+			o.Log(tt.entry)
+			records := exporter.exported()
+			if len(records) != 1 {
+				t.Fatalf("%d records exported, want 1", len(records))
+			}
+			if got := records[0].Timestamp(); !got.Equal(tt.timestamp) {
+				t.Errorf("timestamp %v, want %v", got, tt.timestamp)
+			}
+			// __REALTIME_TIMESTAMP is the observed timestamp, whatever the event timestamp
+			if _, found := tt.entry["__REALTIME_TIMESTAMP"]; found && !records[0].ObservedTimestamp().Equal(journal) {
+				t.Errorf("observed timestamp %v, want %v", records[0].ObservedTimestamp(), journal)
+			}
+		})
+	}
+}
+
+func TestObservedIngestTime(t *testing.T) {
+	journal := time.Unix(1700000010, 0)
+	entry := map[string]interface{}{"MESSAGE": "hello", "__REALTIME_TIMESTAMP": "1700000010000000"}
+	tests := []struct {
+		name   string
+		ingest bool
+		entry  map[string]interface{}
+	}{
+		{"journal time", false, entry},
+		{"reading time", true, entry},
+		{"reading time without a journal time", true, map[string]interface{}{"MESSAGE": "hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.ObservedIngestTime = tt.ingest
+			exporter := &memoryExporter{}
+			o := newMemoryLogger(t, cfg, exporter)
+			before := time.Now()
+			o.Log(tt.entry)
+			after := time.Now()
+			records := exporter.exported()
+			if len(records) != 1 {
+				t.Fatalf("%d records exported, want 1", len(records))
+			}
+			observed := records[0].ObservedTimestamp()
+			if !tt.ingest {
+				if !observed.Equal(journal) {
+					t.Errorf("observed timestamp %v, want the journal time %v", observed, journal)
+				}
+			} else if observed.Before(before) || observed.After(after) {
+				t.Errorf("observed timestamp %v, want the reading time", observed)
+			}
+			// the event timestamp is not affected
+			if _, found := tt.entry["__REALTIME_TIMESTAMP"]; found && !records[0].Timestamp().Equal(journal) {
+				t.Errorf("timestamp %v, want %v", records[0].Timestamp(), journal)
+			}
+		})
+	}
+}
+
+func TestIngestLatency(t *testing.T) {
+	received := time.Now().Add(-2 * time.Second)
+	valid := strconv.FormatInt(received.UnixMicro(), 10)
+	tests := []struct {
+		name    string
+		enabled bool
+		ts      interface{}
+		found   bool
+	}{
+		{"disabled", false, valid, false},
+		{"journal time", true, valid, true},
+		{"invalid journal time", true, "yesterday", false},
+		{"missing journal time", true, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.AddIngestLatency = tt.enabled
+			exporter := &memoryExporter{}
+			o := newMemoryLogger(t, cfg, exporter)
+			entry := map[string]interface{}{"MESSAGE": "hello"}
+			if tt.ts != nil {
+				entry["__REALTIME_TIMESTAMP"] = tt.ts
+			}
+			o.Log(entry)
+			elapsed := time.Since(received).Milliseconds()
+			records := exporter.exported()
+			if len(records) != 1 {
+				t.Fatalf("%d records exported, want 1", len(records))
+			}
+			var latency otellog.Value
+			found := false
+			records[0].WalkAttributes(func(kv otellog.KeyValue) bool {
+				if kv.Key == "ingest.latency.ms" {
+					latency, found = kv.Value, true
+				}
+				return true
+			})
+			if found != tt.found {
+				t.Fatalf("ingest.latency.ms attribute found: %t, want %t", found, tt.found)
+			}
+			if found && (latency.AsInt64() < 2000 || latency.AsInt64() > elapsed) {
+				t.Errorf("latency %d ms, want between 2000 and %d", latency.AsInt64(), elapsed)
+			}
+		})
+	}
+}
+
+// return the string form of a resource attribute of an exported record, and whether it's set
+func resourceAttr(r sdklog.Record, key string) (string, bool) {
+	res := r.Resource()
+	value, found := res.Set().Value(attribute.Key(key))
+	if !found {
+		return "", false
+	}
+	return value.Emit(), true
+}
+
+func TestClusterName(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster string
+		found   bool
+	}{
+		{"unset", "", false},
+		{"set", "prod-cluster", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.ClusterName = tt.cluster
+			exporter := &memoryExporter{}
+			o := newMemoryLogger(t, cfg, exporter)
+			o.Log("line")
+			records := exporter.exported()
+			if len(records) != 1 {
+				t.Fatalf("%d records exported, want 1", len(records))
+			}
+			if got, found := resourceAttr(records[0], "proxmox.cluster"); found != tt.found || got != tt.cluster {
+				t.Errorf("proxmox.cluster = %q (set: %t), want %q", got, found, tt.cluster)
+			}
+		})
+	}
+}
+
+// return the first record exported by a logger created with the given options
+func firstRecord(t *testing.T, cfg *config.Config, opts OLoggerOptions) sdklog.Record {
+	t.Helper()
+	exporter := &memoryExporter{}
+	opts.Exporter = exporter
+	o, err := New(context.Background(), cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Shutdown(context.Background())
+	o.Log("line")
+	records := exporter.exported()
+	if len(records) != 1 {
+		t.Fatalf("%d records exported, want 1", len(records))
+	}
+	return records[0]
+}
+
+func TestProxmoxResource(t *testing.T) {
+	tests := []struct {
+		id     int
+		vmType string
+	}{
+		{100, "lxc"},
+		{101, "qm"},
+		{0, "pve"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.vmType, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			r := firstRecord(t, cfg, OLoggerOptions{ServiceId: fmt.Sprintf("%s/%d", tt.vmType, tt.id),
+				ServiceName: "name", VMId: tt.id, VMType: tt.vmType})
+			res := r.Resource()
+			if value, _ := res.Set().Value("proxmox.vmid"); value.Type() != attribute.INT64 || value.AsInt64() != int64(tt.id) {
+				t.Errorf("proxmox.vmid = %v, want the integer %d", value.Emit(), tt.id)
+			}
+			if got, _ := resourceAttr(r, "proxmox.vm.type"); got != tt.vmType {
+				t.Errorf("proxmox.vm.type = %q, want %q", got, tt.vmType)
+			}
+			if got, _ := resourceAttr(r, "service.instance.id"); got != fmt.Sprintf("%s/%d", tt.vmType, tt.id) {
+				t.Errorf("unexpected service.instance.id %q", got)
+			}
+		})
+	}
+}
+
+func TestBootIdAttr(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		entry   map[string]interface{}
+		want    interface{}
+	}{
+		{"disabled", false, map[string]interface{}{"MESSAGE": "hello", "_BOOT_ID": "b00t"}, nil},
+		{"enabled", true, map[string]interface{}{"MESSAGE": "hello", "_BOOT_ID": "b00t"}, "b00t"},
+		{"missing field", true, map[string]interface{}{"MESSAGE": "hello"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.BootIdAttr = tt.enabled
+			o := newTestLogger(t, cfg)
+			o.Log(tt.entry)
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", records)
+			}
+			if got := attributes(records[0])["boot.id"]; got != tt.want {
+				t.Errorf("boot.id = %v, want %v", got, tt.want)
+			}
+			// the field is kept in the body
+			if _, found := tt.entry["_BOOT_ID"]; found && !slices.Contains(bodyFields(records[0]), "_BOOT_ID") {
+				t.Error("the _BOOT_ID field must be kept in the body")
+			}
+		})
+	}
+}
+
+func TestSourceKind(t *testing.T) {
+	tests := []struct {
+		vmType string
+		want   string
+	}{
+		{"lxc", "lxc"},
+		{"qm", "qemu"},
+		{"pve", "pve-host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.vmType, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			// the kind doesn't depend on the service name
+			cfg.ServiceNameTemplate = "{type}-{name}"
+			r := firstRecord(t, cfg, OLoggerOptions{ServiceId: tt.vmType + "/1", ServiceName: "custom",
+				VMId: 1, VMType: tt.vmType})
+			if got, _ := resourceAttr(r, "source.kind"); got != tt.want {
+				t.Errorf("source.kind = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScopeVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+	}{
+		{"default", config.DEFAULT_OTLP_SCOPE_VERSION},
+		{"custom", "1.2.3"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.OtlpScopeVersion = tt.version
+			exporter := &memoryExporter{}
+			o := newMemoryLogger(t, cfg, exporter)
+			o.Log("line")
+			records := exporter.exported()
+			if len(records) != 1 {
+				t.Fatalf("%d records exported, want 1", len(records))
+			}
+			scope := records[0].InstrumentationScope()
+			if scope.Version != tt.version || scope.Name != cfg.OtlpLoggerName {
+				t.Errorf("scope %q version %q, want %q version %q", scope.Name, scope.Version,
+					cfg.OtlpLoggerName, tt.version)
+			}
+		})
+	}
+}
+
+func TestPoolResource(t *testing.T) {
+	tests := []struct {
+		pool  string
+		found bool
+	}{
+		{"", false},
+		{"web", true},
+	}
+	for _, tt := range tests {
+		cfg, _ := testConfig(t)
+		r := firstRecord(t, cfg, OLoggerOptions{ServiceId: "lxc/100", ServiceName: "ct100", VMId: 100,
+			VMType: "lxc", Pool: tt.pool})
+		if got, found := resourceAttr(r, "proxmox.pool"); got != tt.pool || found != tt.found {
+			t.Errorf("proxmox.pool = %q (set: %t), want %q", got, found, tt.pool)
+		}
+	}
+}
+
+func TestNewWithRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		delay   int
+		// time before the directory of the file exporter is created, or before
+		// the context is cancelled, if negative
+		after    time.Duration
+		warnings int
+		ok       bool
+	}{
+		{"no retries", 0, 0, time.Hour, 0, false},
+		{"retries exhausted", 2, 0, time.Hour, 2, false},
+		{"created by a retry", 2, 1, 100 * time.Millisecond, 1, true},
+		{"cancelled while waiting", 2, 60, -100 * time.Millisecond, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg, _ := testConfig(t)
+			dir := filepath.Join(t.TempDir(), "missing")
+			cfg.FilePath = filepath.Join(dir, "records.jsonl")
+			cfg.OtlpCreateRetries = tt.retries
+			cfg.OtlpCreateRetryDelay = tt.delay
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			timer := time.AfterFunc(tt.after.Abs(), func() {
+				if tt.after < 0 {
+					cancel()
+				} else {
+					os.Mkdir(dir, 0o755)
+				}
+			})
+			defer timer.Stop()
+			start := time.Now()
+			o, err := NewWithRetry(ctx, cfg, OLoggerOptions{ServiceId: "lxc/100", ServiceName: "ct100",
+				VMId: 100, VMType: "lxc"})
+			if (err == nil) != tt.ok {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			if o != nil {
+				o.Shutdown(context.Background())
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("gave up after %v", elapsed)
+			}
+			if n := strings.Count(logs.String(), "failure creating a logger; retrying"); n != tt.warnings {
+				t.Errorf("%d retries, want %d", n, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestTraceRecord(t *testing.T) {
+	logs := captureLogs(t)
+	cfg, _ := testConfig(t)
+	cfg.LogRules = []config.LogRule{{Field: "_COMM", Value: "cron", Action: config.RULE_DROP}}
+	o := newMemoryLogger(t, cfg, &memoryExporter{})
+	o.Log(map[string]interface{}{"MESSAGE": "hello", "PRIORITY": "3", "_COMM": "sshd"})
+	o.Log(map[string]interface{}{"MESSAGE": "tick", "PRIORITY": "6", "_COMM": "cron"})
+	lines := []string{}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, `msg="log entry mapped to a record"`) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 2 {
+		t.Fatalf("%d entries traced, want 2:\n%s", len(lines), logs.String())
+	}
+	for _, want := range []string{"service=lxc/100", "severity_text=ERROR", "MESSAGE:hello", `rule_action=""`} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("%s missing from the trace of the kept entry: %s", want, lines[0])
+		}
+	}
+	if !strings.Contains(lines[1], "rule_action=drop") {
+		t.Errorf("the dropping rule missing from the trace: %s", lines[1])
+	}
+
+	// nothing is traced above the debug level
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	before := logs.String()
+	o.Log(map[string]interface{}{"MESSAGE": "hello", "PRIORITY": "3"})
+	if after := logs.String(); after != before {
+		t.Errorf("entry traced at the info level: %s", strings.TrimPrefix(after, before))
+	}
+}
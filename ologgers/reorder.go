@@ -0,0 +1,90 @@
+package ologgers
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// maximum number of records held to be sorted; when reached, they are emitted
+// without waiting for the end of the reorder window
+const REORDER_MAX_RECORDS = 10000
+
+// state used to sort the records by timestamp before emitting them
+type reorderState struct {
+	mu     sync.Mutex
+	window time.Duration
+	held   []heldRecord
+	timer  *time.Timer
+	// incremented every time the held records are emitted, to ignore stale timers
+	gen int
+}
+
+// record waiting to be emitted, with its context
+type heldRecord struct {
+	ctx    context.Context
+	record otellog.Record
+}
+
+// return the time a record is sorted by: its timestamp or, if not set, the observed one
+func sortTime(r otellog.Record) time.Time {
+	if tm := r.Timestamp(); !tm.IsZero() {
+		return tm
+	}
+	return r.ObservedTimestamp()
+}
+
+// emit the held records, sorted by timestamp; the reorder lock must be held
+func (o *OLogger) flushReorderLocked() {
+	ro := o.reorder
+	if ro.timer != nil {
+		ro.timer.Stop()
+		ro.timer = nil
+	}
+	ro.gen++
+	// stable, so that records with the same timestamp keep their order
+	slices.SortStableFunc(ro.held, func(a, b heldRecord) int {
+		return sortTime(a.record).Compare(sortTime(b.record))
+	})
+	for _, h := range ro.held {
+		o.Logger.Emit(h.ctx, h.record)
+	}
+	ro.held = ro.held[:0]
+}
+
+// emit the held records, if any
+func (o *OLogger) flushReorder() {
+	if o.reorder == nil {
+		return
+	}
+	o.reorder.mu.Lock()
+	defer o.reorder.mu.Unlock()
+	o.flushReorderLocked()
+}
+
+// hold a record until the reorder window started by the first held one expires,
+// then emit all of them sorted by timestamp
+func (o *OLogger) logReorder(ctx context.Context, r otellog.Record) {
+	ro := o.reorder
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	ro.held = append(ro.held, heldRecord{ctx: ctx, record: r})
+	if len(ro.held) >= REORDER_MAX_RECORDS {
+		o.flushReorderLocked()
+		return
+	}
+	if ro.timer != nil {
+		return
+	}
+	gen := ro.gen
+	ro.timer = time.AfterFunc(ro.window, func() {
+		ro.mu.Lock()
+		defer ro.mu.Unlock()
+		if ro.gen == gen {
+			o.flushReorderLocked()
+		}
+	})
+}
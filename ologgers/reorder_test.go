@@ -0,0 +1,113 @@
+package ologgers
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// return a record with the given body and timestamps
+func timedRecord(body string, timestamp time.Time, observed time.Time) otellog.Record {
+	r := otellog.Record{}
+	r.SetBody(otellog.StringValue(body))
+	r.SetTimestamp(timestamp)
+	r.SetObservedTimestamp(observed)
+	return r
+}
+
+// return the bodies of the records received by an exporter
+func exportedBodies(e *memoryExporter) []string {
+	bodies := []string{}
+	for _, r := range e.exported() {
+		bodies = append(bodies, r.Body().AsString())
+	}
+	return bodies
+}
+
+func TestReorder(t *testing.T) {
+	base := time.Now()
+	at := func(s int) time.Time { return base.Add(time.Duration(s) * time.Second) }
+	tests := []struct {
+		name    string
+		records []otellog.Record
+		want    []string
+	}{
+		{"by timestamp", []otellog.Record{
+			timedRecord("c", at(3), at(3)),
+			timedRecord("a", at(1), at(5)),
+			timedRecord("b", at(2), at(4)),
+		}, []string{"a", "b", "c"}},
+		{"same timestamp keeps the order", []otellog.Record{
+			timedRecord("first", at(1), at(1)),
+			timedRecord("second", at(1), at(1)),
+			timedRecord("earlier", at(0), at(1)),
+			timedRecord("third", at(1), at(1)),
+		}, []string{"earlier", "first", "second", "third"}},
+		{"observed timestamp without a timestamp", []otellog.Record{
+			timedRecord("b", time.Time{}, at(2)),
+			timedRecord("a", at(1), at(3)),
+			timedRecord("c", time.Time{}, at(3)),
+		}, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.ReorderWindow = 60000
+			exporter := &memoryExporter{}
+			o := newMemoryLogger(t, cfg, exporter)
+			for _, r := range tt.records {
+				o.logReorder(context.Background(), r)
+			}
+			if n := len(exporter.exported()); n != 0 {
+				t.Fatalf("%d records emitted before the end of the window", n)
+			}
+			o.ForceFlush()
+			if got := exportedBodies(exporter); !slices.Equal(got, tt.want) {
+				t.Errorf("records emitted as %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReorderMaxRecords(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.ReorderWindow = 60000
+	exporter := &memoryExporter{}
+	o := newMemoryLogger(t, cfg, exporter)
+	now := time.Now()
+	for range REORDER_MAX_RECORDS {
+		o.logReorder(context.Background(), timedRecord("line", now, now))
+	}
+	if n := len(exporter.exported()); n != REORDER_MAX_RECORDS {
+		t.Errorf("%d records emitted once the limit was reached, want %d", n, REORDER_MAX_RECORDS)
+	}
+	o.logReorder(context.Background(), timedRecord("line", now, now))
+	if n := len(exporter.exported()); n != REORDER_MAX_RECORDS {
+		t.Errorf("the record after the limit must be held, %d emitted", n)
+	}
+}
+
+// a timer that fired while the records were being emitted by a flush
+// doesn't emit the records held after it
+func TestReorderStaleTimer(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.ReorderWindow = 50
+	exporter := &memoryExporter{}
+	o := newMemoryLogger(t, cfg, exporter)
+	now := time.Now()
+	o.logReorder(context.Background(), timedRecord("first", now, now))
+	// the timer fires and waits for the lock, taken by the flush
+	o.reorder.mu.Lock()
+	time.Sleep(100 * time.Millisecond)
+	o.flushReorderLocked()
+	o.reorder.mu.Unlock()
+	o.logReorder(context.Background(), timedRecord("second", now, now))
+	time.Sleep(10 * time.Millisecond)
+	if got := exportedBodies(exporter); !slices.Equal(got, []string{"first"}) {
+		t.Errorf("records emitted before the end of the window: %q", got)
+	}
+	waitFor(t, "the end of the window", func() bool { return len(exporter.exported()) == 2 })
+}
@@ -0,0 +1,40 @@
+package ologgers
+
+import (
+	"context"
+	"strings"
+
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// map the names of the severities to the lowest OTLP severity of each level
+var name2severity = map[string]otellog.Severity{
+	"debug": otellog.SeverityDebug,
+	"info":  otellog.SeverityInfo,
+	"warn":  otellog.SeverityWarn,
+	"error": otellog.SeverityError,
+	"fatal": otellog.SeverityFatal,
+}
+
+// convert the name of a severity, as accepted by the configuration, to an OTLP severity
+func parseSeverity(name string) otellog.Severity {
+	return name2severity[strings.ToLower(name)]
+}
+
+// context key marking the records routed by a rule to the secondary exporter
+type routeKey struct{}
+
+// processor forwarding only the records at or above a minimum severity,
+// or the ones routed to it
+type severityProcessor struct {
+	sdklog.Processor
+	min otellog.Severity
+}
+
+func (p severityProcessor) OnEmit(ctx context.Context, r *sdklog.Record) error {
+	if routed, _ := ctx.Value(routeKey{}).(bool); !routed && r.Severity() < p.min {
+		return nil
+	}
+	return p.Processor.OnEmit(ctx, r)
+}
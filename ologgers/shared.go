@@ -0,0 +1,77 @@
+package ologgers
+
+import (
+	"context"
+	"sync"
+
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// Exporters shared by the loggers of an instance of the monitoring, by name;
+// the OTLP exporters group the records by resource, so each VM keeps its own
+// resource over a single connection
+type SharedExporters struct {
+	mu     sync.Mutex
+	byName map[string]*sharedExporter
+}
+
+// Return an empty set of shared exporters
+func NewSharedExporters() *SharedExporters {
+	return &SharedExporters{byName: map[string]*sharedExporter{}}
+}
+
+// Return the number of shared exporters in use
+func (s *SharedExporters) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byName)
+}
+
+// exporter shared by several loggers, shut down when the last one releases it
+type sharedExporter struct {
+	sdklog.Exporter
+	owner *SharedExporters
+	name  string
+	refs  int
+}
+
+// reference to a shared exporter held by a logger
+type sharedExporterRef struct {
+	*sharedExporter
+	once sync.Once
+}
+
+// return a reference to the shared exporter with the given name, creating it if needed
+func (s *SharedExporters) acquire(name string, create func() (sdklog.Exporter, error)) (sdklog.Exporter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.byName[name]
+	if !ok {
+		exporter, err := create()
+		if err != nil {
+			return nil, err
+		}
+		e = &sharedExporter{Exporter: exporter, owner: s, name: name}
+		s.byName[name] = e
+	}
+	e.refs++
+	return &sharedExporterRef{sharedExporter: e}, nil
+}
+
+// release the reference; the exporter is shut down with the last one
+func (r *sharedExporterRef) Shutdown(ctx context.Context) error {
+	last := false
+	r.once.Do(func() {
+		r.owner.mu.Lock()
+		defer r.owner.mu.Unlock()
+		r.refs--
+		if r.refs == 0 {
+			delete(r.owner.byName, r.name)
+			last = true
+		}
+	})
+	if last {
+		return r.Exporter.Shutdown(ctx)
+	}
+	return nil
+}
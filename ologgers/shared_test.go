@@ -0,0 +1,52 @@
+package ologgers
+
+import (
+	"context"
+	"testing"
+
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+func TestSharedExporterShutdown(t *testing.T) {
+	shared := NewSharedExporters()
+	stub := &stubExporter{}
+	created := 0
+	create := func() (sdklog.Exporter, error) {
+		created++
+		return stub, nil
+	}
+	first, err := shared.acquire("test", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := shared.acquire("test", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 {
+		t.Fatalf("the exporter was created %d times, want 1", created)
+	}
+	ctx := context.Background()
+	first.Shutdown(ctx)
+	// releasing the same reference twice doesn't release the other one
+	first.Shutdown(ctx)
+	if stub.shutdowns != 0 {
+		t.Fatal("the exporter was shut down while still referenced")
+	}
+	if err := second.Export(ctx, make([]sdklog.Record, 1)); err != nil || stub.exported != 1 {
+		t.Fatalf("the remaining reference must still export: err=%v, exported=%d", err, stub.exported)
+	}
+	second.Shutdown(ctx)
+	if stub.shutdowns != 1 {
+		t.Fatalf("the exporter was shut down %d times, want 1", stub.shutdowns)
+	}
+	// a new reference creates a new exporter
+	third, err := shared.acquire("test", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Shutdown(ctx)
+	if created != 2 {
+		t.Errorf("the exporter was created %d times after the last release, want 2", created)
+	}
+}
@@ -0,0 +1,168 @@
+package ologgers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS certificate, key and CA read from files; they are read again when
+// the modification time of any of the files changes, so that rotated
+// certificates are used without restarting the program. PEM data, when
+// provided, takes precedence over the files and never changes. Without a
+// certificate and a key, only the CA is used and no client certificate is sent.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	certPEM  []byte
+	keyPEM   []byte
+	caPEM    []byte
+
+	mu       sync.Mutex
+	modTimes []time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+// return a certReloader instance, with the files already loaded; the
+// certificate and key PEM data, if not empty, replace the files, and so
+// does the CA PEM data
+func newCertReloader(certFile string, keyFile string, caFile string,
+	certPEM string, keyPEM string, caPEM string) (*certReloader, error) {
+	r := certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if certPEM != "" && keyPEM != "" {
+		r.certFile, r.keyFile = "", ""
+		r.certPEM, r.keyPEM = []byte(certPEM), []byte(keyPEM)
+	}
+	if caPEM != "" {
+		r.caFile = ""
+		r.caPEM = []byte(caPEM)
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// return the modification times of the files
+func (r *certReloader) currentModTimes() []time.Time {
+	times := []time.Time{}
+	for _, fn := range []string{r.certFile, r.keyFile, r.caFile} {
+		tm := time.Time{}
+		if fn == "" {
+			// PEM data: never modified
+		} else if st, err := os.Stat(fn); err == nil {
+			tm = st.ModTime()
+		}
+		times = append(times, tm)
+	}
+	return times
+}
+
+// read and parse the files; the lock must be held
+func (r *certReloader) load() error {
+	modTimes := r.currentModTimes()
+	var certificate tls.Certificate
+	var err error
+	if r.certPEM != nil {
+		certificate, err = tls.X509KeyPair(r.certPEM, r.keyPEM)
+	} else if r.certFile != "" {
+		certificate, err = tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate and key: %w", err)
+	}
+	ca := r.caPEM
+	if ca == nil {
+		ca, err = os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+	}
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		return errors.New("failed to append CA certificate to cert pool")
+	}
+	r.cert = &certificate
+	r.pool = certPool
+	r.modTimes = modTimes
+	return nil
+}
+
+// read the files again, if they were modified; on failure, the
+// previous certificates are kept
+func (r *certReloader) maybeReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	modTimes := r.currentModTimes()
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		slog.Warn("failure reloading TLS certificates; keeping the previous ones", "err", err)
+		return
+	}
+	slog.Info("reloaded TLS certificates", "cert_file", r.certFile)
+}
+
+// return the client certificate, used as tls.Config.GetClientCertificate
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// verify the server certificates against the current CA and the expected
+// server name, used as tls.Config.VerifyConnection
+func (r *certReloader) verifyConnection(cs tls.ConnectionState, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate received")
+	}
+	r.maybeReload()
+	r.mu.Lock()
+	pool := r.pool
+	r.mu.Unlock()
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         pool,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// return a TLS configuration always using the current certificates, to connect
+// to a server with the given name or IP address
+func (r *certReloader) tlsConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		// sent as SNI, unless it's an IP address
+		ServerName:           serverName,
+		GetClientCertificate: r.getClientCertificate,
+		// the standard verification would use a fixed CA pool: it's
+		// replaced by verifyConnection, that uses the current one.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return r.verifyConnection(cs, serverName)
+		},
+	}
+}
@@ -0,0 +1,220 @@
+package ologgers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// return a self-signed certificate for the given name and its key, PEM encoded
+func selfSigned(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// write a file, with a modification time different from the previous one
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certA, keyA := selfSigned(t, "old.example")
+	now := time.Now()
+	writeFile(t, certFile, certA, now)
+	writeFile(t, keyFile, keyA, now)
+	r, err := newCertReloader(certFile, keyFile, certFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() []byte {
+		cert, err := r.getClientCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Certificate[0]
+	}
+	first := current()
+
+	// rotated certificates are used without creating the logger again
+	certB, keyB := selfSigned(t, "new.example")
+	writeFile(t, certFile, certB, now.Add(time.Minute))
+	writeFile(t, keyFile, keyB, now.Add(time.Minute))
+	second := current()
+	if bytes.Equal(first, second) {
+		t.Fatal("the rotated certificate was not loaded")
+	}
+	block, _ := pem.Decode(certB)
+	if !bytes.Equal(second, block.Bytes) {
+		t.Error("unexpected certificate after the rotation")
+	}
+
+	// a broken rotation keeps the previous certificates
+	writeFile(t, certFile, []byte("garbage"), now.Add(2*time.Minute))
+	if !bytes.Equal(current(), second) {
+		t.Error("the previous certificate must be kept when the new one is invalid")
+	}
+}
+
+func TestCertReloaderMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"),
+		filepath.Join(dir, "cert.pem"), "", "", ""); err == nil {
+		t.Error("expected an error with missing files")
+	}
+}
+
+func TestCAOnlyTLS(t *testing.T) {
+	serverCert, serverKey := selfSigned(t, "collector.example")
+	otherCert, _ := selfSigned(t, "collector.example")
+	clientCert, clientKey := selfSigned(t, "client.example")
+	pair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *http.Request, 16)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	srv.StartTLS()
+	defer srv.Close()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, clientCert, time.Now())
+	writeFile(t, keyFile, clientKey, time.Now())
+
+	tests := []struct {
+		name     string
+		caPEM    string
+		files    bool
+		accepted bool
+	}{
+		{"ca pem", string(serverCert), false, true},
+		{"wrong ca pem", string(otherCert), false, false},
+		{"cert files with ca pem", string(serverCert), true, true},
+		{"cert files used as ca", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.OtlpExporter = "http"
+			cfg.OtlpHTTPURL = srv.URL
+			cfg.OtlpTLSServerName = "collector.example"
+			cfg.OtlpTLSCAPEM = tt.caPEM
+			if tt.files {
+				cfg.OtlpTLSCertFile, cfg.OtlpTLSKeyFile = certFile, keyFile
+			}
+			o := newTestLogger(t, cfg)
+			o.Log("line")
+			if _, delivered := o.DeliveryStats(); (delivered == 1) != tt.accepted {
+				t.Errorf("delivered %d records, accepted by the server: %v", delivered, tt.accepted)
+			}
+			if received := len(requests) > 0; received != tt.accepted {
+				t.Errorf("request received: %v, want %v", received, tt.accepted)
+			}
+			for len(requests) > 0 {
+				<-requests
+			}
+		})
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	serverCert, serverKey := selfSigned(t, "collector.example")
+	pair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *http.Request, 16)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	// the rejected handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		serverName string
+		caPEM      string
+		accepted   bool
+	}{
+		{"name of the certificate", "collector.example", string(serverCert), true},
+		{"mismatched name", "other.example", string(serverCert), false},
+		// the server is reached by IP address, not in the certificate
+		{"name of the url", "", string(serverCert), false},
+		{"system certificates", "collector.example", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.OtlpExporter = "http"
+			cfg.OtlpHTTPURL = srv.URL
+			cfg.OtlpTLSServerName = tt.serverName
+			cfg.OtlpTLSCAPEM = tt.caPEM
+			o := newTestLogger(t, cfg)
+			o.Log("line")
+			if _, delivered := o.DeliveryStats(); (delivered == 1) != tt.accepted {
+				t.Errorf("delivered %d records, accepted by the server: %v", delivered, tt.accepted)
+			}
+			if received := len(requests) > 0; received != tt.accepted {
+				t.Errorf("request received: %v, want %v", received, tt.accepted)
+			}
+			for len(requests) > 0 {
+				<-requests
+			}
+		})
+	}
+}
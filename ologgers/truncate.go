@@ -0,0 +1,77 @@
+package ologgers
+
+import (
+	"slices"
+	"unicode/utf8"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// cut a string to at most max bytes, without splitting a multi-byte character;
+// the second value tells whether the string was truncated
+func truncateString(s string, max int) (string, bool) {
+	if len(s) <= max {
+		return s, false
+	}
+	n := max
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n], true
+}
+
+// bytes left for the strings of a record; once used up, the following
+// strings are emptied
+type byteBudget struct {
+	left      int
+	truncated bool
+}
+
+// return a string cut to the bytes left, consuming them
+func (b *byteBudget) take(s string) string {
+	s, cut := truncateString(s, b.left)
+	b.left -= len(s)
+	b.truncated = b.truncated || cut
+	return s
+}
+
+// limit the total length of the strings contained in a parsed log entry;
+// the fields of a map are visited sorted by name, with MESSAGE first, so
+// that the same fields are truncated every time
+func (b *byteBudget) truncateBody(i interface{}) interface{} {
+	switch obj := i.(type) {
+	case string:
+		return b.take(obj)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		if idx := slices.Index(keys, "MESSAGE"); idx > 0 {
+			keys = slices.Insert(slices.Delete(keys, idx, idx+1), 0, "MESSAGE")
+		}
+		for _, key := range keys {
+			obj[key] = b.truncateBody(obj[key])
+		}
+		return obj
+	case []interface{}:
+		for idx, value := range obj {
+			obj[idx] = b.truncateBody(value)
+		}
+		return obj
+	}
+	return i
+}
+
+// limit the total length of the string values of the given attributes,
+// with the bytes left by the body
+func (b *byteBudget) truncateAttrs(attrs []otellog.KeyValue) []otellog.KeyValue {
+	for idx, kv := range attrs {
+		if kv.Value.Kind() != otellog.KindString {
+			continue
+		}
+		attrs[idx].Value = otellog.StringValue(b.take(kv.Value.AsString()))
+	}
+	return attrs
+}
@@ -0,0 +1,83 @@
+package ologgers
+
+import (
+	"reflect"
+	"testing"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+func TestTruncateString(t *testing.T) {
+	if s, cut := truncateString("hello", 5); s != "hello" || cut {
+		t.Errorf("a string at the limit must be kept: %q, %t", s, cut)
+	}
+	if s, cut := truncateString("hello!", 5); s != "hello" || !cut {
+		t.Errorf("a string over the limit must be cut: %q, %t", s, cut)
+	}
+	// "è" is two bytes long
+	if s, cut := truncateString("caffè", 5); s != "caff" || !cut {
+		t.Errorf("a multi-byte character must not be split: %q, %t", s, cut)
+	}
+}
+
+func TestRecordBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		body      interface{}
+		want      map[string]interface{}
+		truncated bool
+	}{
+		{"at the limit", 10, map[string]interface{}{"MESSAGE": "hello", "_COMM": "sshd", "OTHER": "x"},
+			map[string]interface{}{"MESSAGE": "hello", "_COMM": "sshd", "OTHER": "x"}, false},
+		{"over the limit", 8, map[string]interface{}{"MESSAGE": "hello", "_COMM": "sshd", "OTHER": "x"},
+			map[string]interface{}{"MESSAGE": "hello", "_COMM": "ss", "OTHER": "x"}, true},
+		{"message first", 4, map[string]interface{}{"MESSAGE": "hello world", "A": "first"},
+			map[string]interface{}{"MESSAGE": "hell", "A": ""}, true},
+		{"nested values", 6, map[string]interface{}{"MESSAGE": "abc", "LIST": []interface{}{"de", "fgh", 1.0}},
+			map[string]interface{}{"MESSAGE": "abc", "LIST": []interface{}{"de", "f", 1.0}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.MaxRecordBytes = tt.max
+			o := newTestLogger(t, cfg)
+			o.Log(tt.body)
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", records)
+			}
+			body, _ := records[0]["body"].(map[string]interface{})
+			for key, want := range tt.want {
+				if got := body[key]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+			if got := attributes(records[0])["truncated"] == true; got != tt.truncated {
+				t.Errorf("truncated = %t, want %t", got, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestRecordBudgetIncludesAttributes(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.MaxRecordBytes = 10
+	o := newTestLogger(t, cfg)
+	// the raw line comes after the body
+	o.Log("a line", otellog.String("raw", "a line that is long"))
+	records := readRecords(t, path)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %v", records)
+	}
+	if body := records[0]["body"]; body != "a line" {
+		t.Errorf("unexpected body: %v", body)
+	}
+	attrs := attributes(records[0])
+	if raw := attrs["raw"]; raw != "a li" {
+		t.Errorf("the attributes must get the bytes left by the body: %q", raw)
+	}
+	if attrs["truncated"] != true {
+		t.Error("the record must be marked as truncated")
+	}
+}
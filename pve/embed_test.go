@@ -0,0 +1,96 @@
+package pve
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alberanid/pve2otelcol/metrics"
+)
+
+// two instances in the same process, as a program embedding the monitoring
+// may run, don't share their configuration, their attributes nor their exporters
+func TestTwoInstances(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shared exporter %t", shared), func(t *testing.T) { testTwoInstances(t, shared) })
+	}
+}
+
+func testTwoInstances(t *testing.T, shared bool) {
+	type instance struct {
+		p    *Pve
+		path string
+		site string
+	}
+	instances := []instance{}
+	for _, site := range []string{"milan", "rome"} {
+		cfg, path := testConfig(t)
+		cfg.OtlpProcessor = "simple"
+		cfg.OtlpSharedExporter = shared
+		cfg.LXCMonitorCmd = fakeCommand(t, fmt.Sprintf("echo 'hello from %s'; exec sleep 60", site))
+		p := newTestPve(t, cfg)
+		defer p.Stop()
+		p.SetFileAttrs(map[string]string{"site": site})
+		fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+		instances = append(instances, instance{p, path, site})
+	}
+	for _, i := range instances {
+		i.p.RefreshVMsMonitoring()
+	}
+	for _, i := range instances {
+		waitFor(t, "the records of "+i.site, func() bool { return len(readRecords(t, i.path)) > 0 })
+		records := readRecords(t, i.path)
+		if len(records) != 1 {
+			t.Fatalf("%d records written for %s, want 1", len(records), i.site)
+		}
+		if body := fmt.Sprint(records[0]["body"]); body != "hello from "+i.site {
+			t.Errorf("record %q written for %s", body, i.site)
+		}
+		resource, _ := records[0]["resource"].(map[string]interface{})
+		if site := resource["site"]; site != i.site {
+			t.Errorf("site = %v in the records of %s", site, i.site)
+		}
+	}
+	// the loggers created after a reload get the new attributes
+	p := instances[0].p
+	p.SetFileAttrs(map[string]string{"site": "turin"})
+	if site := p.loggerOptions(&VM{Id: 101, Type: "lxc"}).FileAttrs["site"]; site != "turin" {
+		t.Errorf("site = %q after the reload, want %q", site, "turin")
+	}
+	if site := instances[1].p.loggerOptions(&VM{Id: 101, Type: "lxc"}).FileAttrs["site"]; site != "rome" {
+		t.Errorf("site = %q in the other instance, want %q", site, "rome")
+	}
+}
+
+// the series of the VMs of an instance are neither reset by the other ones
+// nor kept once it's stopped
+func TestTwoInstancesMetrics(t *testing.T) {
+	instances := []*Pve{}
+	for _, id := range []int{100, 200} {
+		cfg, _ := testConfig(t)
+		p := newTestPve(t, cfg)
+		defer p.Stop()
+		p.UpdateVM(&VM{Id: id, Name: fmt.Sprintf("ct%d", id), Type: "lxc"})
+		instances = append(instances, p)
+	}
+	written := func() string {
+		rec := httptest.NewRecorder()
+		metrics.Write(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	series := func(id int) string {
+		return fmt.Sprintf(`pve2otelcol_batch_queue_depth{vm_type="lxc",vm_id="%d"} `, id)
+	}
+	if out := written(); !strings.Contains(out, series(100)) || !strings.Contains(out, series(200)) {
+		t.Fatalf("series of the VMs of both the instances missing:\n%s", out)
+	}
+	instances[0].Stop()
+	out := written()
+	if strings.Contains(out, series(100)) {
+		t.Error("the series of the stopped instance are still written")
+	}
+	if !strings.Contains(out, series(200)) {
+		t.Error("the series of the running instance were removed")
+	}
+}
@@ -0,0 +1,159 @@
+package pve
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alberanid/pve2otelcol/ologgers"
+)
+
+// start sending, in the background, the last IncludeStoppedHistory records of
+// the journal of each stopped LXC; it's stopped by stopStoppedHistory
+func (p *Pve) startStoppedHistory() {
+	if p.cfg.SkipLXCs || p.cfg.IncludeStoppedHistory <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	done := make(chan struct{})
+	p.historyCancel, p.historyDone = cancel, done
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				p.logPanic(r, "during", "history")
+			}
+		}()
+		p.sendStoppedHistory(ctx)
+	}()
+}
+
+// stop sending the history of the stopped LXCs, waiting for the one being
+// mounted to be unmounted
+func (p *Pve) stopStoppedHistory() {
+	if p.historyCancel == nil {
+		return
+	}
+	p.historyCancel()
+	<-p.historyDone
+	p.historyCancel, p.historyDone = nil, nil
+}
+
+// send the last IncludeStoppedHistory records of the journal of each stopped LXC;
+// since "pct exec" requires a running container, the journal is read from the
+// host, without following it
+func (p *Pve) sendStoppedHistory(ctx context.Context) {
+	vms, err := p.listLXCs(false)
+	if err != nil {
+		return
+	}
+	for _, vm := range p.filterVMs(vms) {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := p.sendHistory(ctx, vm); err != nil {
+			slog.Error("failure sending the history of a stopped LXC", "vm_type", vm.Type, "vm_id", vm.Id, "err", err)
+		}
+	}
+}
+
+// return the volume of the root filesystem in the output of "pct config"
+func parseRootfs(config string) string {
+	for _, line := range strings.Split(config, "\n") {
+		if value, found := strings.CutPrefix(line, "rootfs:"); found {
+			volume, _, _ := strings.Cut(strings.TrimSpace(value), ",")
+			return volume
+		}
+	}
+	return ""
+}
+
+// return the directory of the root filesystem of a stopped LXC, if its volume
+// is one (e.g. a ZFS subvolume) that can be read without mounting the container
+func (p *Pve) rootfsDir(ctx context.Context, id int) (string, bool) {
+	config, err := p.readConfig(id)
+	if err != nil {
+		return "", false
+	}
+	volume := parseRootfs(config)
+	if volume == "" {
+		return "", false
+	}
+	out, err := p.historyCmd(ctx, "pvesm", "path", volume).Output()
+	if err != nil {
+		return "", false
+	}
+	dir := strings.TrimSpace(string(out))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return dir, true
+}
+
+// send the last IncludeStoppedHistory records of the journal of a stopped LXC;
+// its root filesystem is mounted only if it can't be read otherwise, since the
+// container can't be started while mounted
+func (p *Pve) sendHistory(ctx context.Context, vm *VM) error {
+	strId := strconv.Itoa(vm.Id)
+	rootfs, readable := p.rootfsDir(ctx, vm.Id)
+	if !readable {
+		rootfs = filepath.Join("/var/lib/lxc", strId, "rootfs")
+	}
+	args := []string{"--root", rootfs, "--lines", strconv.Itoa(p.cfg.IncludeStoppedHistory),
+		"--no-pager", "--output", "json"}
+	args = append(args, p.cfg.JournalFilterArgs()...)
+	if p.cfg.DryRun {
+		cmd := "journalctl " + strings.Join(args, " ")
+		if !readable {
+			cmd = fmt.Sprintf("pct mount %s; %s; pct unmount %s", strId, cmd, strId)
+		}
+		slog.Info("DRY RUN", "cmd", cmd)
+		return nil
+	}
+	slog.Debug("sending the history of a stopped LXC", "vm_type", vm.Type, "vm_id", vm.Id)
+	logger, err := ologgers.New(p.ctx, p.cfg, p.loggerOptions(vm))
+	if err != nil {
+		return err
+	}
+	defer logger.Shutdown(context.Background())
+
+	if !readable {
+		// the container can't be started while mounted: it's unmounted even when
+		// the mount is interrupted, since it may have been mounted anyway, and
+		// when the program is stopped, by stopStoppedHistory
+		defer func() {
+			if out, err := p.historyCmd(context.Background(), "pct", "unmount", strId).CombinedOutput(); err != nil {
+				slog.Error("unable to unmount a stopped LXC", "vm_type", vm.Type, "vm_id", vm.Id, "err", err,
+					"output", string(out))
+			}
+		}()
+		if out, err := p.historyCmd(ctx, "pct", "mount", strId).CombinedOutput(); err != nil {
+			return fmt.Errorf("unable to mount the LXC: %w: %s", err, out)
+		}
+	}
+	cmd := p.historyCmd(ctx, "journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var jData interface{}
+		if err := json.Unmarshal([]byte(line), &jData); err != nil {
+			logger.Log(line)
+		} else {
+			logger.Log(jData)
+		}
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,154 @@
+package pve
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// make the Pve instance run a fake script for the history commands, receiving
+// the name of the command as the first argument; the calls are appended to the
+// returned file
+func fakeHistoryCmd(t *testing.T, p *Pve, script string) string {
+	t.Helper()
+	calls := filepath.Join(t.TempDir(), "calls")
+	path := fakeCommand(t, fmt.Sprintf("echo \"$@\" >> %s\n%s", calls, script))
+	p.historyCmd = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, path, append([]string{name}, args...)...)
+	}
+	return calls
+}
+
+// return the commands run by the fake script
+func readCalls(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		calls = append(calls, strings.Fields(line)[0]+" "+strings.Fields(line)[1])
+	}
+	return calls
+}
+
+func TestStoppedHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		records int
+		calls   []string
+	}{
+		{"journal sent", `[ "$1" = journalctl ] && echo '{"MESSAGE": "one"}' && echo '{"MESSAGE": "two"}'; exit 0`,
+			2, []string{"pct mount", "journalctl --root", "pct unmount"}},
+		{"failed mount", `[ "$1" = pct ] && [ "$2" = mount ] && exit 1; exit 0`,
+			0, []string{"pct mount", "pct unmount"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.IncludeStoppedHistory = 10
+			cfg.LXCMonitorCmd = "sleep 60"
+			cfg.OtlpProcessor = "simple"
+			p := newTestPve(t, cfg)
+			fakePctList(p, PCT_LIST)
+			calls := fakeHistoryCmd(t, p, tt.script)
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the history to be sent", func() bool {
+				select {
+				case <-p.historyDone:
+					return true
+				default:
+					return false
+				}
+			})
+			p.Stop()
+			// the running LXCs print nothing
+			records := readRecords(t, path)
+			if len(records) != tt.records {
+				t.Errorf("%d records sent for the stopped LXC, want %d: %v", len(records), tt.records, records)
+			}
+			if got := readCalls(t, calls); strings.Join(got, ",") != strings.Join(tt.calls, ",") {
+				t.Errorf("commands %q, want %q", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestStopUnmountsStoppedLXC(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.IncludeStoppedHistory = 10
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	fakePctList(p, PCT_LIST)
+	// the journal is never read to the end
+	calls := fakeHistoryCmd(t, p, `[ "$1" = journalctl ] && exec sleep 60; exit 0`)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the journal to be read", func() bool {
+		data, _ := os.ReadFile(calls)
+		return strings.Contains(string(data), "journalctl")
+	})
+	p.Stop()
+	want := []string{"pct mount", "journalctl --root", "pct unmount"}
+	if got := readCalls(t, calls); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("commands %q, want %q", got, want)
+	}
+}
+
+func TestParseRootfs(t *testing.T) {
+	config := "arch: amd64\nhostname: web\nrootfs: local-zfs:subvol-100-disk-0,size=8G\nswap: 512\n"
+	if got := parseRootfs(config); got != "local-zfs:subvol-100-disk-0" {
+		t.Errorf("parseRootfs = %q", got)
+	}
+	if got := parseRootfs("hostname: web\n"); got != "" {
+		t.Errorf("parseRootfs = %q without a rootfs", got)
+	}
+}
+
+// a root filesystem that is a directory on the host is read without mounting the LXC
+func TestStoppedHistoryWithoutMount(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.IncludeStoppedHistory = 10
+	cfg.LXCMonitorCmd = "sleep 60"
+	cfg.OtlpProcessor = "simple"
+	p := newTestPve(t, cfg)
+	fakePctList(p, PCT_LIST)
+	p.readConfig = func(id int) (string, error) {
+		return fmt.Sprintf("rootfs: local-zfs:subvol-%d-disk-0,size=8G\n", id), nil
+	}
+	rootfs := t.TempDir()
+	calls := fakeHistoryCmd(t, p, fmt.Sprintf(`[ "$1" = pvesm ] && echo %s && exit 0
+[ "$1" = journalctl ] && echo '{"MESSAGE": "one"}'; exit 0`, rootfs))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the history to be sent", func() bool {
+		select {
+		case <-p.historyDone:
+			return true
+		default:
+			return false
+		}
+	})
+	p.Stop()
+	if records := readRecords(t, path); len(records) != 1 {
+		t.Errorf("%d records sent for the stopped LXC, want 1", len(records))
+	}
+	want := []string{"pvesm path", "journalctl --root"}
+	if got := readCalls(t, calls); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("commands %q, want %q", got, want)
+	}
+	data, _ := os.ReadFile(calls)
+	if !strings.Contains(string(data), "path local-zfs:subvol-101-disk-0\njournalctl --root "+rootfs+" ") {
+		t.Errorf("journal not read from the root filesystem of the LXC:\n%s", data)
+	}
+}
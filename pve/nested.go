@@ -0,0 +1,55 @@
+package pve
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alberanid/pve2otelcol/config"
+)
+
+// prefix of the names of the log sources of the nested containers
+const NESTED_SOURCE_PREFIX = "nested:"
+
+// return the names (or IDs) of the containers running inside an LXC, as
+// printed one per line by NestedListCmd
+func (p *Pve) nestedContainers(vm *VM) ([]string, error) {
+	// the template is validated at startup
+	args, _ := config.ExpandCmdTemplate(p.cfg.NestedListCmd,
+		map[string]string{"id": strconv.Itoa(vm.Id), "name": vm.Name})
+	out, err := p.runList(args[0], args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	containers := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !slices.Contains(containers, line) {
+			containers = append(containers, line)
+		}
+	}
+	return containers, nil
+}
+
+// return the log sources of the containers running inside an LXC with the
+// NestedTag, built from NestedMonitorCmd; the containers are enumerated again
+// every time the monitoring commands are (re)started
+func (p *Pve) nestedSources(vm *VM) []LogSource {
+	if p.cfg.NestedTag == "" || vm.Type != "lxc" || !slices.Contains(p.vmTags(vm), p.cfg.NestedTag) {
+		return nil
+	}
+	containers, err := p.listNested(vm)
+	if err != nil {
+		slog.Warn("failure listing the nested containers", "vm_type", vm.Type, "vm_id", vm.Id, "err", err)
+		return nil
+	}
+	sources := []LogSource{}
+	for _, container := range containers {
+		// the template is validated at startup, and the values are not expanded
+		args, _ := config.ExpandCmdTemplate(p.cfg.NestedMonitorCmd,
+			map[string]string{"id": strconv.Itoa(vm.Id), "name": vm.Name, "container": container})
+		sources = append(sources, LogSource{Name: NESTED_SOURCE_PREFIX + container, Cmd: args[0], Args: args[1:]})
+	}
+	slog.Debug("found nested containers", "vm_type", vm.Type, "vm_id", vm.Id, "containers", containers)
+	return sources
+}
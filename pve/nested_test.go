@@ -0,0 +1,83 @@
+package pve
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNestedContainers(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{"none", "", []string{}},
+		{"listing order", "f00d\nbeef\ncafe\n", []string{"f00d", "beef", "cafe"}},
+		{"blank lines and spaces", "\n  f00d \r\n\n\tbeef\n", []string{"f00d", "beef"}},
+		{"duplicates", "f00d\nbeef\nf00d\n", []string{"f00d", "beef"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			p := newTestPve(t, cfg)
+			var cmd []string
+			p.runList = func(name string, args ...string) ([]byte, error) {
+				cmd = append([]string{name}, args...)
+				return []byte(tt.out), nil
+			}
+			got, err := p.nestedContainers(&VM{Id: 100, Name: "web", Type: "lxc"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("containers %q, want %q", got, tt.want)
+			}
+			if want := []string{"pct", "exec", "100", "--", "docker", "ps", "--quiet"}; !slices.Equal(cmd, want) {
+				t.Errorf("listing command %q, want %q", cmd, want)
+			}
+		})
+	}
+}
+
+func TestNestedSources(t *testing.T) {
+	tests := []struct {
+		name       string
+		vm         *VM
+		tags       string
+		containers []string
+		err        error
+		want       []LogSource
+	}{
+		{"tagged LXC", &VM{Id: 100, Name: "web", Type: "lxc"}, "tags: docker;prod\n", []string{"f00d", "beef"}, nil,
+			[]LogSource{
+				{Name: "nested:f00d", Cmd: "pct", Args: []string{"exec", "100", "--", "docker", "logs", "--follow", "--tail", "0", "f00d"}},
+				{Name: "nested:beef", Cmd: "pct", Args: []string{"exec", "100", "--", "docker", "logs", "--follow", "--tail", "0", "beef"}},
+			}},
+		{"values are not expanded", &VM{Id: 100, Name: "web", Type: "lxc"}, "tags: docker\n", []string{"my app {id}"}, nil,
+			[]LogSource{
+				{Name: "nested:my app {id}", Cmd: "pct", Args: []string{"exec", "100", "--", "docker", "logs", "--follow", "--tail", "0", "my app {id}"}},
+			}},
+		{"untagged LXC", &VM{Id: 100, Name: "web", Type: "lxc"}, "tags: prod\n", []string{"f00d"}, nil, nil},
+		{"KVM", &VM{Id: 100, Name: "web", Type: "qm"}, "tags: docker\n", []string{"f00d"}, nil, nil},
+		{"listing failure", &VM{Id: 100, Name: "web", Type: "lxc"}, "tags: docker\n", nil, errors.New("not running"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.NestedTag = "docker"
+			p := newTestPve(t, cfg)
+			p.readConfig = func(id int) (string, error) { return tt.tags, nil }
+			p.listNested = func(vm *VM) ([]string, error) { return tt.containers, tt.err }
+			got := p.nestedSources(tt.vm)
+			if len(got) != len(tt.want) {
+				t.Fatalf("sources %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i].Name || got[i].Cmd != tt.want[i].Cmd || !slices.Equal(got[i].Args, tt.want[i].Args) {
+					t.Errorf("source %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
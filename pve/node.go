@@ -0,0 +1,47 @@
+package pve
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+)
+
+// file of the cluster filesystem describing the nodes, including the local one
+const PVE_MEMBERS_FILE = "/etc/pve/.members"
+
+// extract the name of the local node from the content of the .members file
+func parseMembers(data []byte) (string, error) {
+	members := struct {
+		NodeName string `json:"nodename"`
+	}{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return "", err
+	}
+	if members.NodeName == "" {
+		return "", errors.New("missing nodename")
+	}
+	return members.NodeName, nil
+}
+
+// return the name of the PVE node: the one used by Proxmox, if source is "pve",
+// or the hostname. The hostname is also used if the Proxmox name can't be read
+func nodeName(source string, membersFile string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if source != "pve" {
+		return hostname
+	}
+	data, err := os.ReadFile(membersFile)
+	if err == nil {
+		var name string
+		if name, err = parseMembers(data); err == nil {
+			return name
+		}
+	}
+	slog.Warn("unable to read the name of the PVE node; using the hostname", "path", membersFile,
+		"hostname", hostname, "err", err)
+	return hostname
+}
@@ -0,0 +1,39 @@
+package pve
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeName(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		source  string
+		members string
+		want    string
+	}{
+		{"hostname", "hostname", `{"nodename": "pve1"}`, hostname},
+		{"pve", "pve", `{"nodename": "pve1", "version": 5, "cluster": {"name": "prod"}}`, "pve1"},
+		{"missing file", "pve", "", hostname},
+		{"invalid file", "pve", "nodename: pve1", hostname},
+		{"missing nodename", "pve", `{"version": 5}`, hostname},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".members")
+			if tt.members != "" {
+				if err := os.WriteFile(path, []byte(tt.members), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := nodeName(tt.source, path); got != tt.want {
+				t.Errorf("node name %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package pve
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os/exec"
+	"time"
+)
+
+// maximum age of the known pool memberships
+const POOLS_CACHE_TTL = time.Minute
+
+// return the resource pool of every VM of the cluster, with an empty string
+// for the VMs not in a pool
+func pveshPools() (map[int]string, error) {
+	out, err := exec.Command("pvesh", "get", "/cluster/resources", "--type", "vm", "--output-format", "json").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parsePools(out)
+}
+
+// parse the VM resources of the cluster, as printed by pvesh in JSON format
+func parsePools(out []byte) (map[int]string, error) {
+	resources := []struct {
+		VMId int    `json:"vmid"`
+		Pool string `json:"pool"`
+	}{}
+	if err := json.Unmarshal(out, &resources); err != nil {
+		return nil, err
+	}
+	pools := map[int]string{}
+	for _, r := range resources {
+		pools[r.VMId] = r.Pool
+	}
+	return pools, nil
+}
+
+// return the resource pool of a VM, or an empty string if it's not in a pool;
+// the memberships are read again when too old or when the VM is unknown
+func (p *Pve) vmPool(vm *VM) string {
+	p.poolsMu.Lock()
+	defer p.poolsMu.Unlock()
+	pool, ok := p.poolsCache[vm.Id]
+	if ok && time.Since(p.poolsRead) < POOLS_CACHE_TTL {
+		return pool
+	}
+	if !ok && time.Since(p.poolsRead) < time.Duration(p.cfg.RefreshInterval)*time.Second {
+		// already read during this refresh
+		return ""
+	}
+	// failures are not retried before the next refresh
+	p.poolsRead = time.Now()
+	pools, err := p.readPools()
+	if err != nil {
+		slog.Debug("failure reading the resource pools", "err", err)
+		return pool
+	}
+	p.poolsCache = pools
+	return pools[vm.Id]
+}
@@ -0,0 +1,82 @@
+package pve
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParsePools(t *testing.T) {
+	out := `[{"vmid": 100, "type": "lxc", "pool": "web", "node": "pve1"},
+		{"vmid": 101, "type": "qemu", "node": "pve2"},
+		{"vmid": 102, "type": "lxc", "pool": "db"}]`
+	pools, err := parsePools([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]string{100: "web", 101: "", 102: "db"}; fmt.Sprint(pools) != fmt.Sprint(want) {
+		t.Errorf("pools %v, want %v", pools, want)
+	}
+	if _, err := parsePools([]byte("not json")); err == nil {
+		t.Error("expected an error parsing invalid output")
+	}
+}
+
+func TestVMPool(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.RefreshInterval = 60
+	p := newTestPve(t, cfg)
+	reads := 0
+	var pools map[int]string
+	var readErr error
+	p.readPools = func() (map[int]string, error) {
+		reads++
+		return pools, readErr
+	}
+	pools = map[int]string{100: "web", 101: ""}
+	tests := []struct {
+		name  string
+		setup func()
+		id    int
+		want  string
+		reads int
+	}{
+		{"first read", func() {}, 100, "web", 1},
+		{"cached", func() { pools = map[int]string{100: "db"} }, 100, "web", 1},
+		{"not in a pool", func() {}, 101, "", 1},
+		{"unknown VM during the same refresh", func() {}, 102, "", 1},
+		{"unknown VM at the next refresh", func() {
+			pools = map[int]string{100: "db", 102: "cache"}
+			p.poolsRead = time.Now().Add(-61 * time.Second)
+		}, 102, "cache", 2},
+		{"expired", func() { p.poolsRead = time.Now().Add(-POOLS_CACHE_TTL) }, 100, "db", 3},
+		{"failure keeps the known pool", func() {
+			readErr = errors.New("pvesh failed")
+			p.poolsRead = time.Now().Add(-POOLS_CACHE_TTL)
+		}, 100, "db", 4},
+		{"failure not retried", func() { readErr = nil }, 100, "db", 4},
+	}
+	for _, tt := range tests {
+		tt.setup()
+		if got := p.vmPool(&VM{Id: tt.id, Type: "lxc"}); got != tt.want {
+			t.Errorf("%s: pool %q, want %q", tt.name, got, tt.want)
+		}
+		if reads != tt.reads {
+			t.Errorf("%s: pools read %d times, want %d", tt.name, reads, tt.reads)
+		}
+	}
+}
+
+func TestLoggerOptionsPool(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	p.readPools = func() (map[int]string, error) { return map[int]string{0: "node", 100: "web"}, nil }
+	if got := p.loggerOptions(&VM{Id: 100, Type: "lxc"}).Pool; got != "web" {
+		t.Errorf("pool %q of a VM, want %q", got, "web")
+	}
+	// the PVE node is not a VM of a pool
+	if got := p.loggerOptions(&VM{Id: 0, Type: "pve"}).Pool; got != "" {
+		t.Errorf("pool %q of the PVE node, want none", got)
+	}
+}
@@ -2,21 +2,32 @@ package pve
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"maps"
+	"math/rand/v2"
 	"os"
 	"os/exec"
+	"path"
+	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alberanid/pve2otelcol/config"
+	"github.com/alberanid/pve2otelcol/metrics"
 	"github.com/alberanid/pve2otelcol/ologgers"
+	otellog "go.opentelemetry.io/otel/log"
 )
 
 // configuration used to monitor a VM
@@ -26,127 +37,550 @@ type VM struct {
 	Type        string
 	MonitorCmd  string
 	MonitorArgs []string
+	// additional commands following other logs of the VM
+	ExtraSources []LogSource
+	// Running, StopProcess, LastError and RestartCount are protected by the lock of the Pve instance
 	Running     bool
 	Logger      *ologgers.OLogger
 	StopProcess func()
 	LastError   *error
+	// times the monitoring command was run again after the first time
+	RestartCount int
+	// incremented every time a monitoring loop is started; older loops exit
+	monitorGen int
+	// closed when the latest monitoring loop exits
+	monitorDone chan struct{}
+	// closed when the latest monitoring loop no longer owns the VM, to stop
+	// its wait before a retry
+	monitorStop chan struct{}
+	// consecutive refreshes the VM was not found; protected by the lock of the Pve instance
+	absentRefreshes int
+	// consecutive failures creating the logger, and when to try again
+	loggerFailures int
+	nextLoggerTry  time.Time
+	// time of the last line read from the monitoring command, in Unix nanoseconds
+	lastLine atomic.Int64
 }
 
+// maximum time to wait before trying again to create the logger of a VM
+const MAX_LOGGER_RETRY_DELAY = 5 * time.Minute
+
+// maximum length of a line read from a monitoring command, unless the record
+// size is greater; longer lines are cut
+const MAX_LINE_BYTES = 1024 * 1024
+
+// minimum interval between the warnings about a monitoring command that keeps failing
+const RETRY_WARNING_INTERVAL = 5 * time.Minute
+
+// minimum interval between the warnings about the lines dropped by the rate limit
+const RATE_LIMIT_WARNING_INTERVAL = time.Minute
+
+// reasons reported by the stop markers
+const STOP_REASON_REMOVED = "vm_removed"
+const STOP_REASON_SHUTDOWN = "shutdown"
+
+// returned when a monitoring command is killed because it produced no output
+var errMonitorIdle = errors.New("monitoring command idle for too long")
+
+// returned when a monitoring command is killed because it ran for MonitorMaxLifetime
+var errMonitorRecycled = errors.New("monitoring command recycled")
+
 // map of VMID to VM information
 type VMs map[int]*VM
 
 // object used to interact with a Proxmox instance
 type Pve struct {
-	cfg        *config.Config
-	knownVMs   VMs
+	// root context; once cancelled, the monitoring processes are stopped
+	ctx context.Context
+	cfg *config.Config
+	// hostname of the PVE node
+	node string
+	// protect knownVMs, hostVM, stopped and the mutable fields of the VMs
+	mu       sync.Mutex
+	knownVMs VMs
+	hostVM   *VM
+	// set by Stop: a refresh still running doesn't monitor more VMs
+	stopped    bool
 	ticker     *time.Ticker
 	quitTicker *chan bool
+	// pending refresh requests; a single one is kept, to coalesce bursts
+	refreshReq chan struct{}
+	// serialize the refreshes of the list of VMs
+	refreshMu sync.Mutex
+	// completion time of the last refresh; protected by mu
+	lastRefresh time.Time
+	// return the configuration of a VM; replaceable for testing
+	readConfig func(id int) (string, error)
+	tagsMu     sync.Mutex
+	tagsCache  map[int][]string
+	// run a command and return its output; replaceable for testing
+	runList func(name string, args ...string) ([]byte, error)
+	// return the containers running inside an LXC; replaceable to use another discovery
+	listNested func(vm *VM) ([]string, error)
+	// create the commands reading the journal of the stopped LXCs; replaceable for testing
+	historyCmd func(ctx context.Context, name string, args ...string) *exec.Cmd
+	// open the standard output of a monitoring command; replaceable for testing
+	stdoutPipe func(cmd *exec.Cmd) (io.ReadCloser, error)
+	// stop sending the history of the stopped LXCs, and closed once stopped
+	historyCancel context.CancelFunc
+	historyDone   chan struct{}
+	// return the resource pool of every VM; replaceable for testing
+	readPools  func() (map[int]string, error)
+	poolsMu    sync.Mutex
+	poolsCache map[int]string
+	poolsRead  time.Time
+	// remove collectMetrics from the functions updating the metrics
+	stopCollecting func()
+	// series of the VMs set by the last collection, as metric name, VM type and
+	// ID, so that the ones of the other instances are left alone; protected by metricsMu
+	metricsMu sync.Mutex
+	vmSeries  map[[3]string]bool
+	// exporters shared by the loggers of the VMs, with OtlpSharedExporter
+	sharedExporters *ologgers.SharedExporters
+	// attributes read from the attributes file, added to the resource of the loggers
+	fileAttrsMu sync.Mutex
+	fileAttrs   map[string]string
+	// minimum interval between the warnings about a failing monitoring command; replaceable for testing
+	retryWarningInterval time.Duration
+	// minimum interval between the warnings about the rate limit; replaceable for testing
+	rateLimitWarningInterval time.Duration
+	// file where TestVM writes the records; replaceable for testing
+	testVMOutput string
+}
+
+func init() {
+	metrics.Register("pve2otelcol_up", metrics.GAUGE, "Whether the monitoring is running.")
+	metrics.Register("pve2otelcol_last_refresh_timestamp_seconds", metrics.GAUGE,
+		"Completion time of the last refresh of the list of VMs, in seconds since the epoch.")
+	metrics.Register("pve2otelcol_batch_max_queue_size", metrics.GAUGE,
+		"Maximum number of records queued by the batch processor of each VM.")
+	metrics.Register("pve2otelcol_batch_buffer_size", metrics.GAUGE,
+		"Number of batches buffered by the batch processor of each VM.")
+	metrics.Register("pve2otelcol_batch_max_batch_size", metrics.GAUGE,
+		"Maximum number of records in a batch.")
+	metrics.Register("pve2otelcol_batch_queue_depth", metrics.GAUGE,
+		"Number of records of a VM accepted and not yet exported.")
+	metrics.Register("pve2otelcol_panics_total", metrics.COUNTER,
+		"Number of panics recovered while refreshing or monitoring the VMs.")
+	metrics.Register("pve2otelcol_vm_restarts_total", metrics.COUNTER,
+		"Number of times the monitoring command of a VM was restarted.")
 }
 
 // return a Pve instance.
-func New(cfg *config.Config) *Pve {
+func New(ctx context.Context, cfg *config.Config) *Pve {
 	pve := Pve{
-		cfg:      cfg,
-		knownVMs: VMs{},
+		ctx:             ctx,
+		cfg:             cfg,
+		node:            nodeName(cfg.NodeNameSource, PVE_MEMBERS_FILE),
+		knownVMs:        VMs{},
+		refreshReq:      make(chan struct{}, 1),
+		readConfig:      pctConfig,
+		tagsCache:       map[int][]string{},
+		readPools:       pveshPools,
+		runList:         execOutput,
+		historyCmd:      exec.CommandContext,
+		stdoutPipe:      (*exec.Cmd).StdoutPipe,
+		poolsCache:      map[int]string{},
+		sharedExporters: ologgers.NewSharedExporters(),
 	}
+	pve.listNested = pve.nestedContainers
+	pve.retryWarningInterval = RETRY_WARNING_INTERVAL
+	pve.rateLimitWarningInterval = RATE_LIMIT_WARNING_INTERVAL
+	pve.testVMOutput = "/dev/stdout"
+	metrics.Set("pve2otelcol_batch_max_queue_size", float64(cfg.OtlpBatchMaxQueueSize))
+	metrics.Set("pve2otelcol_batch_buffer_size", float64(cfg.OtlpBatchBufferSize))
+	metrics.Set("pve2otelcol_batch_max_batch_size", float64(cfg.BatchMaxBatchSize()))
+	pve.stopCollecting = metrics.OnCollect(pve.collectMetrics)
 	return &pve
 }
 
-// execute the command to get and parse logs from a VM
+// additional command following the logs of a VM
+type LogSource struct {
+	Name string
+	Cmd  string
+	Args []string
+}
+
+// return the commands following the logs of a VM: the monitoring command
+// first, then the additional sources
+func (vm *VM) logSources() []LogSource {
+	sources := []LogSource{{Name: config.JOURNAL_LOG_SOURCE, Cmd: vm.MonitorCmd, Args: vm.MonitorArgs}}
+	return append(sources, vm.ExtraSources...)
+}
+
+// execute the commands to get and parse logs from a VM; if any of them exits,
+// the others are stopped too, so that they are restarted together
 func (p *Pve) runVMMonitoring(vm *VM, ctx context.Context, finished chan error) {
-	cmd := exec.CommandContext(ctx, vm.MonitorCmd, vm.MonitorArgs...)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		slog.Error(fmt.Sprintf("failure opening standard output of %s/%d: %v", vm.Type, vm.Id, err))
-		finished <- err
-		return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type process struct {
+		source LogSource
+		cmd    *exec.Cmd
+		stdout io.Reader
+		stderr *stderrLogger
 	}
-	err = cmd.Start()
-	if err != nil {
-		slog.Error(fmt.Sprintf("failure starting monitoring command of %s/%d: %v", vm.Type, vm.Id, err))
-		finished <- err
-		return
+	processes := []process{}
+	stopAll := func() {
+		cancel()
+		for _, proc := range processes {
+			proc.cmd.Wait()
+		}
 	}
+	for _, source := range slices.Concat(vm.logSources(), p.nestedSources(vm)) {
+		cmd := exec.CommandContext(ctx, source.Cmd, source.Args...)
+		// once cancelled, give the command some time to close its output
+		cmd.WaitDelay = time.Duration(p.cfg.DrainTimeout) * time.Second
+		// errors like a missing unit are only reported on the standard error
+		stderr := &stderrLogger{vm: vm}
+		cmd.Stderr = stderr
+		stdout, err := p.stdoutPipe(cmd)
+		if err != nil {
+			slog.Error("failure opening standard output", "vm_type", vm.Type, "vm_id", vm.Id, "err", err)
+			stopAll()
+			finished <- err
+			return
+		}
+		err = cmd.Start()
+		if err != nil {
+			slog.Error("failure starting monitoring command", "vm_type", vm.Type, "vm_id", vm.Id,
+				"source", source.Name, "err", err)
+			stopAll()
+			finished <- err
+			return
+		}
+		processes = append(processes, process{source: source, cmd: cmd, stdout: stdout, stderr: stderr})
+	}
+	limiter := newRateLimiter(p.cfg.VMRateLimit(vm.Id))
+	var idle atomic.Bool
+	var watchdog *time.Timer
+	idleTimeout := time.Duration(p.cfg.MonitorIdleTimeout) * time.Second
+	if idleTimeout > 0 {
+		// a follower can get stuck without exiting: kill it when it's quiet for too long
+		watchdog = time.AfterFunc(idleTimeout, func() {
+			slog.Warn("no output from the monitoring command; restarting it", "vm_type", vm.Type, "vm_id", vm.Id,
+				"idle_timeout_seconds", p.cfg.MonitorIdleTimeout)
+			idle.Store(true)
+			cancel()
+		})
+		defer watchdog.Stop()
+	}
+	var recycled atomic.Bool
+	if p.cfg.MonitorMaxLifetime > 0 {
+		lifetime := time.AfterFunc(time.Duration(p.cfg.MonitorMaxLifetime)*time.Second, func() {
+			slog.Debug("monitoring command reached its maximum lifetime; restarting it", "vm_type", vm.Type,
+				"vm_id", vm.Id)
+			recycled.Store(true)
+			cancel()
+		})
+		defer lifetime.Stop()
+	}
+	errs := make(chan error, len(processes))
+	for _, proc := range processes {
+		go func() {
+			var attrs []otellog.KeyValue
+			if len(processes) > 1 {
+				attrs = []otellog.KeyValue{{Key: "log.source", Value: otellog.StringValue(proc.source.Name)}}
+			}
+			func() {
+				// a panic processing a line stops the commands, that are restarted
+				defer func() {
+					if r := recover(); r != nil {
+						p.logPanic(r, "vm_type", vm.Type, "vm_id", vm.Id)
+					}
+				}()
+				p.scanOutput(ctx, vm, proc.stdout, limiter, watchdog, idleTimeout, attrs)
+			}()
+			// the other commands are restarted along with this one
+			cancel()
+			err := proc.cmd.Wait()
+			proc.stderr.Flush()
+			errs <- err
+		}()
+	}
+	// the first command to exit is the one that stopped the others
+	err := <-errs
+	for range processes[1:] {
+		<-errs
+	}
+	if !p.isRunning(vm) || p.ctx.Err() != nil {
+		err = nil
+	} else if idle.Load() {
+		err = errMonitorIdle
+	} else if recycled.Load() {
+		err = errMonitorRecycled
+	} else {
+		slog.Error("failure running monitoring command", "vm_type", vm.Type, "vm_id", vm.Id, "err", err)
+	}
+	finished <- err
+}
+
+// read a line, without its end, keeping at most max bytes of it and without
+// splitting a multi-byte character; the rest of a longer line is discarded,
+// and the second value tells whether the line was cut
+func readLine(r *bufio.Reader, max int) (string, bool, error) {
+	line := []byte{}
+	cut := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+		if keep := min(len(chunk), max-len(line)); keep < len(chunk) {
+			line = append(line, chunk[:keep]...)
+			cut = true
+		} else {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && len(line) == 0 && !cut {
+			return "", false, err
+		}
+		// drop the bytes of a character split by the cut
+		for n := 0; cut && n < utf8.UTFMax && len(line) > 0; n++ {
+			if r, size := utf8.DecodeLastRune(line); r != utf8.RuneError || size > 1 {
+				break
+			}
+			line = line[:len(line)-1]
+		}
+		return string(bytes.TrimSuffix(line, []byte("\r"))), cut, nil
+	}
+}
+
+// read the lines of the output of a monitoring command, sending them to the
+// logger of a VM along with the given attributes
+func (p *Pve) scanOutput(ctx context.Context, vm *VM, stdout io.Reader, limiter *rateLimiter,
+	watchdog *time.Timer, idleTimeout time.Duration, sourceAttrs []otellog.KeyValue) {
 	seenError := false
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		line := scanner.Text()
-		var jData interface{}
-		err := json.Unmarshal([]byte(line), &jData)
+	seenLongLine := false
+	dropped := 0
+	// lines dropped by the rate limit since the last warning, logged at most
+	// once per rateLimitWarningInterval
+	var lastLimitWarning time.Time
+	limitDrops := 0
+	// a line is never cut below the size of a record
+	maxLine := max(MAX_LINE_BYTES, p.cfg.MaxRecordBytes)
+	reader := bufio.NewReader(stdout)
+	for {
+		line, cut, err := readLine(reader, maxLine)
 		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				slog.Warn("failure reading the output of the monitoring command", "vm_type", vm.Type,
+					"vm_id", vm.Id, "err", err)
+			}
+			return
+		}
+		vm.lastLine.Store(time.Now().UnixNano())
+		if watchdog != nil {
+			watchdog.Reset(idleTimeout)
+		}
+		if limiter != nil && !limiter.Allow() {
+			dropped++
+			limitDrops++
+			if lastLimitWarning.IsZero() || time.Since(lastLimitWarning) >= p.rateLimitWarningInterval {
+				slog.Warn("rate limit exceeded; dropping log lines", "vm_type", vm.Type, "vm_id", vm.Id,
+					"dropped", limitDrops)
+				lastLimitWarning, limitDrops = time.Now(), 0
+			}
+			continue
+		}
+		attrs := slices.Clone(sourceAttrs)
+		if dropped > 0 {
+			// report the number of lines dropped since the last emitted record
+			attrs = append(attrs, otellog.KeyValue{
+				Key:   "dropped",
+				Value: otellog.IntValue(dropped),
+			})
+			dropped = 0
+		}
+		if p.cfg.Backpressure {
+			// stop reading while the export queue is full, instead of dropping
+			// records; the command is not idle in the meantime
+			if watchdog != nil {
+				watchdog.Stop()
+			}
+			vm.Logger.WaitQueue(ctx)
+			if watchdog != nil {
+				watchdog.Reset(idleTimeout)
+			}
+		}
+		if cut {
+			if !seenLongLine {
+				slog.Warn("line too long; it was cut (further occurrences are not reported)",
+					"vm_type", vm.Type, "vm_id", vm.Id, "max_bytes", maxLine)
+				seenLongLine = true
+			}
+			attrs = append(attrs, otellog.KeyValue{
+				Key:   "truncated",
+				Value: otellog.BoolValue(true),
+			})
+		}
+		if p.cfg.KeepRawLine {
+			attrs = append(attrs, otellog.KeyValue{
+				Key:   "raw",
+				Value: otellog.StringValue(line),
+			})
+		}
+		var jData interface{}
+		if err := json.Unmarshal([]byte(line), &jData); err != nil {
 			if !seenError {
-				slog.Warn(fmt.Sprintf("failure parsing JSON for %s/%d; some logs will be sent as strings: %s",
-					vm.Type, vm.Id, err))
+				slog.Warn("failure parsing JSON; some logs will be sent as strings",
+					"vm_type", vm.Type, "vm_id", vm.Id, "err", err)
 				seenError = true
 			}
-			vm.Logger.Log(line)
+			vm.Logger.Log(line, attrs...)
 		} else {
-			vm.Logger.Log(jData)
+			vm.Logger.Log(jData, attrs...)
 		}
 	}
-	err = cmd.Wait()
-	if !vm.Running {
-		err = nil
-	} else {
-		slog.Error(fmt.Sprintf("failure running monitoring command of %s/%d: %v", vm.Type, vm.Id, err))
-	}
-	finished <- err
 }
 
 // run a command inside a VM and parse its output that will be sent to a OTLP collector
 func (p *Pve) RunKeptAliveProcess(vm *VM, forever bool) error {
+	p.mu.Lock()
+	vm.Running = true
+	gen, done, stop := p.newMonitorGenLocked(vm)
+	p.mu.Unlock()
+	return p.monitorLoop(vm, forever, gen, done, stop)
+}
+
+// take ownership of the monitoring of a VM, returning the generation of the new
+// monitoring loop and the channel it has to close on exit; the lock must be held
+func (p *Pve) newMonitorGenLocked(vm *VM) (int, chan struct{}, chan struct{}) {
+	vm.stopMonitorLocked()
+	vm.monitorGen++
+	vm.monitorDone = make(chan struct{})
+	vm.monitorStop = make(chan struct{})
+	return vm.monitorGen, vm.monitorDone, vm.monitorStop
+}
+
+// tell the latest monitoring loop of a VM that it no longer owns it; the lock must be held
+func (vm *VM) stopMonitorLocked() {
+	if vm.monitorStop != nil {
+		close(vm.monitorStop)
+		vm.monitorStop = nil
+	}
+}
+
+// tell whether the monitoring loop of the given generation still owns the VM;
+// the lock must be held
+func (p *Pve) ownsMonitorLocked(vm *VM, gen int) bool {
+	return vm.Running && vm.monitorGen == gen
+}
+
+// keep the monitoring command of a VM running, as long as this loop owns the VM
+func (p *Pve) monitorLoop(vm *VM, forever bool, gen int, done chan struct{}, stop chan struct{}) error {
+	defer close(done)
 	if vm.MonitorCmd == "" {
 		return errors.New("missing monitoring command")
 	}
 	strCmd := fmt.Sprintf("%s %s", vm.MonitorCmd, strings.Join(vm.MonitorArgs, " "))
-	slog.Debug(fmt.Sprintf("run monitoring process '%s'", strCmd))
+	slog.Debug("run monitoring process", "cmd", strCmd)
 	if p.cfg.DryRun {
-		slog.Info(fmt.Sprintf("DRY RUN: %s", strCmd))
+		slog.Info("DRY RUN", "cmd", strCmd)
 		return nil
 	}
 	round := 0
+	// unlike round, it is not reset by idle restarts
+	runs := 0
+	// failures since the last warning, logged at most once per retryWarningInterval
+	var lastWarning time.Time
+	failures := 0
 	for {
-		if round >= p.cfg.CmdRetryTimes && !forever {
-			slog.Error(fmt.Sprintf("monitoring of %s/%d failed %d times: giving up", vm.Type, vm.Id, round))
+		// the command is always run once, then restarted up to CmdRetryTimes times
+		if round > p.cfg.CmdRetryTimes && !forever {
+			slog.Error("monitoring failed too many times: giving up", "vm_type", vm.Type, "vm_id", vm.Id, "runs", round)
+			// the VM is no longer monitored: the following refreshes can start it again
+			p.mu.Lock()
+			if p.ownsMonitorLocked(vm, gen) {
+				vm.Running = false
+				vm.StopProcess = nil
+				vm.stopMonitorLocked()
+			}
+			p.mu.Unlock()
 			break
 		}
 		if round > 0 {
 			// the process failed to run: try again after a delay
-			slog.Warn(fmt.Sprintf("command '%s' failed; trying again in %d second(s) (run %d of %d)",
-				strCmd, p.cfg.CmdRetryDelay, round, p.cfg.CmdRetryTimes))
-			time.Sleep(time.Duration(p.cfg.CmdRetryDelay) * time.Second)
+			failures++
+			if lastWarning.IsZero() {
+				slog.Warn("monitoring command failed; trying again", "cmd", strCmd,
+					"delay_seconds", p.cfg.CmdRetryDelay, "run", round, "max_runs", p.cfg.CmdRetryTimes+1)
+				lastWarning, failures = time.Now(), 0
+			} else if time.Since(lastWarning) >= p.retryWarningInterval {
+				slog.Warn("monitoring command still failing", "cmd", strCmd, "failures", failures,
+					"since", lastWarning, "run", round)
+				lastWarning, failures = time.Now(), 0
+			} else {
+				slog.Debug("monitoring command failed; trying again", "cmd", strCmd, "run", round)
+			}
+			select {
+			case <-p.ctx.Done():
+			case <-stop:
+			case <-time.After(time.Duration(p.cfg.CmdRetryDelay) * time.Second):
+			}
 		}
 		round++
 		finished := make(chan error, 1)
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(p.ctx)
+		p.mu.Lock()
+		if !p.ownsMonitorLocked(vm, gen) || p.ctx.Err() != nil {
+			// stopped or restarted while waiting to retry, or shutting down
+			p.mu.Unlock()
+			cancel()
+			break
+		}
 		if vm.StopProcess != nil {
-			slog.Debug(fmt.Sprintf("stopping existing monitoring process for VM %s/%d", vm.Type, vm.Id))
+			slog.Debug("stopping existing monitoring process", "vm_type", vm.Type, "vm_id", vm.Id)
 			vm.StopProcess()
 		}
+		if runs > 0 {
+			vm.RestartCount++
+		}
+		runs++
 		// store the cancel function so that we can stop it from outside
 		vm.StopProcess = cancel
-		go p.runVMMonitoring(vm, ctx, finished)
+		p.mu.Unlock()
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					p.logPanic(r, "vm_type", vm.Type, "vm_id", vm.Id)
+					finished <- fmt.Errorf("panic: %v", r)
+				}
+			}()
+			p.runVMMonitoring(vm, ctx, finished)
+		}()
 		err := <-finished
-		if !vm.Running {
-			break
-		}
-		if err != nil {
+		p.mu.Lock()
+		owned := p.ownsMonitorLocked(vm, gen) && p.ctx.Err() == nil
+		if owned && err != nil && !errors.Is(err, errMonitorRecycled) {
 			vm.LastError = &err
 		}
+		p.mu.Unlock()
+		if errors.Is(err, errMonitorIdle) || errors.Is(err, errMonitorRecycled) {
+			// restart right away, without counting it as a failure
+			round = 0
+		}
+		if !owned {
+			break
+		}
 	}
 	return nil
 }
 
-// monitor Proxmox itself
-func (p *Pve) pveSelfMonitoring() {
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = "localhost"
-	}
-	slog.Debug(fmt.Sprintf("start PVE self-monitoring for node %s", hostname))
-	vm := VM{
+// tell whether the monitoring of a VM is expected to be running
+func (p *Pve) isRunning(vm *VM) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return vm.Running
+}
+
+// return the VM following the journal of the PVE node
+func (p *Pve) newHostVM() *VM {
+	vm := &VM{
 		Id:         0,
-		Name:       hostname,
+		Name:       p.node,
 		Type:       "pve",
 		MonitorCmd: "journalctl",
 		MonitorArgs: []string{
@@ -157,105 +591,229 @@ func (p *Pve) pveSelfMonitoring() {
 			"json",
 		},
 	}
-	logger, err := ologgers.New(p.cfg, ologgers.OLoggerOptions{
-		ServiceName: vm.Name,
-		ServiceId:   fmt.Sprintf("%s/%d", vm.Type, vm.Id),
-	})
+	// follow only the selected units, if any, instead of the whole journal
+	for _, unit := range p.cfg.PveUnits {
+		vm.MonitorArgs = append(vm.MonitorArgs, "--unit", unit)
+	}
+	return vm
+}
+
+// return the configuration of the logger of the PVE node; journalctl can't
+// exclude units: the entries of the excluded ones are dropped by log rules,
+// checked before the configured ones
+func (p *Pve) hostConfig() *config.Config {
+	if len(p.cfg.PveExcludeUnits) == 0 {
+		return p.cfg
+	}
+	hostCfg := *p.cfg
+	rules := []config.LogRule{}
+	for _, unit := range p.cfg.PveExcludeUnits {
+		rules = append(rules, config.LogRule{Field: "_SYSTEMD_UNIT", Value: unit, Action: config.RULE_DROP})
+	}
+	hostCfg.LogRules = slices.Concat(rules, p.cfg.LogRules)
+	return &hostCfg
+}
+
+// monitor Proxmox itself
+func (p *Pve) pveSelfMonitoring() error {
+	slog.Debug("start PVE self-monitoring", "node", p.node)
+	vm := p.newHostVM()
+	// the collector may not be reachable yet, when the node is booting
+	logger, err := ologgers.NewWithRetry(p.ctx, p.hostConfig(), p.loggerOptions(vm))
 	if err != nil {
-		slog.Warn(fmt.Sprintf("unable to create a logger for %s/%d", vm.Type, vm.Id))
+		slog.Error("unable to create a logger", "vm_type", vm.Type, "vm_id", vm.Id, "err", err)
+		return err
 	}
 	vm.Logger = logger
-	go p.RunKeptAliveProcess(&vm, true)
+	p.mu.Lock()
+	p.hostVM = vm
+	vm.Running = true
+	gen, done, stop := p.newMonitorGenLocked(vm)
+	p.mu.Unlock()
+	go p.monitorLoop(vm, true, gen, done, stop)
+	return nil
 }
 
-// check id against the include and exclude lists
-func (p *Pve) checkLists(id int) bool {
-	if len(p.cfg.MonitorExclude) > 0 && slices.Contains(p.cfg.MonitorExclude, id) {
-		return false
+// return the options of the logger of a VM
+func (p *Pve) loggerOptions(vm *VM) ologgers.OLoggerOptions {
+	opts := ologgers.OLoggerOptions{
+		Node:            p.node,
+		ServiceName:     p.serviceName(vm),
+		ServiceId:       fmt.Sprintf("%s/%d", vm.Type, vm.Id),
+		VMId:            vm.Id,
+		VMType:          vm.Type,
+		MinSeverity:     p.cfg.VMMinSeverity(vm.Id),
+		FileAttrs:       p.getFileAttrs(),
+		SharedExporters: p.sharedExporters,
+	}
+	if vm.Type != "pve" {
+		opts.Pool = p.vmPool(vm)
+	}
+	return opts
+}
+
+// Replace the attributes added to the resource of the loggers created from now
+// on, e.g. read from the attributes file
+func (p *Pve) SetFileAttrs(attrs map[string]string) {
+	p.fileAttrsMu.Lock()
+	defer p.fileAttrsMu.Unlock()
+	p.fileAttrs = attrs
+}
+
+// return the attributes added to the resource of the loggers
+func (p *Pve) getFileAttrs() map[string]string {
+	p.fileAttrsMu.Lock()
+	defer p.fileAttrsMu.Unlock()
+	return p.fileAttrs
+}
+
+// return the service name of the logs of a VM, expanding the configured template
+func (p *Pve) serviceName(vm *VM) string {
+	strId := strconv.Itoa(vm.Id)
+	name := vm.Name
+	if name == "" {
+		name = strId
+	}
+	// the template is validated at startup
+	serviceName, _ := config.ExpandTemplate(p.cfg.ServiceNameTemplate, map[string]string{
+		"id":   strId,
+		"name": name,
+		"type": vm.Type,
+		"node": p.node,
+	})
+	return p.cfg.ServiceNamePrefix + serviceName
+}
+
+// check whether a VM has to be monitored
+func (p *Pve) ShouldMonitor(vm *VM) bool {
+	return p.checkLists(vm) && p.checkTags(vm)
+}
+
+// check the tags of a VM against the required ones; at least one must match
+func (p *Pve) checkTags(vm *VM) bool {
+	if len(p.cfg.MonitorTags) == 0 {
+		return true
+	}
+	for _, tag := range p.vmTags(vm) {
+		if slices.Contains(p.cfg.MonitorTags, tag) {
+			return true
+		}
 	}
-	if len(p.cfg.MonitorInclude) > 0 && !slices.Contains(p.cfg.MonitorInclude, id) {
+	return false
+}
+
+// check id and name against the include and exclude lists.
+// A match in any exclude list (by ID or by name) always wins; then, if any
+// include list is set, the VM must match at least one of them.
+func (p *Pve) checkLists(vm *VM) bool {
+	if slices.Contains(p.cfg.MonitorExclude, vm.Id) || matchName(p.cfg.ExcludeNames, vm.Name) {
 		return false
 	}
-	return true
+	if len(p.cfg.MonitorInclude) == 0 && len(p.cfg.IncludeNames) == 0 {
+		return true
+	}
+	return slices.Contains(p.cfg.MonitorInclude, vm.Id) || matchName(p.cfg.IncludeNames, vm.Name)
+}
+
+// check whether name matches at least one of the glob patterns
+func matchName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // return a map containing the currently running LXCs
 func (p *Pve) CurrentLXCs() VMs {
 	slog.Debug("updating list of running LXCs")
+	vms, _ := p.listLXCs(true)
+	return vms
+}
+
+// run a command listing the VMs, retrying it up to DiscoveryRetries times on failure
+func (p *Pve) runListCommand(name string, args ...string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		out, err := p.runList(name, args...)
+		if err == nil || attempt >= p.cfg.DiscoveryRetries || p.ctx.Err() != nil {
+			return out, err
+		}
+		slog.Debug("failure listing the VMs; trying again", "cmd", name, "attempt", attempt+1, "err", err)
+		select {
+		case <-p.ctx.Done():
+		case <-time.After(time.Duration(p.cfg.DiscoveryRetryDelay) * time.Second):
+		}
+	}
+}
+
+// return a map containing the running LXCs or, if running is false, the stopped ones;
+// on failure, an empty map is returned with the error
+func (p *Pve) listLXCs(running bool) (VMs, error) {
 	vms := VMs{}
-	out, err := exec.Command("pct", "list").Output()
+	out, err := p.runListCommand("pct", "list")
 	if err != nil {
-		slog.Error(fmt.Sprintf("failure listing LXCs: %v", err))
-		return vms
+		slog.Error("failure listing LXCs", "err", err)
+		return vms, err
 	}
-	outStr := string(out)
-	for _, line := range strings.Split(outStr, "\n") {
-		items := strings.Fields(line)
-		if len(items) < 3 {
-			continue
-		}
-		strId := items[0]
-		state := items[1]
-		name := items[2]
-		if state != "running" {
+	rows, err := parseTable(string(out), "vmid", "name", "status")
+	if err != nil {
+		slog.Error("failure parsing the list of LXCs", "err", err)
+		return vms, err
+	}
+	for _, row := range rows {
+		strId := row["vmid"]
+		name := row["name"]
+		if (row["status"] == "running") != running {
 			continue
 		}
 		id, err := strconv.Atoi(strId)
 		if err != nil {
 			continue
 		}
-		if !p.checkLists(id) {
-			continue
+		// the template is validated at startup
+		values := map[string]string{"id": strId, "name": name}
+		args, _ := config.ExpandCmdTemplate(p.cfg.LXCMonitorCmd, values)
+		vm := &VM{
+			Id:          id,
+			Name:        name,
+			Type:        "lxc",
+			MonitorCmd:  args[0],
+			MonitorArgs: slices.Concat(args[1:], p.cfg.JournalFilterArgs()),
 		}
-		vms[id] = &VM{
-			Id:         id,
-			Name:       name,
-			Type:       "lxc",
-			MonitorCmd: "pct",
-			MonitorArgs: []string{
-				"exec",
-				strId,
-				"--",
-				"journalctl",
-				"--lines",
-				"0",
-				"--follow",
-				"--output",
-				"json",
-			},
+		for _, source := range p.cfg.LXCLogSources {
+			args, _ := config.ExpandCmdTemplate(source.Cmd, values)
+			vm.ExtraSources = append(vm.ExtraSources, LogSource{Name: source.Name, Cmd: args[0], Args: args[1:]})
 		}
+		vms[id] = vm
 	}
-	return vms
+	return vms, nil
 }
 
 // return a map containing the currently running KVMs
 func (p *Pve) CurrentKVMs() VMs {
 	slog.Debug("updating list of running KVMs")
 	vms := VMs{}
-	out, err := exec.Command("qm", "list").Output()
+	out, err := p.runListCommand("qm", "list")
 	if err != nil {
-		slog.Error(fmt.Sprintf("failure listing KVMs: %v", err))
+		slog.Error("failure listing KVMs", "err", err)
 		return vms
 	}
-	outStr := string(out)
-	for _, line := range strings.Split(outStr, "\n") {
-		items := strings.Fields(line)
-		if len(items) < 3 {
-			continue
-		}
-		strId := items[0]
-		name := items[1]
-		state := items[2]
-		if state != "running" {
+	rows, err := parseTable(string(out), "vmid", "name", "status")
+	if err != nil {
+		slog.Error("failure parsing the list of KVMs", "err", err)
+		return vms
+	}
+	for _, row := range rows {
+		strId := row["vmid"]
+		name := row["name"]
+		if row["status"] != "running" {
 			continue
 		}
 		id, err := strconv.Atoi(strId)
 		if err != nil {
 			continue
 		}
-		if !p.checkLists(id) {
-			continue
-		}
 		vms[id] = &VM{
 			Id:         id,
 			Name:       name,
@@ -277,11 +835,24 @@ func (p *Pve) CurrentKVMs() VMs {
 	return vms
 }
 
-// return a map containing the currently running LXCs and KVMs
-func (p *Pve) CurrentVMs() VMs {
+// return a map containing the currently running LXCs and KVMs, including
+// the ones excluded from monitoring
+func (p *Pve) DiscoverVMs() VMs {
+	vms, _ := p.discoverVMs()
+	return vms
+}
+
+// return a map containing the currently running LXCs and KVMs, and an
+// error if any of them couldn't be listed
+func (p *Pve) discoverVMs() (VMs, error) {
 	vms := VMs{}
 	if !p.cfg.SkipLXCs {
-		maps.Copy(vms, p.CurrentLXCs())
+		slog.Debug("updating list of running LXCs")
+		lxcs, err := p.listLXCs(true)
+		if err != nil {
+			return vms, err
+		}
+		maps.Copy(vms, lxcs)
 	}
 	/*
 		// right now KVMs are not monitored, since the qm exec command
@@ -291,120 +862,521 @@ func (p *Pve) CurrentVMs() VMs {
 			maps.Copy(vms, p.CurrentKVMs())
 		}
 	*/
+	return vms, nil
+}
+
+// return a map containing the currently running LXCs and KVMs that have to be monitored
+func (p *Pve) CurrentVMs() VMs {
+	return p.filterVMs(p.DiscoverVMs())
+}
+
+// remove from the given map the VMs that must not be monitored, and return it
+func (p *Pve) filterVMs(vms VMs) VMs {
+	p.pruneTags(vms)
+	maps.DeleteFunc(vms, func(id int, vm *VM) bool {
+		return !p.ShouldMonitor(vm)
+	})
 	return vms
 }
 
-// add the received VM to the list of known VMs, creating its logger service if needed
+// print a table of the discovered VMs, reporting whether they would be monitored
+func (p *Pve) ListVMs(w io.Writer) {
+	vms := p.DiscoverVMs()
+	ids := []int{}
+	for id := range vms {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tTYPE\tMONITOR")
+	for _, id := range ids {
+		vm := vms[id]
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", vm.Id, vm.Name, vm.Type, p.ShouldMonitor(vm))
+	}
+	tw.Flush()
+}
+
+// add the received VM to the list of known VMs, creating its logger service if needed;
+// the creation of a logger that failed is retried at the following refreshes, with
+// an increasing delay. The known VM is returned
 func (p *Pve) UpdateVM(vm *VM) *VM {
-	if _, ok := p.knownVMs[vm.Id]; !ok {
-		slog.Debug(fmt.Sprintf("adding newly found VM %s/%d", vm.Type, vm.Id))
-		logger, err := ologgers.New(p.cfg, ologgers.OLoggerOptions{
-			ServiceName: vm.Name,
-			ServiceId:   fmt.Sprintf("%s/%d", vm.Type, vm.Id),
-		})
-		if err != nil {
-			slog.Warn(fmt.Sprintf("unable to create a logger for %s/%d", vm.Type, vm.Id))
+	p.mu.Lock()
+	known, ok := p.knownVMs[vm.Id]
+	retry := ok && known.Logger == nil && !time.Now().Before(known.nextLoggerTry)
+	p.mu.Unlock()
+	if ok && !retry {
+		return known
+	}
+	if ok {
+		vm = known
+		slog.Debug("retrying to create the logger", "vm_type", vm.Type, "vm_id", vm.Id)
+	} else {
+		slog.Debug("adding newly found VM", "vm_type", vm.Type, "vm_id", vm.Id)
+	}
+	logger, err := ologgers.New(p.ctx, p.cfg, p.loggerOptions(vm))
+	// store the VM in the list of monitored VMs
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		if err == nil {
+			logger.Shutdown(context.Background())
 		}
+		return vm
+	}
+	if err != nil {
+		vm.loggerFailures++
+		delay := loggerRetryDelay(vm.loggerFailures)
+		vm.nextLoggerTry = time.Now().Add(delay)
+		slog.Warn("unable to create a logger", "vm_type", vm.Type, "vm_id", vm.Id,
+			"retry_in_seconds", delay.Seconds(), "err", err)
+	} else {
 		vm.Logger = logger
-		// store the VM in the list of monitored VMs
-		p.knownVMs[vm.Id] = vm
+		vm.loggerFailures = 0
 	}
+	p.knownVMs[vm.Id] = vm
+	p.mu.Unlock()
+	p.checkMemoryBudget()
 	return vm
 }
 
+// return the time to wait before trying again to create a logger, after
+// the given number of consecutive failures
+func loggerRetryDelay(failures int) time.Duration {
+	return min(time.Duration(1<<min(failures-1, 16))*time.Second, MAX_LOGGER_RETRY_DELAY)
+}
+
+// warn if the records that can be held in memory by all the loggers exceed the configured budget
+func (p *Pve) checkMemoryBudget() {
+	if p.cfg.OtlpBatchMemoryBudget == 0 {
+		return
+	}
+	loggers := len(p.allLoggers())
+	if total := loggers * p.cfg.OtlpBatchCapacity(); total > p.cfg.OtlpBatchMemoryBudget {
+		slog.Warn("the batch processors can hold more records than the memory budget",
+			"loggers", loggers, "records", total, "budget", p.cfg.OtlpBatchMemoryBudget)
+	}
+}
+
+// update the metrics of the monitored VMs
+func (p *Pve) collectMetrics() {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+	series := map[[3]string]bool{}
+	for vm, logger := range p.allLoggers() {
+		key := [3]string{"pve2otelcol_batch_queue_depth", vm.Type, strconv.Itoa(vm.Id)}
+		series[key] = true
+		metrics.Set(key[0], float64(logger.QueueDepth()), "vm_type", key[1], "vm_id", key[2])
+	}
+	for _, status := range p.Snapshot() {
+		key := [3]string{"pve2otelcol_vm_restarts_total", status.Type, strconv.Itoa(status.Id)}
+		series[key] = true
+		metrics.Set(key[0], float64(status.RestartCount), "vm_type", key[1], "vm_id", key[2])
+	}
+	// the series of the VMs no longer known
+	for key := range p.vmSeries {
+		if !series[key] {
+			metrics.Delete(key[0], "vm_type", key[1], "vm_id", key[2])
+		}
+	}
+	p.vmSeries = series
+}
+
 // run the monitoring process of a VM
 func (p *Pve) StartVMMonitoring(vm *VM) {
-	p.UpdateVM(vm)
-	if vm.Logger != nil && !vm.Running {
-		slog.Debug(fmt.Sprintf("start monitoring VM %s/%d", vm.Type, vm.Id))
+	vm = p.UpdateVM(vm)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if vm.Logger != nil && !vm.Running && !p.stopped {
+		slog.Debug("start monitoring VM", "vm_type", vm.Type, "vm_id", vm.Id)
+		// the state transition and the ownership of the new loop are atomic,
+		// so that a VM never has two live monitoring loops
 		vm.Running = true
-		go p.RunKeptAliveProcess(vm, false)
+		gen, done, stop := p.newMonitorGenLocked(vm)
+		go p.monitorLoop(vm, false, gen, done, stop)
 	}
 }
 
 // stop the monitoring process of a VM
 func (p *Pve) StopVMMonitoring(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopVMMonitoringLocked(id)
+}
+
+// stop the monitoring process of a VM; the lock must be held
+func (p *Pve) stopVMMonitoringLocked(id int) {
 	if vm, ok := p.knownVMs[id]; ok {
 		if vm.StopProcess != nil {
-			slog.Debug(fmt.Sprintf("stop monitoring VM %s/%d", vm.Type, vm.Id))
+			slog.Debug("stop monitoring VM", "vm_type", vm.Type, "vm_id", vm.Id)
 			vm.StopProcess()
 		}
 		vm.Running = false
+		vm.stopMonitorLocked()
 	}
 }
 
-// remove a VM from the list of known VMs
+// remove a VM from the list of known VMs, after its pending logs are exported
 func (p *Pve) RemoveVM(id int) {
-	vmDesc := fmt.Sprintf("%d", id)
-	if vm, ok := p.knownVMs[id]; ok {
-		vmDesc = fmt.Sprintf("%s/%d", vm.Type, id)
+	p.mu.Lock()
+	vm, ok := p.knownVMs[id]
+	if !ok {
+		p.mu.Unlock()
+		slog.Debug("remove unknown VM", "vm_id", id)
+		return
 	}
-	slog.Debug(fmt.Sprintf("remove VM %s", vmDesc))
-	p.StopVMMonitoring(id)
+	slog.Debug("remove VM", "vm_type", vm.Type, "vm_id", id)
+	p.stopVMMonitoringLocked(id)
 	delete(p.knownVMs, id)
+	done := vm.monitorDone
+	p.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.cfg.DrainTimeout)*time.Second)
+	defer cancel()
+	p.drainVM(ctx, vm, done, STOP_REASON_REMOVED)
+}
+
+// wait for the monitoring loop of a stopped VM to exit, so that the lines
+// already produced by its command are logged, then flush and shut down its logger;
+// the reason is sent in the stop marker, if enabled
+func (p *Pve) drainVM(ctx context.Context, vm *VM, done chan struct{}, reason string) error {
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Warn("timeout waiting for the monitoring process to exit", "vm_type", vm.Type, "vm_id", vm.Id)
+		}
+	}
+	if vm.Logger == nil {
+		return nil
+	}
+	if p.cfg.StopMarker {
+		vm.Logger.LogStopped(reason)
+	}
+	err := vm.Logger.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("failure shutting down logger", "vm_type", vm.Type, "vm_id", vm.Id, "err", err)
+	}
+	return err
+}
+
+// remove all the known VMs and the PVE node itself, draining them concurrently;
+// it returns when all of them are shut down or the shutdown timeout expires,
+// whichever comes first
+func (p *Pve) removeAllVMs() {
+	p.mu.Lock()
+	vms := map[*VM]chan struct{}{}
+	for id, vm := range p.knownVMs {
+		p.stopVMMonitoringLocked(id)
+		vms[vm] = vm.monitorDone
+	}
+	clear(p.knownVMs)
+	if p.hostVM != nil {
+		if p.hostVM.StopProcess != nil {
+			p.hostVM.StopProcess()
+		}
+		p.hostVM.Running = false
+		p.hostVM.stopMonitorLocked()
+		vms[p.hostVM] = p.hostVM.monitorDone
+		p.hostVM = nil
+	}
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	var resMu sync.Mutex
+	flushed := map[int]bool{}
+	var wg sync.WaitGroup
+	for vm, done := range vms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.drainVM(ctx, vm, done, STOP_REASON_SHUTDOWN)
+			resMu.Lock()
+			flushed[vm.Id] = err == nil
+			resMu.Unlock()
+		}()
+	}
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
+	select {
+	case <-allDone:
+	case <-ctx.Done():
+	}
+
+	resMu.Lock()
+	defer resMu.Unlock()
+	failed := []int{}
+	for vm := range vms {
+		if !flushed[vm.Id] {
+			failed = append(failed, vm.Id)
+		}
+	}
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		slog.Warn("some VMs were not flushed before the shutdown timeout", "vm_ids", failed)
+	}
+}
+
+// return the IDs of the known VMs
+func (p *Pve) knownIds() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := []int{}
+	for id := range p.knownVMs {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
 // refresh the map of running VMs
 func (p *Pve) RefreshVMsMonitoring() {
-	vms := p.CurrentVMs()
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	if p.ctx.Err() != nil {
+		// shutting down
+		return
+	}
+	vms, err := p.discoverVMs()
+	if err != nil {
+		// the VMs may still be running: nothing is removed until the next refresh
+		slog.Warn("failure discovering the VMs; skipping this refresh", "err", err)
+		return
+	}
+	found := len(vms)
+	vms = p.filterVMs(vms)
+	if p.LastRefresh().IsZero() {
+		p.logSummary(found, vms)
+	}
 	for _, vm := range vms {
 		p.StartVMMonitoring(vm)
 	}
 
+	// a VM is removed only after being absent for more than VMRemovalGrace
+	// consecutive refreshes, so that a quick restart doesn't churn its logger
 	remove := []int{}
+	p.mu.Lock()
 	for id, vm := range p.knownVMs {
-		if _, ok := vms[id]; !ok {
-			remove = append(remove, vm.Id)
+		if _, ok := vms[id]; ok {
+			vm.absentRefreshes = 0
+			continue
+		}
+		vm.absentRefreshes++
+		if vm.absentRefreshes > p.cfg.VMRemovalGrace {
+			remove = append(remove, id)
+		} else {
+			slog.Debug("VM not found; waiting before removing it", "vm_type", vm.Type, "vm_id", id,
+				"absent_refreshes", vm.absentRefreshes)
 		}
 	}
+	p.mu.Unlock()
+	// each removal waits up to DrainTimeout: they're run concurrently, so that
+	// the VMs stopped at once by a bulk operation don't stall the refresh
+	var wg sync.WaitGroup
 	for _, id := range remove {
-		p.RemoveVM(id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					p.logPanic(r, "during", "removal", "vm_id", id)
+				}
+			}()
+			p.RemoveVM(id)
+		}()
+	}
+	wg.Wait()
+
+	now := time.Now()
+	p.mu.Lock()
+	p.lastRefresh = now
+	p.mu.Unlock()
+	metrics.Set("pve2otelcol_last_refresh_timestamp_seconds", float64(now.Unix()))
+}
+
+// log, at the first refresh, what is going to be monitored and where logs are sent
+func (p *Pve) logSummary(found int, vms VMs) {
+	ids := []int{}
+	for id := range vms {
+		ids = append(ids, id)
 	}
+	slices.Sort(ids)
+	slog.Info("monitoring summary",
+		"vms_found", found,
+		"vms_filtered_out", found-len(vms),
+		"monitored_ids", ids,
+		"pve_node", !p.cfg.SkipPVE,
+		"exporter", p.cfg.OtlpExporter,
+		"endpoint", strings.Join(p.cfg.OtlpURLs(), ","))
 }
 
-func (p *Pve) periodicRefresh() {
-	// Run the first refresh right now
+// return the completion time of the last refresh of the list of VMs
+func (p *Pve) LastRefresh() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastRefresh
+}
+
+// ask for a refresh of the map of running VMs; requests received while
+// a refresh is pending are coalesced into a single one
+func (p *Pve) RequestRefresh() {
+	select {
+	case p.refreshReq <- struct{}{}:
+	default:
+		// a refresh is already pending
+	}
+}
+
+// log a recovered panic, with its stack trace
+func (p *Pve) logPanic(r any, args ...any) {
+	metrics.Add("pve2otelcol_panics_total", 1)
+	slog.Error("recovered from a panic", append(args, "panic", r, "stack", string(debug.Stack()))...)
+}
+
+// refresh the map of running VMs, surviving a panic
+func (p *Pve) safeRefresh() {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logPanic(r, "during", "refresh")
+		}
+	}()
 	p.RefreshVMsMonitoring()
-	if p.cfg.RefreshInterval == 0 {
-		// no refresh: do not monitor for new/vanished VMs
-		return
+}
+
+func (p *Pve) periodicRefresh() {
+	var tick <-chan time.Time
+	if p.cfg.RefreshInterval > 0 {
+		p.ticker = time.NewTicker(time.Duration(p.cfg.RefreshInterval) * time.Second)
+		tick = p.ticker.C
 	}
-	p.ticker = time.NewTicker(time.Duration(p.cfg.RefreshInterval) * time.Second)
+	// when there is no periodic refresh, only explicit requests are served
 	quitTicker := make(chan bool)
 	p.quitTicker = &quitTicker
+	delay := p.startupDelay()
+	if delay == 0 {
+		// Run the first refresh right now
+		p.safeRefresh()
+	}
+	// the goroutine works on its own copies, since Stop resets the fields
+	ticker := p.ticker
 	go func() {
+		if delay > 0 {
+			slog.Info("delaying the first refresh", "delay", delay)
+			select {
+			case <-quitTicker:
+				return
+			case <-time.After(delay):
+			}
+			p.safeRefresh()
+			if ticker != nil {
+				// do not count the delay as a refresh period
+				ticker.Reset(time.Duration(p.cfg.RefreshInterval) * time.Second)
+				select {
+				case <-tick:
+				default:
+				}
+			}
+		}
 		for {
 			select {
-			case <-*p.quitTicker:
+			case <-quitTicker:
 				// was asked to stop
 				return
-			case <-p.ticker.C:
+			case <-tick:
 				// periodic task
-				p.RefreshVMsMonitoring()
+				p.safeRefresh()
+			case <-p.refreshReq:
+				p.safeRefresh()
 			}
 		}
 	}()
 }
 
+// return the time to wait before the first refresh, including a random splay
+func (p *Pve) startupDelay() time.Duration {
+	delay := time.Duration(p.cfg.StartupDelay) * time.Second
+	if p.cfg.StartupSplay > 0 {
+		delay += rand.N(time.Duration(p.cfg.StartupSplay) * time.Second)
+	}
+	return delay
+}
+
+// return the loggers of the known VMs and of the PVE node, by VM; a logger
+// can be created by a later refresh, so it's read while holding the lock
+func (p *Pve) allLoggers() map[*VM]*ologgers.OLogger {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loggers := map[*VM]*ologgers.OLogger{}
+	for _, vm := range p.knownVMs {
+		if vm.Logger != nil {
+			loggers[vm] = vm.Logger
+		}
+	}
+	if p.hostVM != nil && p.hostVM.Logger != nil {
+		loggers[p.hostVM] = p.hostVM.Logger
+	}
+	return loggers
+}
+
+// force the export of pending logs of all the monitored VMs
+func (p *Pve) Flush() {
+	slog.Info("flush pending logs")
+	for vm, logger := range p.allLoggers() {
+		if err := logger.ForceFlush(); err != nil {
+			slog.Warn("failure flushing logs", "vm_type", vm.Type, "vm_id", vm.Id, "err", err)
+		}
+	}
+}
+
 // start managing monitoring processes
-func (p *Pve) Start() {
-	if p.ticker != nil {
+func (p *Pve) Start() error {
+	if p.quitTicker != nil {
 		// do nothing, if already running
-		return
+		return nil
+	}
+	if err := p.cfg.CheckCommands(); err != nil {
+		return err
 	}
 	slog.Info("start monitoring")
+	p.mu.Lock()
+	p.stopped = false
+	p.mu.Unlock()
+	if p.cfg.RequireVMs && len(p.CurrentVMs()) == 0 {
+		return errors.New("no VM can be monitored")
+	}
 	if !p.cfg.SkipPVE {
-		p.pveSelfMonitoring()
+		if err := p.pveSelfMonitoring(); err != nil {
+			return fmt.Errorf("unable to monitor the PVE node: %w", err)
+		}
 	}
+	metrics.Set("pve2otelcol_up", 1)
+	p.startStoppedHistory()
 	p.periodicRefresh()
+	return nil
 }
 
 // stop all running monitoring processes
 func (p *Pve) Stop() {
 	slog.Info("stop monitoring")
-	p.ticker.Stop()
-	*p.quitTicker <- true
-	for id := range p.knownVMs {
-		p.RemoveVM(id)
+	metrics.Set("pve2otelcol_up", 0)
+	// there is no ticker without a periodic refresh, and nothing at all if never started
+	if p.ticker != nil {
+		p.ticker.Stop()
+		p.ticker = nil
+	}
+	// the refresh goroutine can be busy refreshing: the channel is closed
+	// instead of waiting for it to receive
+	if p.quitTicker != nil {
+		close(*p.quitTicker)
+		p.quitTicker = nil
 	}
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.stopStoppedHistory()
+	p.removeAllVMs()
+	// with no VMs left, a last collection removes their series
+	p.stopCollecting()
+	p.collectMetrics()
 }
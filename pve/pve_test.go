@@ -0,0 +1,1609 @@
+package pve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alberanid/pve2otelcol/config"
+	"github.com/alberanid/pve2otelcol/metrics"
+	"github.com/alberanid/pve2otelcol/ologgers"
+)
+
+// return a configuration writing the records as JSON lines to a file of a
+// temporary directory, whose path is also returned
+func testConfig(t *testing.T) (*config.Config, string) {
+	t.Helper()
+	cfg := config.Default()
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	cfg.OtlpExporter = "file"
+	cfg.FilePath = path
+	cfg.SkipPVE = true
+	cfg.RefreshInterval = 0
+	return cfg, path
+}
+
+// return a Pve instance not running any Proxmox command
+func newTestPve(t *testing.T, cfg *config.Config) *Pve {
+	t.Helper()
+	return newTestPveContext(t, context.Background(), cfg)
+}
+
+// return a Pve instance not running any Proxmox command, stopped by the context
+func newTestPveContext(t *testing.T, ctx context.Context, cfg *config.Config) *Pve {
+	t.Helper()
+	p := New(ctx, cfg)
+	p.readConfig = func(id int) (string, error) { return "", nil }
+	p.readPools = func() (map[int]string, error) { return map[int]string{}, nil }
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		return nil, errors.New("unexpected command: " + name)
+	}
+	return p
+}
+
+// return the records written by the file exporter
+func readRecords(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestFlushExportsPendingRecords(t *testing.T) {
+	cfg, path := testConfig(t)
+	// nothing is exported by the batch processor before the flush
+	cfg.OtlpBatchExportInterval = 3600
+	p := newTestPve(t, cfg)
+	vm := p.UpdateVM(&VM{Id: 100, Name: "ct100", Type: "lxc"})
+	if vm.Logger == nil {
+		t.Fatal("no logger created")
+	}
+	defer vm.Logger.Shutdown(context.Background())
+	vm.Logger.Log("pending line")
+	if records := readRecords(t, path); len(records) != 0 {
+		t.Fatalf("records exported before the flush: %v", records)
+	}
+	p.Flush()
+	records := readRecords(t, path)
+	if len(records) != 1 || records[0]["body"] != "pending line" {
+		t.Fatalf("unexpected records after the flush: %v", records)
+	}
+}
+
+// output of "pct list" used by the tests
+const PCT_LIST = `VMID       Status     Lock         Name
+100        running                 web
+101        stopped                 db
+102        running    backup       cache
+`
+
+// make the Pve instance see the given output of "pct list"
+func fakePctList(p *Pve, out string) {
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		if name != "pct" || len(args) == 0 || args[0] != "list" {
+			return nil, errors.New("unexpected command: " + name)
+		}
+		return []byte(out), nil
+	}
+}
+
+func TestListVMs(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.MonitorExclude = []int{102}
+	p := newTestPve(t, cfg)
+	fakePctList(p, PCT_LIST)
+	var buf bytes.Buffer
+	p.ListVMs(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := [][]string{
+		{"ID", "NAME", "TYPE", "MONITOR"},
+		{"100", "web", "lxc", "true"},
+		{"102", "cache", "lxc", "false"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	for i, line := range lines {
+		if got := strings.Fields(line); !slices.Equal(got, want[i]) {
+			t.Errorf("line %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestRequestRefreshCoalesces(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	for range 5 {
+		p.RequestRefresh()
+	}
+	if pending := len(p.refreshReq); pending != 1 {
+		t.Errorf("expected a single pending refresh, got %d", pending)
+	}
+}
+
+func TestRefreshesDoNotOverlap(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	var active, maxActive, calls atomic.Int32
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		calls.Add(1)
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return []byte("VMID Status Lock Name\n"), nil
+	}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.RefreshVMsMonitoring()
+		}()
+	}
+	wg.Wait()
+	if calls.Load() != 4 {
+		t.Errorf("expected 4 refreshes, got %d", calls.Load())
+	}
+	if maxActive.Load() != 1 {
+		t.Errorf("refreshes overlapped: %d at once", maxActive.Load())
+	}
+}
+
+func TestPeriodicRefreshServesRequests(t *testing.T) {
+	cfg, _ := testConfig(t)
+	// started by Start, that looks for the monitoring command
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	var calls atomic.Int32
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		calls.Add(1)
+		return []byte("VMID Status Lock Name\n"), nil
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	// the first refresh is run by Start
+	p.RequestRefresh()
+	deadline := time.Now().Add(5 * time.Second)
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected 2 refreshes, got %d", got)
+	}
+}
+
+// run by "go test -race": the known VMs are read and changed concurrently
+func TestConcurrentRefreshAndStop(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	var toggle atomic.Bool
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		// VMs appear and disappear at every refresh
+		if toggle.Load() {
+			return []byte(PCT_LIST), nil
+		}
+		return []byte("VMID Status Lock Name\n101 running web2\n"), nil
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				toggle.Store(!toggle.Load())
+				p.RefreshVMsMonitoring()
+				p.RequestRefresh()
+				p.Snapshot()
+				p.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+	p.Stop()
+	if ids := p.knownIds(); len(ids) != 0 {
+		t.Errorf("VMs still known after Stop: %v", ids)
+	}
+}
+
+// run by "go test -race": concurrent starts must not run two monitoring loops
+func TestConcurrentStartsRunOneMonitor(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	newVM := func() *VM {
+		return &VM{Id: 100, Name: "web", Type: "lxc", MonitorCmd: "sleep", MonitorArgs: []string{"60"}}
+	}
+	for round := 1; round <= 3; round++ {
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.StartVMMonitoring(newVM())
+			}()
+		}
+		wg.Wait()
+		p.mu.Lock()
+		vm := p.knownVMs[100]
+		gen, running := vm.monitorGen, vm.Running
+		p.mu.Unlock()
+		if gen != round || !running {
+			t.Fatalf("round %d: expected one running monitoring loop, got generation %d (running: %t)",
+				round, gen, running)
+		}
+		p.StopVMMonitoring(100)
+	}
+}
+
+// return a VM whose monitoring command prints the given lines, then waits
+func printingVM(id int, lines ...string) *VM {
+	script := ""
+	for _, line := range lines {
+		script += fmt.Sprintf("echo '%s'; ", line)
+	}
+	return &VM{Id: id, Name: fmt.Sprintf("ct%d", id), Type: "lxc", MonitorCmd: "sh",
+		MonitorArgs: []string{"-c", script + "exec sleep 60"}}
+}
+
+// wait for a condition, failing the test if it's not met in a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRemoveVMDrainsPendingRecords(t *testing.T) {
+	cfg, path := testConfig(t)
+	// records are only exported by the shutdown of the logger
+	cfg.OtlpBatchExportInterval = 3600
+	p := newTestPve(t, cfg)
+	p.StartVMMonitoring(printingVM(100, "one", "two"))
+	vm := p.knownVMs[100]
+	waitFor(t, "the output of the monitoring command", func() bool { return vm.lastLine.Load() > 0 })
+	time.Sleep(20 * time.Millisecond)
+	p.RemoveVM(100)
+	records := readRecords(t, path)
+	if len(records) != 2 || records[0]["body"] != "one" || records[1]["body"] != "two" {
+		t.Fatalf("the pending records must be exported before the removal: %v", records)
+	}
+	if ids := p.knownIds(); len(ids) != 0 {
+		t.Errorf("VMs still known after the removal: %v", ids)
+	}
+}
+
+// return the value of a metric series, as written by the metrics endpoint
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Write(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, found := strings.CutPrefix(line, series+" "); found {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("metric %s not found", series)
+	return 0
+}
+
+func TestQueueDepthGauge(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	cfg, _ := testConfig(t)
+	cfg.OtlpExporter = "http"
+	cfg.OtlpHTTPURL = srv.URL
+	cfg.OtlpBatchMaxBatchSize = 1
+	p := newTestPve(t, cfg)
+	vm := p.UpdateVM(&VM{Id: 100, Name: "ct100", Type: "lxc"})
+	defer vm.Logger.Shutdown(context.Background())
+	for i := 0; i < 3; i++ {
+		vm.Logger.Log(fmt.Sprintf("line %d", i))
+	}
+	// the records stay pending while the collector doesn't answer
+	series := `pve2otelcol_batch_queue_depth{vm_type="lxc",vm_id="100"}`
+	if depth := metricValue(t, series); depth != 3 {
+		t.Errorf("queue depth = %v while the export is blocked, want 3", depth)
+	}
+	close(release)
+	waitFor(t, "the export of the records", func() bool { return metricValue(t, series) == 0 })
+}
+
+func TestBatchSizeGauge(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.OtlpExporter = "http"
+	cfg.OtlpBatchMaxBatchSize = 100
+	cfg.OtlpHTTPBatchMaxBatchSize = 20
+	newTestPve(t, cfg)
+	if size := metricValue(t, "pve2otelcol_batch_max_batch_size"); size != 20 {
+		t.Errorf("pve2otelcol_batch_max_batch_size = %v, want the size of the HTTP exporter", size)
+	}
+}
+
+func TestRefreshGauges(t *testing.T) {
+	cfg, _ := testConfig(t)
+	// started by Start, that looks for the monitoring command
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	fakePctList(p, "VMID Status Lock Name\n")
+	if !p.LastRefresh().IsZero() {
+		t.Fatal("no refresh expected yet")
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if up := metricValue(t, "pve2otelcol_up"); up != 1 {
+		t.Errorf("pve2otelcol_up = %v while running", up)
+	}
+	first := p.LastRefresh()
+	if first.IsZero() {
+		t.Fatal("the first refresh was not recorded")
+	}
+	if gauge := metricValue(t, "pve2otelcol_last_refresh_timestamp_seconds"); gauge != float64(first.Unix()) {
+		t.Errorf("last refresh gauge = %v, want %d", gauge, first.Unix())
+	}
+	time.Sleep(10 * time.Millisecond)
+	p.RefreshVMsMonitoring()
+	if second := p.LastRefresh(); !second.After(first) {
+		t.Errorf("the last refresh time did not advance: %v, then %v", first, second)
+	}
+	if gauge := metricValue(t, "pve2otelcol_last_refresh_timestamp_seconds"); gauge < float64(first.Unix()) {
+		t.Errorf("the last refresh gauge went back: %v", gauge)
+	}
+	p.Stop()
+	if up := metricValue(t, "pve2otelcol_up"); up != 0 {
+		t.Errorf("pve2otelcol_up = %v once stopped", up)
+	}
+}
+
+// collect the program logs written during the test
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return buf
+}
+
+// buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestMemoryBudgetWarning(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.OtlpBatchMaxQueueSize = 100
+	cfg.OtlpBatchBufferSize = 1
+	cfg.OtlpBatchMaxBatchSize = 50
+	// two loggers can hold 300 records
+	cfg.OtlpBatchMemoryBudget = 200
+	logs := captureLogs(t)
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	p.UpdateVM(&VM{Id: 100, Type: "lxc"})
+	if strings.Contains(logs.String(), "memory budget") {
+		t.Fatalf("unexpected warning with a single logger:\n%s", logs)
+	}
+	p.UpdateVM(&VM{Id: 101, Type: "lxc"})
+	if !strings.Contains(logs.String(), "more records than the memory budget") ||
+		!strings.Contains(logs.String(), "records=300") {
+		t.Errorf("expected a warning about the memory budget:\n%s", logs)
+	}
+}
+
+func TestCheckLists(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []int
+		exclude []int
+		names   []string
+		exNames []string
+		want    map[int]bool
+	}{
+		{"no lists", nil, nil, nil, nil, map[int]bool{100: true, 101: true, 200: true}},
+		{"include ids", []int{100}, nil, nil, nil, map[int]bool{100: true, 101: false, 200: false}},
+		{"exclude ids", nil, []int{101}, nil, nil, map[int]bool{100: true, 101: false, 200: true}},
+		{"include names", nil, nil, []string{"web-*"}, nil, map[int]bool{100: true, 101: true, 200: false}},
+		{"include names or ids", []int{200}, nil, []string{"web-1"}, nil,
+			map[int]bool{100: true, 101: false, 200: true}},
+		{"exclude names win", []int{100}, nil, []string{"web-*"}, []string{"web-1"},
+			map[int]bool{100: false, 101: true, 200: false}},
+		{"exclude ids win", nil, []int{101}, []string{"web-?"}, nil, map[int]bool{100: true, 101: false, 200: false}},
+	}
+	vms := []*VM{{Id: 100, Name: "web-1"}, {Id: 101, Name: "web-2"}, {Id: 200, Name: "db"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.MonitorInclude, cfg.MonitorExclude = tt.include, tt.exclude
+			cfg.IncludeNames, cfg.ExcludeNames = tt.names, tt.exNames
+			p := newTestPve(t, cfg)
+			for _, vm := range vms {
+				if got := p.checkLists(vm); got != tt.want[vm.Id] {
+					t.Errorf("VM %d (%s): monitored = %t, want %t", vm.Id, vm.Name, got, tt.want[vm.Id])
+				}
+			}
+		})
+	}
+}
+
+func TestStopHasDeadline(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.DrainTimeout = 4
+	cfg.ShutdownTimeout = 1
+	logs := captureLogs(t)
+	p := newTestPve(t, cfg)
+	// a child keeps the output open once the command is killed, so that the
+	// monitoring loop only exits after DrainTimeout
+	vm := &VM{Id: 100, Type: "lxc", MonitorCmd: "sh", MonitorArgs: []string{"-c", "sleep 5 & exec sleep 5"}}
+	p.StartVMMonitoring(vm)
+	waitFor(t, "the monitoring command", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return vm.StopProcess != nil
+	})
+	start := time.Now()
+	p.Stop()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Stop took %v, past the shutdown timeout", elapsed)
+	}
+	if !strings.Contains(logs.String(), "not flushed before the shutdown timeout") {
+		t.Errorf("expected a warning about the VMs not flushed:\n%s", logs)
+	}
+}
+
+// monitor a VM until its records are logged, then remove it and return them
+func monitorRecords(t *testing.T, p *Pve, path string, vm *VM, expected int) []map[string]interface{} {
+	t.Helper()
+	p.StartVMMonitoring(vm)
+	waitFor(t, "the records of the VM", func() bool { return len(readRecords(t, path)) >= expected })
+	p.RemoveVM(vm.Id)
+	return readRecords(t, path)
+}
+
+// return the attributes of a record written by the file exporter
+func attributes(record map[string]interface{}) map[string]interface{} {
+	attrs, _ := record["attributes"].(map[string]interface{})
+	return attrs
+}
+
+func TestKeepRawLine(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.OtlpProcessor = "simple"
+	cfg.KeepRawLine = true
+	p := newTestPve(t, cfg)
+	raw := `{"MESSAGE":"hello","PRIORITY":"6"}`
+	records := monitorRecords(t, p, path, printingVM(100, raw, "not json"), 2)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	if got := attributes(records[0])["raw"]; got != raw {
+		t.Errorf("raw attribute = %v, want %s", got, raw)
+	}
+	if body, _ := records[0]["body"].(map[string]interface{}); body["MESSAGE"] != "hello" {
+		t.Errorf("the line must still be parsed: %v", records[0]["body"])
+	}
+	if got := attributes(records[1])["raw"]; got != "not json" {
+		t.Errorf("raw attribute = %v, want the line", got)
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	cfg, _ := testConfig(t)
+	// started by Start, that looks for the monitoring command
+	cfg.LXCMonitorCmd = "sleep 60"
+	cfg.StartupDelay = 1
+	cfg.StartupSplay = 2
+	p := newTestPve(t, cfg)
+	for range 20 {
+		if d := p.startupDelay(); d < time.Second || d >= 3*time.Second {
+			t.Fatalf("startup delay %v out of range", d)
+		}
+	}
+
+	cfg.StartupSplay = 0
+	fakePctList(p, "VMID Status Lock Name\n")
+	start := time.Now()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.LastRefresh().IsZero() {
+		t.Fatal("the first refresh must be delayed")
+	}
+	waitFor(t, "the first refresh", func() bool { return !p.LastRefresh().IsZero() })
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("the first refresh ran after %v, before the delay", elapsed)
+	}
+	p.Stop()
+}
+
+func TestStopDuringStartupDelay(t *testing.T) {
+	cfg, _ := testConfig(t)
+	// started by Start, that looks for the monitoring command
+	cfg.LXCMonitorCmd = "sleep 60"
+	cfg.StartupDelay = 60
+	p := newTestPve(t, cfg)
+	fakePctList(p, "VMID Status Lock Name\n")
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	time.Sleep(10 * time.Millisecond)
+	if !p.LastRefresh().IsZero() {
+		t.Error("no refresh expected once stopped")
+	}
+}
+
+func TestStartupSummary(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.LXCMonitorCmd = "sleep 60"
+	cfg.MonitorExclude = []int{102}
+	logs := captureLogs(t)
+	p := newTestPve(t, cfg)
+	fakePctList(p, PCT_LIST)
+	p.RefreshVMsMonitoring()
+	defer p.Stop()
+	summary := ""
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "monitoring summary") {
+			summary = line
+		}
+	}
+	for _, want := range []string{"vms_found=2", "vms_filtered_out=1", "monitored_ids=[100]", "pve_node=false",
+		"exporter=file"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary %q does not contain %q", summary, want)
+		}
+	}
+	p.RefreshVMsMonitoring()
+	if n := strings.Count(logs.String(), "monitoring summary"); n != 1 {
+		t.Errorf("the summary must be logged only at the first refresh, got %d", n)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	// a small buffer, so that lines are read in several chunks
+	r := bufio.NewReaderSize(strings.NewReader("short\r\n"+strings.Repeat("x", 40)+"\nnext\ncaffè\nlast"), 16)
+	want := []struct {
+		line string
+		cut  bool
+	}{
+		{"short", false},
+		{strings.Repeat("x", 20), true},
+		{"next", false},
+		// the two bytes of "è" are not split
+		{"caff", true},
+		{"last", false},
+	}
+	for i, w := range want {
+		max := 20
+		if i == 3 {
+			max = 5
+		}
+		line, cut, err := readLine(r, max)
+		if err != nil || line != w.line || cut != w.cut {
+			t.Errorf("line %d: got %q, %t, %v; want %q, %t", i, line, cut, err, w.line, w.cut)
+		}
+	}
+	if _, _, err := readLine(r, 20); err != io.EOF {
+		t.Errorf("expected EOF at the end, got %v", err)
+	}
+}
+
+func TestLongLinesDoNotStopTheMonitoring(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.OtlpProcessor = "simple"
+	p := newTestPve(t, cfg)
+	script := fmt.Sprintf("head -c %d /dev/zero | tr '\\0' a; echo; echo after; exec sleep 60", MAX_LINE_BYTES+10)
+	vm := &VM{Id: 100, Type: "lxc", MonitorCmd: "sh", MonitorArgs: []string{"-c", script}}
+	records := monitorRecords(t, p, path, vm, 2)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if body, _ := records[0]["body"].(string); len(body) != MAX_LINE_BYTES || attributes(records[0])["truncated"] != true {
+		t.Errorf("the long line must be cut to %d bytes and marked as truncated; got %d bytes", MAX_LINE_BYTES, len(body))
+	}
+	if body := records[1]["body"]; body != "after" {
+		t.Errorf("the lines after a long one must be read, got %v", body)
+	}
+}
+
+func TestContextCancellationStopsMonitoring(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.CmdRetryDelay = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newTestPveContext(t, ctx, cfg)
+	vm := &VM{Id: 100, Type: "lxc", MonitorCmd: "sleep", MonitorArgs: []string{"60"}}
+	p.StartVMMonitoring(vm)
+	p.mu.Lock()
+	done := vm.monitorDone
+	p.mu.Unlock()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the monitoring loop did not exit once the context was cancelled")
+	}
+	if vm.RestartCount != 0 {
+		t.Errorf("the command must not be restarted when shutting down: %d restarts", vm.RestartCount)
+	}
+	// no refresh is run once cancelled
+	p.RefreshVMsMonitoring()
+	if !p.LastRefresh().IsZero() {
+		t.Error("unexpected refresh after the cancellation")
+	}
+}
+
+func TestLXCMonitorCmdTemplate(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.LXCMonitorCmd = "lxc-attach -n {id} -- journalctl --follow --output json --identifier={name}"
+	cfg.JournalPriority = "warning"
+	p := newTestPve(t, cfg)
+	fakePctList(p, PCT_LIST)
+	vm := p.CurrentLXCs()[100]
+	if vm == nil {
+		t.Fatal("LXC 100 not found")
+	}
+	got := append([]string{vm.MonitorCmd}, vm.MonitorArgs...)
+	want := []string{"lxc-attach", "-n", "100", "--", "journalctl", "--follow", "--output", "json",
+		"--identifier=web", "--priority=warning"}
+	if !slices.Equal(got, want) {
+		t.Errorf("monitoring command %q, want %q", got, want)
+	}
+}
+
+func TestLXCJournalFilters(t *testing.T) {
+	monitor := []string{"pct", "exec", "100", "--", "journalctl", "--lines", "0", "--follow", "--output", "json"}
+	tests := []struct {
+		name     string
+		grep     string
+		priority string
+		facility string
+		want     []string
+	}{
+		{"no filters", "", "", "", nil},
+		{"pattern with spaces", "disk full", "", "", []string{"--grep=disk full"}},
+		{"pattern like an option", "--since=today", "", "", []string{"--grep=--since=today"}},
+		{"priority range", "", "0..4", "", []string{"--priority=0..4"}},
+		{"facilities", "", "", "auth,cron", []string{"--facility=auth,cron"}},
+		{"all the filters", "error", "err", "daemon", []string{"--grep=error", "--priority=err", "--facility=daemon"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.JournalGrep, cfg.JournalPriority, cfg.JournalFacility = tt.grep, tt.priority, tt.facility
+			p := newTestPve(t, cfg)
+			fakePctList(p, PCT_LIST)
+			vm := p.CurrentLXCs()[100]
+			if vm == nil {
+				t.Fatal("LXC 100 not found")
+			}
+			got := append([]string{vm.MonitorCmd}, vm.MonitorArgs...)
+			if want := slices.Concat(monitor, tt.want); !slices.Equal(got, want) {
+				t.Errorf("monitoring command %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLXCLogSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []config.LogSource
+		want    []LogSource
+	}{
+		{"journal only", nil, nil},
+		{"expanded templates", []config.LogSource{
+			{Name: "nginx", Cmd: "pct exec {id} -- tail -F /var/log/nginx/{name}.log"},
+			{Name: "audit", Cmd: "lxc-attach -n {id} -- tail -F /var/log/audit.log"},
+		}, []LogSource{
+			{Name: "nginx", Cmd: "pct", Args: []string{"exec", "100", "--", "tail", "-F", "/var/log/nginx/web.log"}},
+			{Name: "audit", Cmd: "lxc-attach", Args: []string{"-n", "100", "--", "tail", "-F", "/var/log/audit.log"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.LXCLogSources = tt.sources
+			p := newTestPve(t, cfg)
+			fakePctList(p, PCT_LIST)
+			vm := p.CurrentLXCs()[100]
+			if vm == nil {
+				t.Fatal("LXC 100 not found")
+			}
+			sources := vm.logSources()
+			if sources[0].Name != config.JOURNAL_LOG_SOURCE || sources[0].Cmd != vm.MonitorCmd {
+				t.Errorf("the journal must be the first source, got %v", sources[0])
+			}
+			got := sources[1:]
+			if len(got) != len(tt.want) {
+				t.Fatalf("sources %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i].Name || got[i].Cmd != tt.want[i].Cmd || !slices.Equal(got[i].Args, tt.want[i].Args) {
+					t.Errorf("source %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPveUnits(t *testing.T) {
+	journal := []string{"journalctl", "--lines", "0", "--follow", "--output", "json"}
+	tests := []struct {
+		name  string
+		units []string
+		want  []string
+	}{
+		{"whole journal", nil, nil},
+		{"single unit", []string{"pveproxy.service"}, []string{"--unit", "pveproxy.service"}},
+		{"units and patterns", []string{"pvedaemon.service", "pve-*"},
+			[]string{"--unit", "pvedaemon.service", "--unit", "pve-*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.PveUnits = tt.units
+			vm := newTestPve(t, cfg).newHostVM()
+			got := append([]string{vm.MonitorCmd}, vm.MonitorArgs...)
+			if want := slices.Concat(journal, tt.want); !slices.Equal(got, want) {
+				t.Errorf("monitoring command %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPveExcludeUnits(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		rules   []config.LogRule
+		want    []string
+	}{
+		{"no exclusions", nil, nil, []string{"pveproxy.service", "pvedaemon.service", "cron.service"}},
+		{"excluded units", []string{"pvedaemon.service", "cron.service"}, nil, []string{"pveproxy.service"}},
+		{"before the configured rules", []string{"cron.service"},
+			[]config.LogRule{{Field: "_SYSTEMD_UNIT", Value: "cron.service", Action: config.RULE_KEEP}},
+			[]string{"pveproxy.service", "pvedaemon.service"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.PveExcludeUnits = tt.exclude
+			cfg.LogRules = tt.rules
+			p := newTestPve(t, cfg)
+			vm := p.newHostVM()
+			logger, err := ologgers.New(context.Background(), p.hostConfig(), p.loggerOptions(vm))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, unit := range []string{"pveproxy.service", "pvedaemon.service", "cron.service"} {
+				logger.Log(map[string]interface{}{"MESSAGE": unit, "PRIORITY": "6", "_SYSTEMD_UNIT": unit})
+			}
+			logger.Shutdown(context.Background())
+			got := []string{}
+			for _, record := range readRecords(t, path) {
+				got = append(got, fmt.Sprint(record["body"].(map[string]interface{})["MESSAGE"]))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("records of the units %q, want %q", got, tt.want)
+			}
+			if len(cfg.LogRules) != len(tt.rules) {
+				t.Error("the configured rules must not be changed")
+			}
+		})
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		prefix   string
+		vm       *VM
+		want     string
+	}{
+		{"default", config.DEFAULT_SERVICE_NAME_TEMPLATE, "", &VM{Id: 100, Name: "web", Type: "lxc"}, "web"},
+		{"all the placeholders", "{node}/{type}/{id}-{name}", "", &VM{Id: 100, Name: "web", Type: "lxc"}, "pve1/lxc/100-web"},
+		{"missing name", "{name}", "", &VM{Id: 101, Type: "qm"}, "101"},
+		{"fixed text", "vm-{id}.example", "", &VM{Id: 102, Name: "db", Type: "qm"}, "vm-102.example"},
+		{"PVE node", "{type}-{name}", "", &VM{Id: 0, Name: "pve1", Type: "pve"}, "pve-pve1"},
+		{"prefix", config.DEFAULT_SERVICE_NAME_TEMPLATE, "prod-", &VM{Id: 100, Name: "web", Type: "lxc"}, "prod-web"},
+		{"prefix not expanded", "{id}", "{name}.", &VM{Id: 100, Name: "web", Type: "lxc"}, "{name}.100"},
+		{"prefix of the PVE node", "{name}", "prod/", &VM{Id: 0, Name: "pve1", Type: "pve"}, "prod/pve1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.ServiceNameTemplate = tt.template
+			cfg.ServiceNamePrefix = tt.prefix
+			p := newTestPve(t, cfg)
+			p.node = "pve1"
+			if got := p.serviceName(tt.vm); got != tt.want {
+				t.Errorf("service name %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		failures int
+		calls    int
+		found    bool
+	}{
+		{"no failures", 2, 0, 1, true},
+		{"recovered", 2, 2, 3, true},
+		{"no retries", 0, 1, 1, false},
+		{"still failing", 2, 5, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.LXCMonitorCmd = "sleep 60"
+			cfg.DiscoveryRetries = tt.retries
+			cfg.DiscoveryRetryDelay = 0
+			cfg.VMRemovalGrace = 0
+			p := newTestPve(t, cfg)
+			defer p.Stop()
+			// the VM was found by a previous refresh
+			fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+			p.RefreshVMsMonitoring()
+			calls := 0
+			p.runList = func(name string, args ...string) ([]byte, error) {
+				calls++
+				if calls <= tt.failures {
+					return nil, errors.New("cluster filesystem not ready")
+				}
+				return []byte("VMID Status Lock Name\n101 running db\n"), nil
+			}
+			p.RefreshVMsMonitoring()
+			if calls != tt.calls {
+				t.Errorf("pct list run %d times, want %d", calls, tt.calls)
+			}
+			ids := p.knownIds()
+			slices.Sort(ids)
+			// a failed refresh removes nothing
+			want := []int{100}
+			if tt.found {
+				want = []int{101}
+			}
+			if !slices.Equal(ids, want) {
+				t.Errorf("known VMs %v, want %v", ids, want)
+			}
+		})
+	}
+}
+
+func TestVMMinSeverity(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.MinSeverity = "info"
+	cfg.VMMinSeverities = map[int]string{100: "error"}
+	p := newTestPve(t, cfg)
+	if got := p.loggerOptions(&VM{Id: 100, Type: "lxc"}).MinSeverity; got != "error" {
+		t.Errorf("VM 100 must use its own minimum severity, got %q", got)
+	}
+	if got := p.loggerOptions(&VM{Id: 101, Type: "lxc"}).MinSeverity; got != "info" {
+		t.Errorf("VM 101 must use the global minimum severity, got %q", got)
+	}
+}
+
+// write an executable shell script running the given commands, returning its path
+func fakeCommand(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fake.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVMMonitoredAgainAfterGivingUp(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.OtlpProcessor = "simple"
+	cfg.CmdRetryTimes = 0
+	cfg.VMRemovalGrace = 1
+	// the monitoring command fails until the flag file exists
+	flag := filepath.Join(t.TempDir(), "up")
+	cfg.LXCMonitorCmd = fakeCommand(t, fmt.Sprintf("[ -f %s ] || exit 1\necho started\nexec sleep 60", flag))
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	vm := p.knownVMs[100]
+	waitFor(t, "the monitoring to give up", func() bool { return !p.isRunning(vm) })
+	// the VM restarts: it's absent for a refresh, within the grace period
+	fakePctList(p, "VMID Status Lock Name\n")
+	p.RefreshVMsMonitoring()
+	if err := os.WriteFile(flag, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	p.mu.Lock()
+	known := p.knownVMs[100]
+	p.mu.Unlock()
+	if known != vm {
+		t.Fatal("the VM must not be removed within the grace period")
+	}
+	waitFor(t, "the monitoring to start again", func() bool { return vm.lastLine.Load() > 0 })
+	records := readRecords(t, path)
+	if len(records) != 1 || records[0]["body"] != "started" {
+		t.Errorf("unexpected records: %v", records)
+	}
+}
+
+func TestNoRetryRunsOnce(t *testing.T) {
+	cfg, _ := testConfig(t)
+	// as set by -no-retry
+	cfg.CmdRetryTimes = 0
+	cfg.CmdRetryDelay = 0
+	runs := filepath.Join(t.TempDir(), "runs")
+	cfg.LXCMonitorCmd = fakeCommand(t, fmt.Sprintf("echo run >> %s\nexit 1", runs))
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	countRuns := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run\n")
+	}
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	vm := p.knownVMs[100]
+	waitFor(t, "the monitoring to give up", func() bool { return !p.isRunning(vm) })
+	time.Sleep(50 * time.Millisecond)
+	if n := countRuns(); n != 1 {
+		t.Fatalf("the command must run exactly once, ran %d times", n)
+	}
+	// the VM disappears, then it's found again
+	fakePctList(p, "VMID Status Lock Name\n")
+	p.RefreshVMsMonitoring()
+	if ids := p.knownIds(); len(ids) != 0 {
+		t.Fatalf("VMs still known: %v", ids)
+	}
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	waitFor(t, "the monitoring of the VM found again", func() bool { return countRuns() == 2 })
+}
+
+// a VM removed while waiting to retry its command doesn't wait for the retry delay
+func TestRemoveVMDuringRetryDelay(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.CmdRetryDelay = 60
+	cfg.DrainTimeout = 30
+	runs := filepath.Join(t.TempDir(), "runs")
+	cfg.LXCMonitorCmd = fakeCommand(t, fmt.Sprintf("echo run >> %s\nexit 1", runs))
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	waitFor(t, "the first failure", func() bool {
+		data, _ := os.ReadFile(runs)
+		return len(data) > 0
+	})
+	p.mu.Lock()
+	done := p.knownVMs[100].monitorDone
+	p.mu.Unlock()
+	start := time.Now()
+	p.RemoveVM(100)
+	select {
+	case <-done:
+	default:
+		t.Fatal("the monitoring loop still running after the removal")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the removal took %v, waiting for the retry delay", elapsed)
+	}
+}
+
+// run by "go test -race": the logger created by a retry is read by Flush
+func TestLoggerRetryDuringFlush(t *testing.T) {
+	cfg, _ := testConfig(t)
+	// the logger can't be created until the directory exists
+	dir := filepath.Join(t.TempDir(), "missing")
+	cfg.FilePath = filepath.Join(dir, "records.jsonl")
+	cfg.OtlpBatchMemoryBudget = 1
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	list := "VMID Status Lock Name\n"
+	for id := 100; id < 110; id++ {
+		list += fmt.Sprintf("%d running ct%d\n", id, id)
+	}
+	fakePctList(p, list)
+	p.RefreshVMsMonitoring()
+	vms := []*VM{}
+	p.mu.Lock()
+	for _, vm := range p.knownVMs {
+		vms = append(vms, vm)
+	}
+	p.mu.Unlock()
+	for _, vm := range vms {
+		if p.isRunning(vm) {
+			t.Fatal("a VM must not be monitored without a logger")
+		}
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var rounds atomic.Int32
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p.Flush()
+			p.collectMetrics()
+			p.checkMemoryBudget()
+			rounds.Add(1)
+		}
+	}()
+	waitFor(t, "the flushes to run", func() bool { return rounds.Load() > 10 })
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	for _, vm := range vms {
+		vm.nextLoggerTry = time.Time{}
+	}
+	p.mu.Unlock()
+	p.RefreshVMsMonitoring()
+	close(stop)
+	wg.Wait()
+	for _, vm := range vms {
+		if !p.isRunning(vm) {
+			t.Errorf("VM %d must be monitored once its logger is created", vm.Id)
+		}
+	}
+}
+
+// run by "go test -race": the VMs missing at a refresh are removed
+// concurrently, while their loggers are flushed
+func TestRemovalsDuringFlush(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	list := "VMID Status Lock Name\n"
+	for id := 100; id < 110; id++ {
+		list += fmt.Sprintf("%d running ct%d\n", id, id)
+	}
+	fakePctList(p, list)
+	p.RefreshVMsMonitoring()
+	if ids := p.knownIds(); len(ids) != 10 {
+		t.Fatalf("expected 10 known VMs, got %v", ids)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var rounds atomic.Int32
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p.Flush()
+			p.collectMetrics()
+			p.Snapshot()
+			rounds.Add(1)
+		}
+	}()
+	waitFor(t, "the flushes to run", func() bool { return rounds.Load() > 10 })
+	fakePctList(p, "VMID Status Lock Name\n")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// racing with the removals of the refresh
+		p.RemoveVM(105)
+	}()
+	p.RefreshVMsMonitoring()
+	close(stop)
+	wg.Wait()
+	if ids := p.knownIds(); len(ids) != 0 {
+		t.Errorf("VMs still known after the refresh: %v", ids)
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	p.Stop()
+	if up := metricValue(t, "pve2otelcol_up"); up != 0 {
+		t.Errorf("pve2otelcol_up = %v once stopped", up)
+	}
+}
+
+func TestStopDuringRefresh(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.RefreshInterval = 3600
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		if calls.Add(1) > 1 {
+			// the requested refresh is blocked until the end of the test
+			listing <- struct{}{}
+			<-release
+		}
+		return []byte("VMID Status Lock Name\n100 running web\n"), nil
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.RemoveVM(100)
+	p.RequestRefresh()
+	<-listing
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the refresh")
+	}
+	close(release)
+	// wait for the end of the refresh
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	if ids := p.knownIds(); len(ids) != 0 {
+		t.Errorf("VMs monitored by a refresh ending after Stop: %v", ids)
+	}
+}
+
+func TestStopDrainsWithoutPeriodicRefresh(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.RefreshInterval = 0
+	// records are only exported by the shutdown of the logger
+	cfg.OtlpBatchExportInterval = 3600
+	cfg.LXCMonitorCmd = fakeCommand(t, "echo one\necho two\nexec sleep 60")
+	p := newTestPve(t, cfg)
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	vm := p.knownVMs[100]
+	p.mu.Unlock()
+	waitFor(t, "the output of the monitoring command", func() bool { return vm.lastLine.Load() > 0 })
+	time.Sleep(20 * time.Millisecond)
+	p.mu.Lock()
+	done := vm.monitorDone
+	p.mu.Unlock()
+	p.Stop()
+	select {
+	case <-done:
+	default:
+		t.Error("the monitoring loop is still running after Stop")
+	}
+	records := readRecords(t, path)
+	if len(records) != 2 || records[0]["body"] != "one" || records[1]["body"] != "two" {
+		t.Errorf("the pending records must be exported by Stop: %v", records)
+	}
+}
+
+func TestIdleMonitorIsRestarted(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.MonitorIdleTimeout = 1
+	// idle restarts are not failures: the command is not given up
+	cfg.CmdRetryTimes = 0
+	runs := filepath.Join(t.TempDir(), "runs")
+	cfg.LXCMonitorCmd = fakeCommand(t, fmt.Sprintf("echo run >> %s\nexec sleep 60", runs))
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	countRuns := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run\n")
+	}
+	waitFor(t, "two restarts of the silent command", func() bool { return countRuns() >= 3 })
+	for _, status := range p.Snapshot() {
+		if status.Id != 100 {
+			continue
+		}
+		if !status.Running {
+			t.Error("the VM must still be monitored")
+		}
+		// counted across the idle restarts
+		if status.RestartCount < 2 {
+			t.Errorf("%d restarts counted, want at least 2", status.RestartCount)
+		}
+	}
+}
+
+func TestMaxLifetimeRestartsTheCommand(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.OtlpProcessor = "simple"
+	cfg.MonitorMaxLifetime = 1
+	// recycling is not a failure: the command is not given up
+	cfg.CmdRetryTimes = 0
+	runs := filepath.Join(t.TempDir(), "runs")
+	cfg.LXCMonitorCmd = fakeCommand(t, fmt.Sprintf("echo run >> %s\necho started\nexec sleep 60", runs))
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	countRuns := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run\n")
+	}
+	waitFor(t, "two restarts of the command", func() bool { return countRuns() >= 3 })
+	for _, status := range p.Snapshot() {
+		if status.Id != 100 {
+			continue
+		}
+		if !status.Running {
+			t.Error("the VM must still be monitored")
+		}
+		if status.RestartCount < 2 {
+			t.Errorf("%d restarts counted, want at least 2", status.RestartCount)
+		}
+		if status.LastError != "" {
+			t.Errorf("a recycled command must not be reported as an error: %s", status.LastError)
+		}
+	}
+	waitFor(t, "the output of every run", func() bool { return len(readRecords(t, path)) >= 3 })
+}
+
+func TestNoMaxLifetime(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.MonitorMaxLifetime = 0
+	runs := filepath.Join(t.TempDir(), "runs")
+	cfg.LXCMonitorCmd = fakeCommand(t, fmt.Sprintf("echo run >> %s\nexec sleep 60", runs))
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	time.Sleep(1500 * time.Millisecond)
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run\n") != 1 {
+		t.Errorf("the command must not be restarted, ran %d times", strings.Count(string(data), "run\n"))
+	}
+}
+
+func TestRestartCounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		restarts float64
+	}{
+		{"no retries", 0, 0},
+		{"retries", 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.CmdRetryTimes = tt.retries
+			cfg.CmdRetryDelay = 0
+			cfg.LXCMonitorCmd = fakeCommand(t, "exit 1")
+			p := newTestPve(t, cfg)
+			defer p.Stop()
+			fakePctList(p, "VMID Status Lock Name\n100 running web\n101 running db\n")
+			p.RefreshVMsMonitoring()
+			for _, id := range []int{100, 101} {
+				vm := p.knownVMs[id]
+				waitFor(t, "the monitoring to give up", func() bool { return !p.isRunning(vm) })
+			}
+			p.collectMetrics()
+			for _, id := range []string{"100", "101"} {
+				series := `pve2otelcol_vm_restarts_total{vm_type="lxc",vm_id="` + id + `"}`
+				if restarts := metricValue(t, series); restarts != tt.restarts {
+					t.Errorf("%s = %v, want %v", series, restarts, tt.restarts)
+				}
+			}
+			for _, status := range p.Snapshot() {
+				if float64(status.RestartCount) != tt.restarts || status.LastError == "" {
+					t.Errorf("VM %d: %d restarts, last error %q; want %v restarts and an error",
+						status.Id, status.RestartCount, status.LastError, tt.restarts)
+				}
+			}
+		})
+	}
+}
+
+func TestStopMarker(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		stop    func(p *Pve)
+		reason  string
+	}{
+		{"disabled", false, func(p *Pve) { p.RemoveVM(100) }, ""},
+		{"removed", true, func(p *Pve) { p.RemoveVM(100) }, STOP_REASON_REMOVED},
+		{"shutdown", true, func(p *Pve) { p.Stop() }, STOP_REASON_SHUTDOWN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path := testConfig(t)
+			cfg.OtlpProcessor = "simple"
+			cfg.StopMarker = tt.enabled
+			p := newTestPve(t, cfg)
+			defer p.Stop()
+			p.StartVMMonitoring(printingVM(100, "one"))
+			vm := p.knownVMs[100]
+			waitFor(t, "the output of the monitoring command", func() bool { return vm.lastLine.Load() > 0 })
+			tt.stop(p)
+			records := readRecords(t, path)
+			want := 1
+			if tt.reason != "" {
+				want = 2
+			}
+			if len(records) != want {
+				t.Fatalf("%d records, want %d: %v", len(records), want, records)
+			}
+			if tt.reason == "" {
+				return
+			}
+			// the marker is the last record of the VM
+			marker := records[1]
+			attrs := attributes(marker)
+			if marker["body"] != "monitoring stopped: "+tt.reason || attrs["monitoring.stopped"] != true ||
+				attrs["monitoring.stop_reason"] != tt.reason {
+				t.Errorf("unexpected stop marker: %v", marker)
+			}
+		})
+	}
+}
+
+func TestRetryWarningsAreThrottled(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.CmdRetryTimes = 1000000
+	cfg.CmdRetryDelay = 0
+	cfg.LXCMonitorCmd = fakeCommand(t, "exit 1")
+	logs := captureLogs(t)
+	p := newTestPve(t, cfg)
+	p.retryWarningInterval = 200 * time.Millisecond
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	time.Sleep(700 * time.Millisecond)
+	p.StopVMMonitoring(100)
+	output := logs.String()
+	if n := strings.Count(output, `level=WARN msg="monitoring command failed; trying again"`); n != 1 {
+		t.Errorf("the first failure was reported %d times, want once", n)
+	}
+	// a warning every 200ms, instead of one for each of the many failures
+	if n := strings.Count(output, `level=WARN msg="monitoring command still failing"`); n < 2 || n > 4 {
+		t.Errorf("%d warnings about the following failures, want about 3", n)
+	}
+	if failures := strings.Count(output, `level=DEBUG msg="monitoring command failed; trying again"`); failures < 10 {
+		t.Errorf("only %d failures not reported as warnings", failures)
+	}
+}
+
+func TestPanicReadingOutputIsRecovered(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.OtlpProcessor = "simple"
+	cfg.CmdRetryDelay = 1
+	logs := captureLogs(t)
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	// without a logger, processing the first line panics
+	vm := printingVM(100, "line")
+	p.mu.Lock()
+	p.knownVMs[vm.Id] = vm
+	p.mu.Unlock()
+	// the counter is only written by the first panic
+	metrics.Add("pve2otelcol_panics_total", 0)
+	panics := metricValue(t, "pve2otelcol_panics_total")
+	go p.RunKeptAliveProcess(vm, false)
+	waitFor(t, "the panic to be recovered", func() bool { return strings.Contains(logs.String(), "recovered from a panic") })
+	if got := metricValue(t, "pve2otelcol_panics_total"); got != panics+1 {
+		t.Errorf("%v panics counted, want %v", got, panics+1)
+	}
+	// the command is restarted once the delay expires
+	logger, err := ologgers.New(context.Background(), cfg, p.loggerOptions(vm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	vm.Logger = logger
+	p.mu.Unlock()
+	waitFor(t, "the line to be exported", func() bool { return len(readRecords(t, path)) == 1 })
+	if !p.isRunning(vm) {
+		t.Error("the VM must still be monitored")
+	}
+}
+
+func TestPanicDuringRefreshIsRecovered(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.LXCMonitorCmd = "sleep 60"
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	var calls atomic.Int32
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		if calls.Add(1) == 1 {
+			var vms VMs
+			vms[100] = &VM{}
+		}
+		return []byte("VMID Status Lock Name\n100 running web\n"), nil
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the following refreshes are still run
+	p.RequestRefresh()
+	waitFor(t, "the VM to be monitored", func() bool { return len(p.knownIds()) == 1 })
+}
+
+// the VMs keep their own resource attributes over the shared exporter
+func TestSharedExporter(t *testing.T) {
+	cfg, path := testConfig(t)
+	cfg.OtlpProcessor = "simple"
+	cfg.OtlpSharedExporter = true
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	p.StartVMMonitoring(printingVM(100, "from 100"))
+	p.StartVMMonitoring(printingVM(101, "from 101"))
+	waitFor(t, "the records of the VMs", func() bool { return len(readRecords(t, path)) == 2 })
+	if exporters := p.sharedExporters.Len(); exporters != 1 {
+		t.Errorf("%d exporters created, want 1 shared by the VMs", exporters)
+	}
+	for _, record := range readRecords(t, path) {
+		resource, _ := record["resource"].(map[string]interface{})
+		want := strings.TrimPrefix(fmt.Sprint(record["body"]), "from ")
+		if vmid := fmt.Sprint(resource["proxmox.vmid"]); vmid != want {
+			t.Errorf("record %q sent with the resource of VM %s", record["body"], vmid)
+		}
+		if name := resource["service.name"]; name != "ct"+want {
+			t.Errorf("record %q sent with service.name %v", record["body"], name)
+		}
+	}
+}
+
+// a command that can't be started stops the ones of the VM already started,
+// and leaks no process nor goroutine
+func TestRunVMMonitoringStartFailures(t *testing.T) {
+	pipeErr := errors.New("too many open files")
+	tests := []struct {
+		name string
+		// fail opening the output of the n-th command, if greater than zero
+		failPipe int
+		extra    string
+	}{
+		{"missing command", 0, "/nonexistent/command"},
+		{"failing standard output", 2, "sleep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			p := newTestPve(t, cfg)
+			vm := &VM{Id: 100, Type: "lxc", MonitorCmd: "sleep", MonitorArgs: []string{"60"},
+				ExtraSources: []LogSource{{Name: "app", Cmd: tt.extra, Args: []string{"60"}}}}
+			cmds := []*exec.Cmd{}
+			p.stdoutPipe = func(cmd *exec.Cmd) (io.ReadCloser, error) {
+				if cmds = append(cmds, cmd); len(cmds) == tt.failPipe {
+					return nil, pipeErr
+				}
+				return cmd.StdoutPipe()
+			}
+			goroutines := runtime.NumGoroutine()
+			finished := make(chan error, 1)
+			p.runVMMonitoring(vm, context.Background(), finished)
+			select {
+			case err := <-finished:
+				if err == nil || (tt.failPipe > 0 && !errors.Is(err, pipeErr)) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			default:
+				t.Fatal("the failure was not reported")
+			}
+			if len(cmds) != 2 {
+				t.Fatalf("%d commands created, want 2", len(cmds))
+			}
+			// the command started first is killed and waited for, not left as a zombie
+			if first := cmds[0]; first.Process == nil || first.ProcessState == nil {
+				t.Error("the command started first was not waited for")
+			}
+			if second := cmds[1]; second.Process != nil {
+				t.Error("the failing command was started anyway")
+			}
+			waitFor(t, "the goroutines to exit", func() bool { return runtime.NumGoroutine() <= goroutines })
+		})
+	}
+}
+
+// the logger of a VM whose command can't be started is shut down with the VM
+func TestMissingCommandLeaksNoLogger(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.CmdRetryTimes = 0
+	cfg.LXCMonitorCmd = "/nonexistent/command"
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	goroutines := runtime.NumGoroutine()
+	p.RefreshVMsMonitoring()
+	vm := p.knownVMs[100]
+	if vm == nil || vm.Logger == nil {
+		t.Fatal("the VM has no logger")
+	}
+	waitFor(t, "the monitoring to give up", func() bool { return !p.isRunning(vm) })
+	p.RemoveVM(100)
+	// the batch processor of the logger runs its own goroutines
+	waitFor(t, "the goroutines to exit", func() bool { return runtime.NumGoroutine() <= goroutines })
+}
@@ -0,0 +1,49 @@
+package pve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alberanid/pve2otelcol/config"
+)
+
+// token bucket used to limit the number of log lines per second of a VM
+type rateLimiter struct {
+	// shared by the log sources of a VM
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// return a rateLimiter instance, or nil if no limit has to be applied.
+func newRateLimiter(limit config.RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.Rate
+	}
+	return &rateLimiter{
+		rate:   float64(limit.Rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// consume a token, if available
+func (r *rateLimiter) Allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.tokens = min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
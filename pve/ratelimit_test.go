@@ -0,0 +1,67 @@
+package pve
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alberanid/pve2otelcol/config"
+)
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if r := newRateLimiter(config.RateLimit{}); r != nil {
+		t.Errorf("expected no limiter without a rate, got %+v", r)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := newRateLimiter(config.RateLimit{Rate: 10, Burst: 5})
+	allowed := 0
+	for range 20 {
+		if r.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("expected the burst of 5 lines to be allowed, got %d", allowed)
+	}
+}
+
+func TestRateLimiterRate(t *testing.T) {
+	r := newRateLimiter(config.RateLimit{Rate: 100})
+	// the bucket starts full, with a burst equal to the rate
+	for r.Allow() {
+	}
+	r.last = time.Now().Add(-500 * time.Millisecond)
+	allowed := 0
+	for r.Allow() {
+		allowed++
+	}
+	// half a second at 100 lines per second
+	if allowed < 49 || allowed > 51 {
+		t.Errorf("expected about 50 lines allowed after half a second, got %d", allowed)
+	}
+}
+
+// a command keeping over the limit doesn't get a warning for each line let through
+func TestRateLimitWarningsAreThrottled(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.RateLimit = config.RateLimit{Rate: 50}
+	cfg.LXCMonitorCmd = fakeCommand(t, "while :; do echo line; done")
+	logs := captureLogs(t)
+	p := newTestPve(t, cfg)
+	p.rateLimitWarningInterval = 300 * time.Millisecond
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	time.Sleep(time.Second)
+	p.StopVMMonitoring(100)
+	output := logs.String()
+	// the first warning, then one every 300ms
+	if n := strings.Count(output, `msg="rate limit exceeded; dropping log lines"`); n < 2 || n > 5 {
+		t.Errorf("%d warnings about the rate limit in a second, want about 4", n)
+	}
+	if !strings.Contains(output, "dropped=") {
+		t.Errorf("the number of dropped lines missing from the warnings:\n%.500s", output)
+	}
+}
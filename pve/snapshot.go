@@ -0,0 +1,85 @@
+package pve
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// state of a monitored VM at a given time
+type VMState struct {
+	Id              int
+	Name            string
+	Type            string
+	Running         bool
+	HasLogger       bool
+	RestartCount    int
+	LastError       string
+	AbsentRefreshes int
+	// zero if no line was read yet
+	LastLine   time.Time
+	QueueDepth int
+}
+
+// return the state of the known VMs and of the PVE node, sorted by ID
+func (p *Pve) Snapshot() []VMState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vms := []*VM{}
+	for _, vm := range p.knownVMs {
+		vms = append(vms, vm)
+	}
+	if p.hostVM != nil {
+		vms = append(vms, p.hostVM)
+	}
+	states := []VMState{}
+	for _, vm := range vms {
+		state := VMState{
+			Id:              vm.Id,
+			Name:            vm.Name,
+			Type:            vm.Type,
+			Running:         vm.Running,
+			HasLogger:       vm.Logger != nil,
+			RestartCount:    vm.RestartCount,
+			AbsentRefreshes: vm.absentRefreshes,
+		}
+		if vm.LastError != nil && *vm.LastError != nil {
+			state.LastError = (*vm.LastError).Error()
+		}
+		if ns := vm.lastLine.Load(); ns > 0 {
+			state.LastLine = time.Unix(0, ns)
+		}
+		if vm.Logger != nil {
+			state.QueueDepth = vm.Logger.QueueDepth()
+		}
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b VMState) int { return a.Id - b.Id })
+	return states
+}
+
+// write a human-readable dump of the state of the monitored VMs
+func (p *Pve) WriteSnapshot(w io.Writer) {
+	lastRefresh := "never"
+	if tm := p.LastRefresh(); !tm.IsZero() {
+		lastRefresh = tm.Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "node %s, last refresh: %s\n", p.node, lastRefresh)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tTYPE\tRUNNING\tLOGGER\tRESTARTS\tABSENT\tQUEUED\tLAST LINE\tLAST ERROR")
+	for _, s := range p.Snapshot() {
+		lastLine := "-"
+		if !s.LastLine.IsZero() {
+			lastLine = s.LastLine.Format(time.RFC3339)
+		}
+		lastError := "-"
+		if s.LastError != "" {
+			lastError = s.LastError
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\t%t\t%d\t%d\t%d\t%s\t%s\n", s.Id, s.Name, s.Type, s.Running,
+			s.HasLogger, s.RestartCount, s.AbsentRefreshes, s.QueueDepth, lastLine, lastError)
+	}
+	tw.Flush()
+}
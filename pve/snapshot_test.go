@@ -0,0 +1,63 @@
+package pve
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	db := p.UpdateVM(&VM{Id: 102, Name: "db", Type: "lxc"})
+	defer db.Logger.Shutdown(context.Background())
+	web := p.UpdateVM(&VM{Id: 100, Name: "web", Type: "lxc"})
+	defer web.Logger.Shutdown(context.Background())
+	lastLine := time.Now().Truncate(time.Second)
+	err := errors.New("exit status 1")
+	p.mu.Lock()
+	p.hostVM = p.newHostVM()
+	p.hostVM.Running = true
+	db.LastError = &err
+	db.RestartCount = 3
+	db.absentRefreshes = 1
+	db.lastLine.Store(lastLine.UnixNano())
+	p.mu.Unlock()
+
+	states := p.Snapshot()
+	ids := []int{}
+	for _, s := range states {
+		ids = append(ids, s.Id)
+	}
+	if !slices.Equal(ids, []int{0, 100, 102}) {
+		t.Fatalf("VMs in the snapshot: %v, want the PVE node first and the VMs sorted by ID", ids)
+	}
+	if host := states[0]; host.Type != "pve" || !host.Running || host.HasLogger {
+		t.Errorf("unexpected state of the PVE node: %+v", host)
+	}
+	if s := states[1]; s.Name != "web" || !s.HasLogger || s.LastError != "" || !s.LastLine.IsZero() {
+		t.Errorf("unexpected state of VM 100: %+v", s)
+	}
+	want := VMState{Id: 102, Name: "db", Type: "lxc", HasLogger: true, RestartCount: 3,
+		LastError: "exit status 1", AbsentRefreshes: 1, LastLine: lastLine}
+	if s := states[2]; s != want {
+		t.Errorf("state of VM 102 = %+v, want %+v", s, want)
+	}
+
+	var out strings.Builder
+	p.WriteSnapshot(&out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("%d lines written, want the node, the header and 3 VMs:\n%s", len(lines), out.String())
+	}
+	if !strings.Contains(lines[0], "last refresh: never") {
+		t.Errorf("unexpected first line: %q", lines[0])
+	}
+	if fields := strings.Fields(lines[4]); fields[0] != "102" || fields[len(fields)-1] != "1" ||
+		!strings.Contains(lines[4], lastLine.Format(time.RFC3339)) {
+		t.Errorf("unexpected line of VM 102: %q", lines[4])
+	}
+}
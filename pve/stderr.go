@@ -0,0 +1,54 @@
+package pve
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+)
+
+// maximum length of a line of standard error kept while waiting for its end
+const MAX_STDERR_LINE = 4096
+
+// writer logging, at warn level, each line written to the standard error of a monitoring command
+type stderrLogger struct {
+	vm  *VM
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *stderrLogger) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > MAX_STDERR_LINE {
+		w.log(w.buf)
+		w.buf = nil
+	}
+	return len(b), nil
+}
+
+// log the remaining partial line, if any
+func (w *stderrLogger) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.log(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *stderrLogger) log(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return
+	}
+	slog.Warn("monitoring command error output", "vm_type", w.vm.Type, "vm_id", w.vm.Id, "stderr", string(line))
+}
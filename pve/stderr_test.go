@@ -0,0 +1,62 @@
+package pve
+
+import (
+	"strings"
+	"testing"
+)
+
+// return the stderr values logged by a stderrLogger
+func loggedStderr(logs string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(logs, "\n") {
+		if _, stderr, ok := strings.Cut(line, " stderr="); ok {
+			lines = append(lines, stderr)
+		}
+	}
+	return lines
+}
+
+func TestStderrLogger(t *testing.T) {
+	long := strings.Repeat("x", MAX_STDERR_LINE+1)
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{"lines", []string{"one\ntwo\n"}, []string{"one", "two"}},
+		{"line split across writes", []string{"o", "ne\r\n\n", "two"}, []string{"one", "two"}},
+		{"line too long", []string{long, "\n"}, []string{long}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			w := &stderrLogger{vm: &VM{Id: 100, Type: "lxc"}}
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write returned %d, %v", n, err)
+				}
+			}
+			w.Flush()
+			got := loggedStderr(logs.String())
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("logged %.60q, want %.60q", got, tt.want)
+			}
+			if !strings.Contains(logs.String(), "vm_id=100") {
+				t.Errorf("VM missing from the warnings:\n%.200s", logs.String())
+			}
+		})
+	}
+}
+
+func TestMonitoringCommandStderr(t *testing.T) {
+	logs := captureLogs(t)
+	cfg, _ := testConfig(t)
+	cfg.LXCMonitorCmd = fakeCommand(t, "echo 'journal not found' >&2\nexec sleep 60")
+	p := newTestPve(t, cfg)
+	defer p.Stop()
+	fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+	p.RefreshVMsMonitoring()
+	waitFor(t, "the error output to be logged", func() bool {
+		return strings.Contains(logs.String(), `stderr="journal not found"`)
+	})
+}
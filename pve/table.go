@@ -0,0 +1,101 @@
+package pve
+
+import (
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// position of a word in a line of text
+type span struct {
+	text       string
+	start, end int
+}
+
+// return the whitespace-separated words of a line, with their positions
+func spans(line string) []span {
+	res := []span{}
+	start := -1
+	for i, r := range line {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				res = append(res, span{text: line[start:i], start: start, end: i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		res = append(res, span{text: line[start:], start: start, end: len(line)})
+	}
+	return res
+}
+
+// return the index of the header a word belongs to: the one it overlaps the most
+// or, if none, the closest one
+func columnOf(headers []span, word span) int {
+	best := -1
+	bestOverlap := 0
+	bestDistance := 0
+	for i, h := range headers {
+		overlap := min(h.end, word.end) - max(h.start, word.start)
+		if overlap > 0 {
+			if overlap > bestOverlap {
+				best, bestOverlap = i, overlap
+			}
+			continue
+		}
+		if bestOverlap > 0 {
+			continue
+		}
+		distance := -overlap
+		if best < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return best
+}
+
+// parse a table as printed by "pct list" or "qm list" into a list of rows,
+// each one a map with the lowercase headers as keys; values are assigned to
+// columns by their position, so that the order of the columns and empty
+// cells (like the "Lock" column of "pct list") are handled. The first non-blank
+// line is the header: an error is returned if any of the required columns is missing
+func parseTable(out string, required ...string) ([]map[string]string, error) {
+	rows := []map[string]string{}
+	var headers []span
+	for _, line := range strings.Split(out, "\n") {
+		words := spans(line)
+		if len(words) == 0 {
+			continue
+		}
+		if headers == nil {
+			headers = words
+			for _, name := range required {
+				if !slices.ContainsFunc(headers, func(h span) bool { return strings.EqualFold(h.text, name) }) {
+					return nil, fmt.Errorf("missing column '%s' in header '%s'", name, strings.TrimSpace(line))
+				}
+			}
+			continue
+		}
+		row := map[string]string{}
+		for _, word := range words {
+			key := strings.ToLower(headers[columnOf(headers, word)].text)
+			if row[key] != "" {
+				row[key] += " " + word.text
+			} else {
+				row[key] = word.text
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// run a command and return its standard output
+func execOutput(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
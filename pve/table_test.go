@@ -0,0 +1,74 @@
+package pve
+
+import (
+	"testing"
+)
+
+func TestParseTableColumnOrders(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+	}{
+		{"qm list", `      VMID NAME                 STATUS     MEM(MB)    BOOTDISK(GB) PID
+       100 web                  running    2048              32.00 1234
+       101 db                   stopped    4096              64.00 0
+`},
+		{"status first", `STATUS     VMID NAME
+running    100  web
+stopped    101  db
+`},
+		{"pct list", `VMID       Status     Lock         Name
+100        running                 web
+101        stopped    backup       db
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseTable(tt.out, "vmid", "name", "status")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 2 {
+				t.Fatalf("expected 2 rows, got %v", rows)
+			}
+			if rows[0]["vmid"] != "100" || rows[0]["name"] != "web" || rows[0]["status"] != "running" {
+				t.Errorf("unexpected first row: %v", rows[0])
+			}
+			if rows[1]["vmid"] != "101" || rows[1]["name"] != "db" || rows[1]["status"] != "stopped" {
+				t.Errorf("unexpected second row: %v", rows[1])
+			}
+		})
+	}
+}
+
+func TestParseTableEmptyCells(t *testing.T) {
+	rows, err := parseTable("VMID       Status     Lock         Name\n100        running                 web\n",
+		"vmid", "name", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["lock"] != "" || rows[0]["name"] != "web" {
+		t.Errorf("an empty cell must not shift the columns: %v", rows)
+	}
+}
+
+func TestParseTableMissingColumn(t *testing.T) {
+	if _, err := parseTable("VMID NAME\n100 web\n", "vmid", "name", "status"); err == nil {
+		t.Error("expected an error for a missing column")
+	}
+}
+
+func TestCurrentKVMs(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	p.runList = func(name string, args ...string) ([]byte, error) {
+		return []byte("STATUS     VMID NAME\nrunning    300  win\nstopped    301  old\n"), nil
+	}
+	vms := p.CurrentKVMs()
+	if len(vms) != 1 || vms[300] == nil || vms[300].Name != "win" || vms[300].Type != "qm" {
+		t.Fatalf("unexpected KVMs: %v", vms)
+	}
+	if vm := vms[300]; vm.MonitorCmd != "qm" || vm.MonitorArgs[1] != "300" {
+		t.Errorf("unexpected monitoring command: %s %q", vm.MonitorCmd, vm.MonitorArgs)
+	}
+}
@@ -0,0 +1,57 @@
+package pve
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// return the configuration of a LXC, as printed by "pct config"
+func pctConfig(id int) (string, error) {
+	out, err := exec.Command("pct", "config", strconv.Itoa(id)).Output()
+	return string(out), err
+}
+
+// extract the tags from the output of "pct config"
+func parseTags(config string) []string {
+	tags := []string{}
+	for _, line := range strings.Split(config, "\n") {
+		value, found := strings.CutPrefix(line, "tags:")
+		if !found {
+			continue
+		}
+		// Proxmox accepts semicolons, commas and spaces as separators
+		tags = append(tags, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ';' || r == ',' || r == ' '
+		})...)
+	}
+	return tags
+}
+
+// return the tags of a VM, reading them only the first time a VM is seen
+func (p *Pve) vmTags(vm *VM) []string {
+	p.tagsMu.Lock()
+	defer p.tagsMu.Unlock()
+	if tags, ok := p.tagsCache[vm.Id]; ok {
+		return tags
+	}
+	config, err := p.readConfig(vm.Id)
+	if err != nil {
+		// not cached: try again at the next refresh
+		return []string{}
+	}
+	tags := parseTags(config)
+	p.tagsCache[vm.Id] = tags
+	return tags
+}
+
+// forget the tags of the VMs not in the given list
+func (p *Pve) pruneTags(vms VMs) {
+	p.tagsMu.Lock()
+	defer p.tagsMu.Unlock()
+	for id := range p.tagsCache {
+		if _, ok := vms[id]; !ok {
+			delete(p.tagsCache, id)
+		}
+	}
+}
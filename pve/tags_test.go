@@ -0,0 +1,55 @@
+package pve
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	config := "arch: amd64\nhostname: web\ntags: prod;logs, web monitored\nmemory: 512\n"
+	if got, want := parseTags(config), []string{"prod", "logs", "web", "monitored"}; !slices.Equal(got, want) {
+		t.Errorf("parseTags = %q, want %q", got, want)
+	}
+	if got := parseTags("hostname: web\n"); len(got) != 0 {
+		t.Errorf("expected no tags, got %q", got)
+	}
+}
+
+func TestCheckTags(t *testing.T) {
+	cfg, _ := testConfig(t)
+	cfg.MonitorTags = []string{"logs"}
+	p := newTestPve(t, cfg)
+	reads := 0
+	p.readConfig = func(id int) (string, error) {
+		reads++
+		switch id {
+		case 100:
+			return "tags: prod;logs\n", nil
+		case 101:
+			return "tags: prod\n", nil
+		}
+		return "", errors.New("no such VM")
+	}
+	if !p.ShouldMonitor(&VM{Id: 100}) {
+		t.Error("a VM with a required tag must be monitored")
+	}
+	if p.ShouldMonitor(&VM{Id: 101}) {
+		t.Error("a VM without the required tags must not be monitored")
+	}
+	if p.ShouldMonitor(&VM{Id: 102}) {
+		t.Error("a VM whose configuration can't be read must not be monitored")
+	}
+	// the tags are cached, but not the failures
+	p.ShouldMonitor(&VM{Id: 100})
+	p.ShouldMonitor(&VM{Id: 102})
+	if reads != 4 {
+		t.Errorf("expected 4 reads of the configurations, got %d", reads)
+	}
+	// the tags of the VMs no longer running are forgotten
+	p.pruneTags(VMs{101: &VM{Id: 101}})
+	p.ShouldMonitor(&VM{Id: 100})
+	if reads != 5 {
+		t.Errorf("the tags of a pruned VM must be read again; reads: %d", reads)
+	}
+}
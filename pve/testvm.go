@@ -0,0 +1,80 @@
+package pve
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+
+	"github.com/alberanid/pve2otelcol/ologgers"
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// monitor a single VM, printing its first records as JSON lines to standard
+// output instead of sending them to the collector, then return; with TestVMSend
+// the records are sent to the collector instead, and an error is returned
+// unless all of them are confirmed as delivered
+func (p *Pve) TestVM(id int, records int) error {
+	vm, ok := p.DiscoverVMs()[id]
+	if !ok {
+		return fmt.Errorf("VM %d not found or not running", id)
+	}
+	// same processing of a real run, but records are written synchronously to stdout
+	cfg := *p.cfg
+	if !cfg.TestVMSend {
+		cfg.OtlpExporter = "file"
+		cfg.FilePath = p.testVMOutput
+		cfg.OtlpProcessor = "simple"
+		cfg.OtlpErrorsURL = ""
+	}
+	logger, err := ologgers.New(p.ctx, &cfg, p.loggerOptions(vm))
+	if err != nil {
+		return err
+	}
+	defer logger.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, vm.MonitorCmd, vm.MonitorArgs...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// lines are read like scanOutput does, so that long ones are cut the same way
+	maxLine := max(MAX_LINE_BYTES, p.cfg.MaxRecordBytes)
+	reader := bufio.NewReader(stdout)
+	for n := 0; n < records; n++ {
+		line, cut, err := readLine(reader, maxLine)
+		if err != nil {
+			break
+		}
+		attrs := []otellog.KeyValue{}
+		if cut {
+			attrs = append(attrs, otellog.KeyValue{Key: "truncated", Value: otellog.BoolValue(true)})
+		}
+		var jData interface{}
+		if err := json.Unmarshal([]byte(line), &jData); err != nil {
+			logger.Log(line, attrs...)
+		} else {
+			logger.Log(jData, attrs...)
+		}
+	}
+	cancel()
+	cmd.Wait()
+	if !cfg.TestVMSend {
+		return nil
+	}
+	// the export errors are only reported by the counters
+	logger.ForceFlush()
+	emitted, delivered := logger.DeliveryStats()
+	if delivered < emitted {
+		return fmt.Errorf("%d of %d records queued but not confirmed by the collector", emitted-delivered, emitted)
+	}
+	slog.Info("records delivered to the collector", "vm_id", id, "records", delivered)
+	return nil
+}
@@ -0,0 +1,99 @@
+package pve
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTestVM(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	tests := []struct {
+		name    string
+		script  string
+		records int
+		want    []string
+	}{
+		{"first records only", `echo '{"MESSAGE": "one"}'; echo two; echo '{"MESSAGE": "three"}'; exec sleep 60`,
+			2, []string{"one", "two"}},
+		{"command exiting first", `echo one; echo two`, 5, []string{"one", "two"}},
+		{"lines longer than the scanner buffer", fmt.Sprintf(`echo '{"MESSAGE": "%s"}'; echo after; exec sleep 60`, long),
+			2, []string{long, "after"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := testConfig(t)
+			cfg.LXCMonitorCmd = fakeCommand(t, tt.script)
+			p := newTestPve(t, cfg)
+			p.testVMOutput = filepath.Join(t.TempDir(), "records.jsonl")
+			fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+			if err := p.TestVM(100, tt.records); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, record := range readRecords(t, p.testVMOutput) {
+				if body, ok := record["body"].(map[string]interface{}); ok {
+					got = append(got, fmt.Sprint(body["MESSAGE"]))
+				} else {
+					got = append(got, fmt.Sprint(record["body"]))
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d records printed, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("record %d = %.40q, want %.40q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTestVMNotFound(t *testing.T) {
+	cfg, _ := testConfig(t)
+	p := newTestPve(t, cfg)
+	fakePctList(p, "VMID Status Lock Name\n100 stopped web\n")
+	if err := p.TestVM(100, 1); err == nil {
+		t.Error("expected an error testing a VM not running")
+	}
+}
+
+func TestTestVMSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"records delivered", http.StatusOK, false},
+		{"records rejected", http.StatusBadRequest, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-protobuf")
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			cfg, path := testConfig(t)
+			cfg.TestVMSend = true
+			cfg.OtlpExporter = "http"
+			cfg.OtlpHTTPURL = srv.URL
+			cfg.LXCMonitorCmd = fakeCommand(t, `echo one; echo two; exec sleep 60`)
+			p := newTestPve(t, cfg)
+			fakePctList(p, "VMID Status Lock Name\n100 running web\n")
+			err := p.TestVM(100, 2)
+			if tt.wantErr && err == nil {
+				t.Error("expected an error for the records rejected by the collector")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if records := readRecords(t, path); len(records) != 0 {
+				t.Errorf("%d records printed instead of being sent", len(records))
+			}
+		})
+	}
+}
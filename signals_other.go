@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// SIGUSR1, SIGUSR2, SIGHUP and SIGQUIT are not available on this platform:
+// refreshes are only periodic, records are flushed only at exit, the attributes
+// file is read only at startup and the state of the VMs can't be dumped
+func notifyControlSignals(refresh, flush, reload, dump chan os.Signal) {}
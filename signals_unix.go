@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// deliver to the given channels the signals asking to refresh the list
+// of VMs, to flush the pending records, to reload the attributes file and
+// to dump the state of the monitored VMs; on SIGQUIT the program keeps running
+func notifyControlSignals(refresh, flush, reload, dump chan os.Signal) {
+	signal.Notify(refresh, syscall.SIGUSR1)
+	signal.Notify(flush, syscall.SIGUSR2)
+	signal.Notify(reload, syscall.SIGHUP)
+	signal.Notify(dump, syscall.SIGQUIT)
+}
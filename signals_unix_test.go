@@ -0,0 +1,111 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyControlSignals(t *testing.T) {
+	refresh := make(chan os.Signal, 1)
+	flush := make(chan os.Signal, 1)
+	reload := make(chan os.Signal, 1)
+	dump := make(chan os.Signal, 1)
+	notifyControlSignals(refresh, flush, reload, dump)
+	defer signal.Reset(syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGQUIT)
+	for sig, ch := range map[syscall.Signal]chan os.Signal{
+		syscall.SIGUSR1: refresh,
+		syscall.SIGUSR2: flush,
+		syscall.SIGHUP:  reload,
+		syscall.SIGQUIT: dump,
+	} {
+		if err := syscall.Kill(os.Getpid(), sig); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-ch:
+			if got != sig {
+				t.Errorf("received %v instead of %v", got, sig)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v not delivered", sig)
+		}
+	}
+}
+
+// the signals not available on some platforms must not break the build
+func TestBuildsWithoutUnixSignals(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cross-compiling is slow")
+	}
+	cmd := exec.Command("go", "build", "-o", os.DevNull, ".")
+	cmd.Env = append(os.Environ(), "GOOS=windows", "GOARCH=amd64")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("failure building for windows: %v\n%s", err, out)
+	}
+}
+
+// SIGQUIT dumps the state of the VMs and the program keeps running, until
+// it's stopped as usual
+func TestQuitDumpsAndKeepsRunning(t *testing.T) {
+	bin := t.TempDir()
+	// listed only after the signal handlers are installed
+	listed := filepath.Join(bin, "listed")
+	writeScript(t, bin, "pct", `touch `+listed+`
+echo "VMID       Status     Lock         Name"`)
+	cmd := exec.Command(os.Args[0], "-test.run=^$", "--", "-discovery-retries", "0", "-skip-pve",
+		"-otlp-exporter", "file", "-file-path", os.DevNull)
+	cmd.Env = append(os.Environ(), RUN_MAIN_ENV+"=1", "PATH="+bin+":"+os.Getenv("PATH"))
+	// written by the program while the test reads it
+	out, err := os.Create(filepath.Join(bin, "output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	output := func() string {
+		data, _ := os.ReadFile(out.Name())
+		return string(data)
+	}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, err := os.Stat(listed); err != nil && time.Now().Before(deadline); _, err = os.Stat(listed) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd.Process.Signal(syscall.SIGQUIT)
+	for !strings.Contains(output(), "last refresh:") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(output(), "last refresh:") {
+		t.Errorf("state not dumped on SIGQUIT:\n%s", output())
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("the program exited on SIGQUIT: %v\n%s", err, output())
+	case <-time.After(200 * time.Millisecond):
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("the program failed after SIGTERM: %v\n%s", err, output())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("the program did not stop on SIGTERM\n%s", output())
+	}
+	if !strings.Contains(output(), "stop monitoring") {
+		t.Errorf("the monitoring was not stopped:\n%s", output())
+	}
+}